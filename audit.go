@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"github.com/sirupsen/logrus"
+)
+
+// lifecycle events recorded in the audit log
+const (
+	auditCreated           = "created"
+	auditDeleted           = "deleted"
+	auditAttached          = "attached"
+	auditDetached          = "detached"
+	auditStolen            = "stolen"
+	auditMounted           = "mounted"
+	auditUnmounted         = "unmounted"
+	auditProtectionChanged = "protection-changed"
+	auditUsageWarning      = "usage-warning"
+	auditInodeWarning      = "inode-warning"
+	auditResized           = "resized"
+)
+
+const defaultAuditWebhookRetries = 3
+
+// how many events may wait for delivery to a single webhook before further ones are dropped
+const auditWebhookQueueSize = 1000
+
+// overridden in tests
+var (
+	auditWebhookBackoff = time.Second
+	auditWebhookClient  = &http.Client{Timeout: 10 * time.Second}
+)
+
+func auditLogPath() string {
+	return os.Getenv("audit_log")
+}
+
+func auditWebhooks() []string {
+	var urls []string
+	for _, u := range strings.Split(os.Getenv("audit_webhooks"), ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
+
+func auditWebhookRetries() int {
+	n, err := strconv.Atoi(os.Getenv("audit_webhook_retries"))
+	if err != nil || n < 0 {
+		return defaultAuditWebhookRetries
+	}
+	return n
+}
+
+// auditEvent is a single change to a volume, as recorded in the audit log
+type auditEvent struct {
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"`
+	Node     string    `json:"node"`
+	Volume   string    `json:"volume"`
+	VolumeID int64     `json:"volume_id,omitempty"`
+	MountID  string    `json:"mount_id,omitempty"`
+	// the server attached to, detached from or stolen from
+	Server string `json:"server,omitempty"`
+	// the new deletion protection, for protection changes
+	Protection *bool `json:"protection,omitempty"`
+	// what happened, for events not described by the fields above
+	Detail     string `json:"detail,omitempty"`
+	Outcome    string `json:"outcome"`
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
+// auditLog appends events to the audit log file and delivers them to the configured webhooks in the background, in
+// order for each webhook
+type auditLog struct {
+	// serializes appends, so lines of concurrent events don't interleave
+	mu sync.Mutex
+	// events waiting for delivery, by webhook
+	queuesMu sync.Mutex
+	queues   map[string]chan auditDelivery
+	// events not delivered yet
+	wg sync.WaitGroup
+}
+
+// auditDelivery is an encoded event to be posted to a webhook
+type auditDelivery struct {
+	event   auditEvent
+	body    []byte
+	retries int
+}
+
+// audit records an event about the docker volume name (and its cloud volume vol, if known) which started at start and
+// failed if err isn't nil. Failures to record it are only logged, since they don't affect the operation itself.
+func (hd *hetznerDriver) audit(e auditEvent, name string, vol *hcloud.Volume, start time.Time, err error) {
+	e.Time = time.Now()
+	e.Node, _ = os.Hostname()
+	e.Volume = name
+	if vol != nil {
+		e.VolumeID = vol.ID
+	}
+	e.DurationMs = e.Time.Sub(start).Milliseconds()
+	e.Outcome = "success"
+	if err != nil {
+		e.Outcome = "failure"
+		e.Error = err.Error()
+	}
+
+	hd.events.record(e)
+}
+
+func (a *auditLog) record(e auditEvent) {
+	path, webhooks := auditLogPath(), auditWebhooks()
+	if path == "" && len(webhooks) == 0 {
+		return
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		logrus.Warnf("encoding audit event: %v", err)
+		return
+	}
+
+	if path != "" {
+		if err := a.appendLine(path, b); err != nil {
+			logrus.Warnf("writing audit log: %v", err)
+		}
+	}
+
+	d := auditDelivery{event: e, body: b, retries: auditWebhookRetries()}
+	for _, url := range webhooks {
+		a.enqueue(url, d)
+	}
+}
+
+// enqueue hands an event to the delivery queue of url, starting the queue's worker on first use. Events are dropped if
+// the queue is full, rather than holding up the operation they're about.
+func (a *auditLog) enqueue(url string, d auditDelivery) {
+	a.queuesMu.Lock()
+	defer a.queuesMu.Unlock()
+
+	q, ok := a.queues[url]
+	if !ok {
+		if a.queues == nil {
+			a.queues = map[string]chan auditDelivery{}
+		}
+		q = make(chan auditDelivery, auditWebhookQueueSize)
+		a.queues[url] = q
+		go a.deliverQueued(url, q)
+	}
+
+	a.wg.Add(1)
+	select {
+	case q <- d:
+	default:
+		a.wg.Done()
+		logrus.Warnf("too many audit events waiting for delivery to webhook; dropping %s event of volume %q", d.event.Event, d.event.Volume)
+	}
+}
+
+// deliverQueued delivers the events queued for url one after another
+func (a *auditLog) deliverQueued(url string, q <-chan auditDelivery) {
+	for d := range q {
+		if err := deliverAuditEvent(url, d.body, d.retries); err != nil {
+			logrus.Warnf("delivering %s event of volume %q to webhook: %v", d.event.Event, d.event.Volume, err)
+		}
+		a.wg.Done()
+	}
+}
+
+func (a *auditLog) appendLine(path string, b []byte) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// flush waits up to timeout for queued webhook deliveries, reporting whether they all finished
+func (a *auditLog) flush(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		a.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func (a *auditLog) flushOrWarn(timeout time.Duration) {
+	if !a.flush(timeout) {
+		logrus.Warnf("audit events still being delivered to webhooks after %s; dropping them", timeout)
+	}
+}
+
+// deliverAuditEvent posts an encoded event to url, retrying failures with exponential backoff
+func deliverAuditEvent(url string, b []byte, retries int) error {
+	backoff := auditWebhookBackoff
+	for attempt := 0; ; attempt++ {
+		err := postAuditEvent(url, b)
+		if err == nil {
+			return nil
+		}
+		if attempt >= retries {
+			return fmt.Errorf("giving up after %d attempts: %w", attempt+1, err)
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func postAuditEvent(url string, b []byte) error {
+	resp, err := auditWebhookClient.Post(url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s from %s", resp.Status, url)
+	}
+	return nil
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+)
+
+func readAuditLog(t *testing.T, path string) []auditEvent {
+	t.Helper()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var events []auditEvent
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e auditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("parsing audit log line %q: %v", scanner.Text(), err)
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+func Test_loopHarness_audit(t *testing.T) {
+	t.Setenv("use_protection", "true")
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	t.Setenv("audit_log", path)
+
+	h := newLoopHarness(t)
+	hd := h.driver()
+	other := h.mock.addServer("other", "fsn1")
+
+	if err := hd.Create(&volume.CreateRequest{Name: "foo"}); err != nil {
+		t.Fatalf("hetznerDriver.Create() error = %v", err)
+	}
+	// taken over from another node
+	h.mock.attachElsewhere("foo", other)
+	if _, err := hd.Mount(&volume.MountRequest{Name: "foo", ID: "some-id"}); err != nil {
+		t.Fatalf("hetznerDriver.Mount() error = %v", err)
+	}
+	if err := hd.Unmount(&volume.UnmountRequest{Name: "foo", ID: "some-id"}); err != nil {
+		t.Fatalf("hetznerDriver.Unmount() error = %v", err)
+	}
+	if err := hd.Remove(&volume.RemoveRequest{Name: "foo"}); err != nil {
+		t.Fatalf("hetznerDriver.Remove() error = %v", err)
+	}
+	if _, err := hd.Mount(&volume.MountRequest{Name: "foo", ID: "other-id"}); err == nil {
+		t.Fatal("hetznerDriver.Mount() of removed volume succeeded")
+	}
+
+	hostname, _ := os.Hostname()
+	local, err := hd.getServerForLocalhost()
+	if err != nil {
+		t.Fatal(err)
+	}
+	type summary struct {
+		event, mountID, server, outcome string
+	}
+	want := []summary{
+		{auditCreated, "", "", "success"},
+		{auditAttached, "", hostname, "success"},
+		{auditProtectionChanged, "", "", "success"},
+		{auditStolen, "", "other", "success"},
+		{auditAttached, "", hostname, "success"},
+		{auditMounted, "some-id", "", "success"},
+		{auditUnmounted, "some-id", "", "success"},
+		// only the ID of the server is known when detaching
+		{auditDetached, "", fmt.Sprint(local.ID), "success"},
+		{auditProtectionChanged, "", "", "success"},
+		{auditDeleted, "", "", "success"},
+		{auditMounted, "other-id", "", "failure"},
+	}
+
+	events := readAuditLog(t, path)
+	var got []summary
+	for _, e := range events {
+		got = append(got, summary{e.Event, e.MountID, e.Server, e.Outcome})
+		if e.Node != hostname || e.Volume != "foo" || e.Time.IsZero() || e.DurationMs < 0 {
+			t.Errorf("audit event %+v lacks node, volume, time or duration", e)
+		}
+		if e.Outcome == "success" && e.VolumeID == 0 {
+			t.Errorf("audit event %+v lacks volume ID", e)
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("audit events = %v, want %v", got, want)
+	}
+	if p := events[2].Protection; p == nil || !*p {
+		t.Errorf("protection of first protection change = %v, want true", p)
+	}
+}
+
+func Test_auditLog_webhooks(t *testing.T) {
+	defer func(orig time.Duration) { auditWebhookBackoff = orig }(auditWebhookBackoff)
+	auditWebhookBackoff = time.Millisecond
+
+	var mu sync.Mutex
+	var delivered []auditEvent
+	var attempts, failing int
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		// fail the first two attempts
+		if attempts++; attempts <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var e auditEvent
+		b, _ := io.ReadAll(req.Body)
+		if err := json.Unmarshal(b, &e); err != nil {
+			t.Errorf("parsing webhook body %q: %v", b, err)
+		}
+		delivered = append(delivered, e)
+	}))
+	defer flaky.Close()
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		failing++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+
+	t.Setenv("audit_webhooks", flaky.URL+", "+broken.URL)
+	t.Setenv("audit_webhook_retries", "2")
+
+	hd := &hetznerDriver{}
+	hd.audit(auditEvent{Event: auditDeleted}, "foo", &hcloud.Volume{ID: 42}, time.Now(), errors.New("failed"))
+	if !hd.events.flush(time.Second) {
+		t.Fatal("auditLog.flush() = false")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(delivered) != 1 || delivered[0].Event != auditDeleted || delivered[0].VolumeID != 42 || delivered[0].Outcome != "failure" || delivered[0].Error != "failed" {
+		t.Errorf("delivered events = %+v, want failed deletion of volume 42", delivered)
+	}
+	if attempts != 3 {
+		t.Errorf("attempts on flaky webhook = %d, want 3", attempts)
+	}
+	if failing != 3 {
+		t.Errorf("attempts on broken webhook = %d, want 3", failing)
+	}
+}
+
+func Test_auditLog_webhookOrder(t *testing.T) {
+	defer func(orig time.Duration) { auditWebhookBackoff = orig }(auditWebhookBackoff)
+	auditWebhookBackoff = 10 * time.Millisecond
+
+	var mu sync.Mutex
+	var delivered []string
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		// fail the first attempt, so later events would overtake the first one if delivered concurrently
+		if attempts++; attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var e auditEvent
+		if err := json.NewDecoder(req.Body).Decode(&e); err != nil {
+			t.Errorf("parsing webhook body: %v", err)
+		}
+		delivered = append(delivered, e.Volume)
+	}))
+	defer srv.Close()
+
+	t.Setenv("audit_webhooks", srv.URL)
+	t.Setenv("audit_webhook_retries", "1")
+
+	hd := &hetznerDriver{}
+	want := []string{"foo", "bar", "baz"}
+	for _, name := range want {
+		hd.audit(auditEvent{Event: auditCreated}, name, nil, time.Now(), nil)
+	}
+	if !hd.events.flush(time.Second) {
+		t.Fatal("auditLog.flush() = false")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(delivered, want) {
+		t.Errorf("delivered events = %v, want %v", delivered, want)
+	}
+}
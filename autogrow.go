@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	defaultAutogrowStep     = 10
+	defaultAutogrowCooldown = 10 * time.Minute
+)
+
+// autogrowCooldown is how long to wait after growing a volume (or failing to) before growing it again, so the
+// filesystem's usage can settle and a misbehaving container doesn't grow it to its ceiling at once
+func autogrowCooldown() time.Duration {
+	d, err := time.ParseDuration(os.Getenv("autogrow_cooldown"))
+	if err != nil || d < 0 {
+		return defaultAutogrowCooldown
+	}
+	return d
+}
+
+// autogrowConfig describes how a volume grows when its filesystem fills up
+type autogrowConfig struct {
+	// percentage of used space triggering growth
+	threshold float64
+	// GB to grow by
+	step int
+	// GB never to grow beyond
+	max int
+}
+
+// autogrowFromOptions returns the autogrow configuration given in opts for a new volume of the given size, or nil if
+// autogrow_threshold isn't set. Without autogrow_max, volumes grow up to max_size, or else the largest size supported.
+func autogrowFromOptions(opts map[string]string, size int) (*autogrowConfig, error) {
+	v := getOption("autogrow_threshold", opts)
+	if v == "" {
+		return nil, nil
+	}
+	threshold, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(v), "%"), 64)
+	if err != nil || threshold < 0 || threshold >= 100 {
+		return nil, fmt.Errorf("invalid autogrow_threshold %q: must be a percentage below 100", v)
+	}
+	if threshold == 0 {
+		return nil, nil
+	}
+
+	c := &autogrowConfig{threshold: threshold, step: defaultAutogrowStep, max: apiMaxSize}
+	if v := getOption("autogrow_step", opts); v != "" {
+		if c.step, err = parseSize(v); err != nil {
+			return nil, fmt.Errorf("invalid autogrow_step: %w", err)
+		}
+		if c.step < 1 {
+			return nil, fmt.Errorf("invalid autogrow_step %q: must be at least 1GB", v)
+		}
+	}
+	if v := getOption("autogrow_max", opts); v != "" {
+		if c.max, err = parseSize(v); err != nil {
+			return nil, fmt.Errorf("invalid autogrow_max: %w", err)
+		}
+	} else if maxSize, err := limitOption("max_size"); err != nil {
+		return nil, err
+	} else if maxSize > 0 {
+		c.max = maxSize
+	}
+	if c.max < size {
+		return nil, fmt.Errorf("autogrow_max of %dGB is below the volume's size of %dGB", c.max, size)
+	}
+	return c, nil
+}
+
+func (c *autogrowConfig) setLabels(labels map[string]string) {
+	labels[autogrowThresholdLabel] = strconv.FormatFloat(c.threshold, 'f', -1, 64)
+	labels[autogrowStepLabel] = strconv.Itoa(c.step)
+	labels[autogrowMaxLabel] = strconv.Itoa(c.max)
+}
+
+// autogrowFromLabels returns the autogrow configuration recorded on a volume, or nil if it doesn't grow automatically
+func autogrowFromLabels(labels map[string]string) *autogrowConfig {
+	v, ok := labels[autogrowThresholdLabel]
+	if !ok {
+		return nil
+	}
+	c := &autogrowConfig{}
+	var errs [3]error
+	c.threshold, errs[0] = strconv.ParseFloat(v, 64)
+	c.step, errs[1] = strconv.Atoi(labels[autogrowStepLabel])
+	c.max, errs[2] = strconv.Atoi(labels[autogrowMaxLabel])
+	for _, err := range errs {
+		if err != nil {
+			logrus.Warnf("ignoring broken autogrow labels %v: %v", labels, err)
+			return nil
+		}
+	}
+	return c
+}
+
+// autogrowState rate limits the growth of each volume
+type autogrowState struct {
+	mu   sync.Mutex
+	last map[string]time.Time
+}
+
+// attempt records an attempt to grow the volume at the given time, unless it was attempted less than cooldown before
+func (s *autogrowState) attempt(name string, now time.Time, cooldown time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if last, ok := s.last[name]; ok && now.Sub(last) < cooldown {
+		return false
+	}
+	if s.last == nil {
+		s.last = map[string]time.Time{}
+	}
+	s.last[name] = now
+	return true
+}
+
+// autogrowCeiling returns the size the volume may grow to, limited by its autogrow_max, the max_size setting and what's
+// left of max_total_size
+func (hd *hetznerDriver) autogrowCeiling(vol *hcloud.Volume, c *autogrowConfig) (int, error) {
+	ceiling := min(c.max, apiMaxSize)
+
+	maxSize, err := limitOption("max_size")
+	if err != nil {
+		return 0, err
+	}
+	if maxSize > 0 {
+		ceiling = min(ceiling, maxSize)
+	}
+
+	maxTotalSize, err := limitOption("max_total_size")
+	if err != nil {
+		return 0, err
+	}
+	if maxTotalSize > 0 {
+		vols, err := hd.labelledVolumes()
+		if err != nil {
+			return 0, err
+		}
+		total := 0
+		for _, v := range vols {
+			total += v.Size
+		}
+		ceiling = min(ceiling, vol.Size+maxTotalSize-total)
+	}
+
+	return ceiling, nil
+}
+
+// growVolume grows a mounted volume by its autogrow step, up to its ceiling: it resizes the cloud volume, makes the
+// kernel notice and then grows the filesystem online. Filesystems lagging behind their device, e.g. after growing them
+// failed, are only grown to catch up.
+func (hd *hetznerDriver) growVolume(m mountedVolume, c *autogrowConfig, u volumeUsage) error {
+	if devSize, err := deviceSize(m.vol.LinuxDevice); err != nil {
+		return err
+	} else if u.SizeBytes < devSize*9/10 {
+		logrus.Infof("growing filesystem of volume %q to the size of its device", m.vol.Name)
+		return growFilesystem(m.vol.LinuxDevice, m.mountpoint)
+	}
+
+	size, err := hd.growWithinLimits(m.vol, c)
+	if err != nil || size == 0 {
+		return err
+	}
+	// the kernel usually notices resized disks on its own, so growing the filesystem is worth a try anyway
+	if err := rescanDevice(m.vol.LinuxDevice); err != nil {
+		logrus.Warnf("%v", err)
+	}
+	if err := growFilesystem(m.vol.LinuxDevice, m.mountpoint); err != nil {
+		return err
+	}
+	logrus.Infof("volume %q grown to %dGB", m.vol.Name, size)
+	return nil
+}
+
+// growWithinLimits resizes the volume by one step, up to its ceiling, and returns the new size or 0 if it can't grow.
+// Like creating volumes, computing the ceiling and resizing happen under limitsMu.
+func (hd *hetznerDriver) growWithinLimits(vol *hcloud.Volume, c *autogrowConfig) (int, error) {
+	hd.limitsMu.Lock()
+	defer hd.limitsMu.Unlock()
+
+	ceiling, err := hd.autogrowCeiling(vol, c)
+	if err != nil {
+		return 0, err
+	}
+	size := min(vol.Size+c.step, ceiling)
+	if size <= vol.Size {
+		logrus.Warnf("volume %q can't grow beyond its ceiling of %dGB", vol.Name, vol.Size)
+		return 0, nil
+	}
+
+	logrus.Infof("growing volume %q from %dGB to %dGB", vol.Name, vol.Size, size)
+	if err := hd.resizeVolume(vol, size); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+func (hd *hetznerDriver) resizeVolume(vol *hcloud.Volume, size int) (err error) {
+	start := time.Now()
+	defer func() {
+		detail := fmt.Sprintf("from %dGB to %dGB", vol.Size, size)
+		hd.audit(auditEvent{Event: auditResized, Detail: detail}, unprefixedName(vol), vol, start, err)
+	}()
+
+	act, _, err := hd.client.Volume().Resize(context.Background(), vol, size)
+	hd.noteMutation(err)
+	if err != nil {
+		return fmt.Errorf("resizing volume %q to %dGB: %w", vol.Name, size, err)
+	}
+	if err := hd.waitForAction(act); err != nil {
+		return fmt.Errorf("waiting for volume resize on %q: %w", vol.Name, err)
+	}
+	return nil
+}
+
+// rescanDevice makes the kernel re-read the size of the disk behind dev, through the read-write /sys of config.json
+func rescanDevice(dev string) error {
+	realDev, err := filepath.EvalSymlinks(dev)
+	if err != nil {
+		return fmt.Errorf("resolving device %q: %w", dev, err)
+	}
+	rescan := filepath.Join(sysfsPath, "class/block", filepath.Base(realDev), "device/rescan")
+	if err := os.WriteFile(rescan, []byte("1"), 0o200); err != nil {
+		return fmt.Errorf("rescanning device %q: %w", dev, err)
+	}
+	return nil
+}
+
+// deviceSize returns the size in bytes of the block device dev
+func deviceSize(dev string) (uint64, error) {
+	f, err := os.Open(dev)
+	if err != nil {
+		return 0, fmt.Errorf("opening device %q: %w", dev, err)
+	}
+	defer f.Close()
+
+	var size uint64
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), unix.BLKGETSIZE64, uintptr(unsafe.Pointer(&size))); errno != 0 {
+		return 0, fmt.Errorf("getting size of device %q: %w", dev, errno)
+	}
+	return size, nil
+}
+
+// growFilesystem grows the filesystem on dev mounted on mountpoint to the size of dev
+func growFilesystem(dev, mountpoint string) error {
+	var st unix.Statfs_t
+	if err := unix.Statfs(mountpoint, &st); err != nil {
+		return fmt.Errorf("getting filesystem type of %s: %w", mountpoint, err)
+	}
+
+	var cmd *exec.Cmd
+	switch st.Type {
+	case unix.EXT4_SUPER_MAGIC: // also ext2 and ext3
+		cmd = exec.Command("resize2fs", dev)
+	case unix.XFS_SUPER_MAGIC:
+		cmd = exec.Command("xfs_growfs", mountpoint)
+	default:
+		return fmt.Errorf("growing filesystem on %s: unsupported filesystem type %#x", mountpoint, st.Type)
+	}
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("growing filesystem on %s: %w: %s", mountpoint, err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// autogrowVolumes grows the given volumes whose usage crossed their autogrow threshold, unless grown recently
+func (hd *hetznerDriver) autogrowVolumes(mounted []mountedVolume, usage map[string]volumeUsage, now time.Time) {
+	cooldown := autogrowCooldown()
+	for _, m := range mounted {
+		c := autogrowFromLabels(m.vol.Labels)
+		// read-only volumes don't fill up, and can't be grown while mounted read-only
+		if c == nil || m.vol.Labels[readonlyLabel] == "true" {
+			continue
+		}
+		name := unprefixedName(m.vol)
+		u, ok := usage[name]
+		if !ok || u.usedPercent() < c.threshold {
+			continue
+		}
+		if !hd.autogrow.attempt(name, now, cooldown) {
+			logrus.Infof("volume %q is above its autogrow threshold, but was grown less than %s ago", m.vol.Name, cooldown)
+			continue
+		}
+		if err := hd.growVolume(m, c, u); err != nil {
+			logrus.Errorf("growing volume %q: %v", m.vol.Name, err)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+	"golang.org/x/sys/unix"
+)
+
+func Test_autogrowFromOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    map[string]string
+		maxSize string
+		want    *autogrowConfig
+		wantErr bool
+	}{
+		{"disabled", map[string]string{}, "", nil, false},
+		{"zero threshold", map[string]string{"autogrow_threshold": "0"}, "", nil, false},
+		{"defaults", map[string]string{"autogrow_threshold": "80"}, "", &autogrowConfig{80, defaultAutogrowStep, apiMaxSize}, false},
+		{"units", map[string]string{"autogrow_threshold": "85.5%", "autogrow_step": "50G", "autogrow_max": "1T"}, "", &autogrowConfig{85.5, 50, 1000}, false},
+		{"max_size", map[string]string{"autogrow_threshold": "80"}, "200", &autogrowConfig{80, defaultAutogrowStep, 200}, false},
+		{"autogrow_max over max_size", map[string]string{"autogrow_threshold": "80", "autogrow_max": "500"}, "200", &autogrowConfig{80, defaultAutogrowStep, 500}, false},
+		{"invalid threshold", map[string]string{"autogrow_threshold": "full"}, "", nil, true},
+		{"threshold too high", map[string]string{"autogrow_threshold": "100"}, "", nil, true},
+		{"invalid step", map[string]string{"autogrow_threshold": "80", "autogrow_step": "lots"}, "", nil, true},
+		{"max below size", map[string]string{"autogrow_threshold": "80", "autogrow_max": "10"}, "", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("max_size", tt.maxSize)
+
+			got, err := autogrowFromOptions(tt.opts, 20)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("autogrowFromOptions() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("autogrowFromOptions() = %+v, want %+v", got, tt.want)
+			}
+			if got == nil {
+				return
+			}
+
+			labels := map[string]string{}
+			got.setLabels(labels)
+			if fromLabels := autogrowFromLabels(labels); !reflect.DeepEqual(fromLabels, got) {
+				t.Errorf("autogrowFromLabels() = %+v, want %+v", fromLabels, got)
+			}
+		})
+	}
+}
+
+func Test_autogrowState_attempt(t *testing.T) {
+	var s autogrowState
+	now := time.Now()
+
+	if !s.attempt("foo", now, time.Minute) {
+		t.Error("first attempt refused")
+	}
+	if s.attempt("foo", now.Add(30*time.Second), time.Minute) {
+		t.Error("attempt within cooldown allowed")
+	}
+	if !s.attempt("bar", now.Add(30*time.Second), time.Minute) {
+		t.Error("attempt for other volume refused")
+	}
+	if !s.attempt("foo", now.Add(time.Minute), time.Minute) {
+		t.Error("attempt after cooldown refused")
+	}
+}
+
+// hasCapability reports whether the process has the given effective capability
+func hasCapability(capability int) bool {
+	b, err := os.ReadFile("/proc/self/status")
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if v, ok := strings.CutPrefix(line, "CapEff:"); ok {
+			caps, err := strconv.ParseUint(strings.TrimSpace(v), 16, 64)
+			return err == nil && caps&(1<<capability) != 0
+		}
+	}
+	return false
+}
+
+func Test_loopHarness_autogrow(t *testing.T) {
+	t.Setenv("use_protection", "false")
+	t.Setenv("autogrow_cooldown", "1h")
+
+	h := newLoopHarness(t)
+	hd := h.driver()
+
+	opts := map[string]string{"autogrow_threshold": "1", "autogrow_step": "10", "autogrow_max": "25"}
+	if err := hd.Create(&volume.CreateRequest{Name: "foo", Options: opts}); err != nil {
+		t.Fatalf("hetznerDriver.Create() error = %v", err)
+	}
+	resp, err := hd.Mount(&volume.MountRequest{Name: "foo", ID: "some-id"})
+	if err != nil {
+		t.Fatalf("hetznerDriver.Mount() error = %v", err)
+	}
+	t.Cleanup(func() { _ = hd.Unmount(&volume.UnmountRequest{Name: "foo", ID: "some-id"}) })
+
+	// read-only volumes are never grown, even above their threshold
+	opts["readonly"] = "true"
+	if err := hd.Create(&volume.CreateRequest{Name: "bar", Options: opts}); err != nil {
+		t.Fatalf("hetznerDriver.Create() error = %v", err)
+	}
+	if _, err := hd.Mount(&volume.MountRequest{Name: "bar", ID: "other-id"}); err != nil {
+		t.Fatalf("hetznerDriver.Mount() error = %v", err)
+	}
+	t.Cleanup(func() { _ = hd.Unmount(&volume.UnmountRequest{Name: "bar", ID: "other-id"}) })
+
+	// failing to rescan the device doesn't keep the filesystem from growing
+	vol, err := hd.getVolume("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev, err := filepath.EvalSymlinks(vol.LinuxDevice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(sysfsPath, "class/block", filepath.Base(dev), "device/rescan"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := statUsage(resp.Mountpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// fill the volume past the threshold
+	if err := os.WriteFile(filepath.Join(resp.Mountpoint, "data"), make([]byte, before.SizeBytes/50), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	resizes := func() []string {
+		var calls []string
+		for _, call := range h.mock.getCalls() {
+			if strings.HasPrefix(call, "Volume.Resize") {
+				calls = append(calls, call)
+			}
+		}
+		return calls
+	}
+
+	// grown once, and then held back by the cooldown
+	for i := 0; i < 2; i++ {
+		if err := hd.checkUsage(); err != nil {
+			t.Fatalf("hetznerDriver.checkUsage() error = %v", err)
+		}
+	}
+	if got, want := resizes(), []string{"Volume.Resize docker-foo 20"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("resize calls = %v, want %v", got, want)
+	}
+	after, err := statUsage(resp.Mountpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasCapability(unix.CAP_SYS_RESOURCE) {
+		t.Log("not checking filesystem size, growing ext4 online needs CAP_SYS_RESOURCE")
+	} else if after.SizeBytes < before.SizeBytes*3/2 {
+		t.Errorf("filesystem size after growing = %d, want about twice %d", after.SizeBytes, before.SizeBytes)
+	}
+
+	// grown up to autogrow_max, and no further
+	t.Setenv("autogrow_cooldown", "0s")
+	for i := 0; i < 2; i++ {
+		if err := hd.checkUsage(); err != nil {
+			t.Fatalf("hetznerDriver.checkUsage() error = %v", err)
+		}
+	}
+	want := []string{"Volume.Resize docker-foo 20", "Volume.Resize docker-foo 25"}
+	if !hasCapability(unix.CAP_SYS_RESOURCE) {
+		// the filesystem never caught up with the first resize, so the volume isn't resized again
+		want = want[:1]
+	}
+	if got := resizes(); !reflect.DeepEqual(got, want) {
+		t.Errorf("resize calls = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/docker/docker/pkg/mount"
+	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+)
+
+// cliCommand is an operator subcommand, run instead of serving the docker socket when given on the command line
+type cliCommand struct {
+	usage string
+	run   func(hd *hetznerDriver, out io.Writer, args []string) error
+}
+
+var cliCommands = map[string]cliCommand{
+	"doctor":    {"doctor", cmdDoctor},
+	"ls":        {"ls", cmdList},
+	"inspect":   {"inspect <name>", cmdInspect},
+	"attach":    {"attach [--force] <name>", cmdAttach},
+	"detach":    {"detach <name>", cmdDetach},
+	"protect":   {"protect <name>", cmdProtect(true)},
+	"unprotect": {"unprotect <name>", cmdProtect(false)},
+	"gc":        {"gc [--dry-run]", cmdGC},
+	"rm":        {"rm [--force] <name>", cmdRemove},
+}
+
+var errUsage = errors.New("invalid usage")
+
+// runCLI runs the subcommand given in args and returns the process exit code
+func runCLI(hd *hetznerDriver, args []string) int {
+	cmd, ok := cliCommands[args[0]]
+	if !ok {
+		printUsage(os.Stderr)
+		return 2
+	}
+
+	if err := checkCLIPoolMode(args[0]); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+
+	// deliver the command's audit events before exiting
+	defer hd.events.flushOrWarn(shutdownTimeout())
+
+	if err := cmd.run(hd, os.Stdout, args[1:]); err != nil {
+		if errors.Is(err, errUsage) {
+			fmt.Fprintf(os.Stderr, "usage: %s %s\n", os.Args[0], cmd.usage)
+			return 2
+		}
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+
+	return 0
+}
+
+// checkCLIPoolMode refuses commands acting on cloud volumes in pool mode, where docker volumes are directories of the
+// pool rather than cloud volumes of their own
+func checkCLIPoolMode(name string) error {
+	if poolName() != "" && name != "doctor" {
+		return fmt.Errorf("%s is not supported in pool mode; use the docker volume commands instead", name)
+	}
+	return nil
+}
+
+func printUsage(w io.Writer) {
+	names := make([]string, 0, len(cliCommands))
+	for name := range cliCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(w, "usage: %s [command]\n\nWithout a command, serves the docker plugin socket. Commands:\n", os.Args[0])
+	for _, name := range names {
+		fmt.Fprintf(w, "  %s\n", cliCommands[name].usage)
+	}
+}
+
+// parseCLIArgs parses flags into fs and returns the single expected positional argument, if wantName is set
+func parseCLIArgs(fs *flag.FlagSet, args []string, wantName bool) (string, error) {
+	fs.SetOutput(io.Discard)
+	if err := fs.Parse(args); err != nil {
+		return "", errUsage
+	}
+	switch {
+	case wantName && fs.NArg() == 1:
+		return fs.Arg(0), nil
+	case !wantName && fs.NArg() == 0:
+		return "", nil
+	default:
+		return "", errUsage
+	}
+}
+
+// managedVolumes returns all cloud volumes belonging to this plugin's prefix
+func (hd *hetznerDriver) managedVolumes() ([]*hcloud.Volume, error) {
+	vols, err := hd.client.Volume().All(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("listing volumes: %w", err)
+	}
+
+	managed := make([]*hcloud.Volume, 0, len(vols))
+	for _, vol := range vols {
+		if nameHasPrefix(vol.Name) {
+			managed = append(managed, vol)
+		}
+	}
+	return managed, nil
+}
+
+// serverNames resolves server IDs to names, caching the results
+type serverNames struct {
+	hd    *hetznerDriver
+	names map[int64]string
+}
+
+func (sn *serverNames) get(srv *hcloud.Server) string {
+	if srv == nil || srv.ID == 0 {
+		return ""
+	}
+	if name, ok := sn.names[srv.ID]; ok {
+		return name
+	}
+	name := strconv.FormatInt(srv.ID, 10)
+	if s, _, err := sn.hd.client.Server().GetByID(context.Background(), srv.ID); err == nil && s != nil {
+		name = s.Name
+	}
+	sn.names[srv.ID] = name
+	return name
+}
+
+func cmdList(hd *hetznerDriver, out io.Writer, args []string) error {
+	if _, err := parseCLIArgs(flag.NewFlagSet("ls", flag.ContinueOnError), args, false); err != nil {
+		return err
+	}
+
+	vols, err := hd.managedVolumes()
+	if err != nil {
+		return err
+	}
+	sort.Slice(vols, func(i, j int) bool { return vols[i].Name < vols[j].Name })
+
+	servers := &serverNames{hd: hd, names: map[int64]string{}}
+
+	tw := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tID\tLOCATION\tSIZE\tATTACHED TO\tPROTECTED")
+	for _, vol := range vols {
+		location := ""
+		if vol.Location != nil {
+			location = vol.Location.Name
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%dGB\t%s\t%t\n",
+			unprefixedName(vol), vol.ID, location, vol.Size, servers.get(vol.Server), vol.Protection.Delete)
+	}
+	return tw.Flush()
+}
+
+type inspectOutput struct {
+	Name        string            `json:"name"`
+	CloudName   string            `json:"cloud_name"`
+	ID          int64             `json:"id"`
+	Status      string            `json:"status"`
+	Location    string            `json:"location,omitempty"`
+	Size        int               `json:"size_gb"`
+	Format      string            `json:"format,omitempty"`
+	AttachedTo  string            `json:"attached_to,omitempty"`
+	Protected   bool              `json:"protected"`
+	LinuxDevice string            `json:"linux_device"`
+	Mountpoint  string            `json:"mountpoint,omitempty"`
+	Labels      map[string]string `json:"labels"`
+	Created     time.Time         `json:"created"`
+}
+
+func cmdInspect(hd *hetznerDriver, out io.Writer, args []string) error {
+	name, err := parseCLIArgs(flag.NewFlagSet("inspect", flag.ContinueOnError), args, true)
+	if err != nil {
+		return err
+	}
+
+	vol, err := hd.getVolume(name)
+	if err != nil {
+		return err
+	}
+
+	mounts, err := getMounts()
+	if err != nil {
+		return fmt.Errorf("getting local mounts: %w", err)
+	}
+	mountpoint, _ := deviceMountpoint(mounts, vol.LinuxDevice)
+
+	info := inspectOutput{
+		Name:        unprefixedName(vol),
+		CloudName:   vol.Name,
+		ID:          vol.ID,
+		Status:      string(vol.Status),
+		Size:        vol.Size,
+		AttachedTo:  (&serverNames{hd: hd, names: map[int64]string{}}).get(vol.Server),
+		Protected:   vol.Protection.Delete,
+		LinuxDevice: vol.LinuxDevice,
+		Mountpoint:  mountpoint,
+		Labels:      vol.Labels,
+		Created:     vol.Created,
+	}
+	if vol.Location != nil {
+		info.Location = vol.Location.Name
+	}
+	if vol.Format != nil {
+		info.Format = *vol.Format
+	}
+
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(info)
+}
+
+func cmdAttach(hd *hetznerDriver, out io.Writer, args []string) error {
+	fs := flag.NewFlagSet("attach", flag.ContinueOnError)
+	force := fs.Bool("force", false, "detach the volume from another server first")
+	name, err := parseCLIArgs(fs, args, true)
+	if err != nil {
+		return err
+	}
+
+	vol, err := hd.getVolume(name)
+	if err != nil {
+		return err
+	}
+
+	srv, err := hd.getServerForLocalhost()
+	if err != nil {
+		return err
+	}
+
+	// unlike mounting, attaching never re-creates volumes in another location
+	if err := checkSameLocation(vol, srv); err != nil {
+		return err
+	}
+
+	if vol.Server != nil && vol.Server.ID != 0 {
+		if vol.Server.ID == srv.ID {
+			fmt.Fprintf(out, "%s already attached to %s\n", name, srv.Name)
+			return nil
+		}
+		if !*force {
+			return fmt.Errorf("volume %q is attached to another server (%d); use --force to take it over", vol.Name, vol.Server.ID)
+		}
+		if err := hd.stealVolume(vol); err != nil {
+			return err
+		}
+	}
+
+	if err := hd.attachVolume(vol, srv); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "%s attached to %s\n", name, srv.Name)
+	return nil
+}
+
+func cmdDetach(hd *hetznerDriver, out io.Writer, args []string) error {
+	name, err := parseCLIArgs(flag.NewFlagSet("detach", flag.ContinueOnError), args, true)
+	if err != nil {
+		return err
+	}
+
+	vol, err := hd.getVolume(name)
+	if err != nil {
+		return err
+	}
+
+	if vol.Server == nil || vol.Server.ID == 0 {
+		fmt.Fprintf(out, "%s not attached\n", name)
+		return nil
+	}
+
+	mounts, err := getMounts()
+	if err != nil {
+		return fmt.Errorf("getting local mounts: %w", err)
+	}
+	if mountpoint, ok := deviceMountpoint(mounts, vol.LinuxDevice); ok {
+		return fmt.Errorf("volume %q is mounted on %s; unmount it first", vol.Name, mountpoint)
+	}
+
+	if err := hd.detachVolume(vol); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "%s detached\n", name)
+	return nil
+}
+
+func cmdProtect(protect bool) func(*hetznerDriver, io.Writer, []string) error {
+	return func(hd *hetznerDriver, out io.Writer, args []string) error {
+		name, err := parseCLIArgs(flag.NewFlagSet("protect", flag.ContinueOnError), args, true)
+		if err != nil {
+			return err
+		}
+
+		vol, err := hd.getVolume(name)
+		if err != nil {
+			return err
+		}
+
+		if err := hd.setProtection(vol, protect); err != nil {
+			return err
+		}
+
+		fmt.Fprintf(out, "%s protection set to %t\n", name, protect)
+		return nil
+	}
+}
+
+// cmdGC detaches volumes attached to the local server but not mounted on it, e.g. left behind by a crash
+func cmdGC(hd *hetznerDriver, out io.Writer, args []string) error {
+	fs := flag.NewFlagSet("gc", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "only print what would be detached")
+	if _, err := parseCLIArgs(fs, args, false); err != nil {
+		return err
+	}
+
+	vols, err := hd.unusedLocalVolumes()
+	if err != nil {
+		return err
+	}
+
+	for _, vol := range vols {
+		if *dryRun {
+			fmt.Fprintf(out, "would detach %s\n", unprefixedName(vol))
+			continue
+		}
+		if err := hd.detachVolume(vol); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "detached %s\n", unprefixedName(vol))
+	}
+
+	return nil
+}
+
+func cmdRemove(hd *hetznerDriver, out io.Writer, args []string) error {
+	fs := flag.NewFlagSet("rm", flag.ContinueOnError)
+	force := fs.Bool("force", false, "remove even if attached or protected, unmounting it locally if needed")
+	name, err := parseCLIArgs(fs, args, true)
+	if err != nil {
+		return err
+	}
+
+	vol, err := hd.getVolume(name)
+	if err != nil {
+		return err
+	}
+
+	if !*force {
+		if vol.Server != nil && vol.Server.ID != 0 {
+			return fmt.Errorf("volume %q is attached to server %d; use --force to remove it anyway", vol.Name, vol.Server.ID)
+		}
+		if vol.Protection.Delete {
+			return fmt.Errorf("volume %q is protected; use --force to remove it anyway", vol.Name)
+		}
+	} else if err := forceRemovable(hd, out, vol); err != nil {
+		return err
+	}
+
+	if err := hd.Remove(&volume.RemoveRequest{Name: name}); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "%s removed\n", name)
+	return nil
+}
+
+// forceRemovable unmounts vol locally and lifts its protection, so it can be removed
+func forceRemovable(hd *hetznerDriver, out io.Writer, vol *hcloud.Volume) error {
+	mounts, err := mount.GetMounts()
+	if err != nil {
+		return fmt.Errorf("getting local mounts: %w", err)
+	}
+	realDev, _ := filepath.EvalSymlinks(vol.LinuxDevice)
+	for _, m := range mounts {
+		if m.Source == vol.LinuxDevice || (realDev != "" && m.Source == realDev) {
+			if err := unmountVolume(m.Mountpoint); err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "unmounted %s\n", m.Mountpoint)
+		}
+	}
+
+	// Remove only lifts the protection it's responsible for
+	if vol.Protection.Delete && !unprotectsOnRemove(vol) {
+		if err := hd.setProtection(vol, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+)
+
+func Test_parseCLIArgs(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		wantName bool
+		want     string
+		wantErr  bool
+	}{
+		{"name", []string{"foo"}, true, "foo", false},
+		{"missing name", nil, true, "", true},
+		{"too many names", []string{"foo", "bar"}, true, "", true},
+		{"no name", nil, false, "", false},
+		{"unexpected name", []string{"foo"}, false, "", true},
+		{"unknown flag", []string{"--bogus", "foo"}, true, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseCLIArgs(flag.NewFlagSet("test", flag.ContinueOnError), tt.args, tt.wantName)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseCLIArgs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, errUsage) {
+				t.Errorf("parseCLIArgs() error = %v, want %v", err, errUsage)
+			}
+			if got != tt.want {
+				t.Errorf("parseCLIArgs() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_cmdList(t *testing.T) {
+	m := newMockClient()
+	other := m.addServer("other", "fsn1")
+	m.addVolume("foo", "fsn1", other)
+	m.addVolume("bar", "nbg1", nil)
+	hd := &hetznerDriver{client: m}
+
+	var out bytes.Buffer
+	if err := cmdList(hd, &out, nil); err != nil {
+		t.Fatalf("cmdList() error = %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("cmdList() output = %q, want header and 2 volumes", out.String())
+	}
+	if fields := strings.Fields(lines[1]); fields[0] != "bar" || fields[2] != "nbg1" {
+		t.Errorf("cmdList() first volume = %q, want bar in nbg1", lines[1])
+	}
+	if fields := strings.Fields(lines[2]); fields[0] != "foo" || fields[4] != "other" {
+		t.Errorf("cmdList() second volume = %q, want foo attached to other", lines[2])
+	}
+}
+
+func Test_cmdAttach(t *testing.T) {
+	tests := []struct {
+		name       string
+		attachedTo string
+		args       []string
+		wantErr    bool
+		wantCalls  []string
+	}{
+		{"detached", "", []string{"foo"}, false, []string{"Volume.Attach docker-foo <local>"}},
+		{"attached locally", "local", []string{"foo"}, false, nil},
+		{"attached elsewhere", "other", []string{"foo"}, true, nil},
+		{"taken over", "other", []string{"--force", "foo"}, false, []string{"Volume.Detach docker-foo", "Volume.Attach docker-foo <local>"}},
+		{"pending elsewhere", "pending", []string{"foo"}, true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMockClient()
+			var srv *hcloud.Server
+			switch tt.attachedTo {
+			case "local":
+				srv = m.servers[1]
+			case "other":
+				srv = m.addServer("other", "fsn1")
+			}
+			if tt.attachedTo == "pending" {
+				m.addVolume("foo", "nbg1", nil).Labels[stateLabel] = statePending
+			} else {
+				m.addVolume("foo", "fsn1", srv)
+			}
+			hd := &hetznerDriver{client: m}
+
+			err := cmdAttach(hd, &bytes.Buffer{}, tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("cmdAttach() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var want []string
+			for _, call := range tt.wantCalls {
+				want = append(want, strings.ReplaceAll(call, "<local>", m.servers[1].Name))
+			}
+			if got := mutatingCalls(m); !reflect.DeepEqual(got, want) {
+				t.Errorf("calls = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func Test_cmdDetach(t *testing.T) {
+	tests := []struct {
+		name      string
+		attached  bool
+		wantCalls []string
+	}{
+		{"attached", true, []string{"Volume.Detach docker-foo"}},
+		{"detached", false, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMockClient()
+			var srv *hcloud.Server
+			if tt.attached {
+				srv = m.addServer("other", "fsn1")
+			}
+			m.addVolume("foo", "fsn1", srv)
+			hd := &hetznerDriver{client: m}
+
+			if err := cmdDetach(hd, &bytes.Buffer{}, []string{"foo"}); err != nil {
+				t.Errorf("cmdDetach() error = %v", err)
+			}
+			if got := mutatingCalls(m); !reflect.DeepEqual(got, tt.wantCalls) {
+				t.Errorf("calls = %v, want %v", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func Test_loopHarness_cmdDetach_mounted(t *testing.T) {
+	t.Setenv("use_protection", "false")
+
+	h := newLoopHarness(t)
+	hd := h.driver()
+
+	if err := hd.Create(&volume.CreateRequest{Name: "foo"}); err != nil {
+		t.Fatalf("hetznerDriver.Create() error = %v", err)
+	}
+	if _, err := hd.Mount(&volume.MountRequest{Name: "foo", ID: "some-id"}); err != nil {
+		t.Fatalf("hetznerDriver.Mount() error = %v", err)
+	}
+	t.Cleanup(func() { _ = hd.Unmount(&volume.UnmountRequest{Name: "foo", ID: "some-id"}) })
+
+	if err := cmdDetach(hd, &bytes.Buffer{}, []string{"foo"}); err == nil || !strings.Contains(err.Error(), "mounted") {
+		t.Errorf("cmdDetach() error = %v, want refusal of mounted volume", err)
+	}
+	for _, call := range h.mock.getCalls() {
+		if strings.HasPrefix(call, "Volume.Detach") {
+			t.Errorf("mounted volume detached: %v", h.mock.getCalls())
+		}
+	}
+}
+
+func Test_cmdProtect(t *testing.T) {
+	m := newMockClient()
+	vol := m.addVolume("foo", "fsn1", nil)
+	hd := &hetznerDriver{client: m}
+
+	if err := cmdProtect(true)(hd, &bytes.Buffer{}, []string{"foo"}); err != nil {
+		t.Fatalf("protect error = %v", err)
+	}
+	if !vol.Protection.Delete {
+		t.Error("volume not protected")
+	}
+	if err := cmdProtect(false)(hd, &bytes.Buffer{}, []string{"foo"}); err != nil {
+		t.Fatalf("unprotect error = %v", err)
+	}
+	if vol.Protection.Delete {
+		t.Error("volume still protected")
+	}
+}
+
+func Test_cmdGC(t *testing.T) {
+	m := newMockClient()
+	m.addVolume("local", "fsn1", m.servers[1])
+	m.addVolume("other", "fsn1", m.addServer("other", "fsn1"))
+	m.addVolume("detached", "fsn1", nil)
+	hd := &hetznerDriver{client: m}
+
+	var out bytes.Buffer
+	if err := cmdGC(hd, &out, []string{"--dry-run"}); err != nil {
+		t.Fatalf("cmdGC() error = %v", err)
+	}
+	if got := mutatingCalls(m); len(got) != 0 {
+		t.Errorf("dry run calls = %v, want none", got)
+	}
+	if want := "would detach local\n"; out.String() != want {
+		t.Errorf("dry run output = %q, want %q", out.String(), want)
+	}
+
+	if err := cmdGC(hd, &bytes.Buffer{}, nil); err != nil {
+		t.Fatalf("cmdGC() error = %v", err)
+	}
+	if got, want := mutatingCalls(m), []string{"Volume.Detach docker-local"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("calls = %v, want %v", got, want)
+	}
+}
+
+func Test_cmdRemove(t *testing.T) {
+	tests := []struct {
+		name          string
+		useProtection string
+		protected     bool
+		attached      bool
+		force         bool
+		wantErr       bool
+		wantCalls     []string
+	}{
+		{"unprotected", "false", false, false, false, false, []string{"Volume.Delete docker-foo"}},
+		{"protected", "true", true, false, false, true, nil},
+		{"attached", "false", false, true, false, true, nil},
+		{"forced while protected", "true", true, false, true, false, []string{
+			"Volume.ChangeProtection docker-foo false",
+			"Volume.Delete docker-foo",
+		}},
+		{"forced while protected by someone else", "false", true, true, true, false, []string{
+			"Volume.ChangeProtection docker-foo false",
+			"Volume.Detach docker-foo",
+			"Volume.Delete docker-foo",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("use_protection", tt.useProtection)
+
+			m := newMockClient()
+			var srv *hcloud.Server
+			if tt.attached {
+				srv = m.addServer("other", "fsn1")
+			}
+			vol := m.addVolume("foo", "fsn1", srv)
+			vol.Protection.Delete = tt.protected
+			hd := &hetznerDriver{client: m}
+
+			args := []string{"foo"}
+			if tt.force {
+				args = append([]string{"--force"}, args...)
+			}
+			out := &bytes.Buffer{}
+			if err := cmdRemove(hd, out, args); (err != nil) != tt.wantErr {
+				t.Errorf("cmdRemove() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !strings.HasSuffix(out.String(), "foo removed\n") {
+				t.Errorf("cmdRemove() output = %q, want confirmation", out.String())
+			}
+			if got := mutatingCalls(m); !reflect.DeepEqual(got, tt.wantCalls) {
+				t.Errorf("calls = %v, want %v", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func Test_checkCLIPoolMode(t *testing.T) {
+	tests := []struct {
+		pool    string
+		command string
+		wantErr bool
+	}{
+		{"", "rm", false},
+		{"shared", "doctor", false},
+		{"shared", "ls", true},
+		{"shared", "rm", true},
+		{"shared", "gc", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pool+" "+tt.command, func(t *testing.T) {
+			t.Setenv("pool", tt.pool)
+			if err := checkCLIPoolMode(tt.command); (err != nil) != tt.wantErr {
+				t.Errorf("checkCLIPoolMode() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// mutatingCalls returns the calls changing volumes, leaving out lookups and watching actions
+func mutatingCalls(m *mockClient) []string {
+	var calls []string
+	for _, call := range m.getCalls() {
+		if strings.HasPrefix(call, "Volume.") && !strings.HasPrefix(call, "Volume.Get") && !strings.HasPrefix(call, "Volume.All") {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	detachImmediate = "immediate"
+	detachNever     = "never"
+	detachIdle      = "idle"
+)
+
+// bounds for how often the idle detacher looks for unused volumes
+const (
+	minIdleCheckInterval = time.Second
+	maxIdleCheckInterval = time.Minute
+)
+
+// detachPolicy decides when volumes are detached from the local server after being unmounted
+type detachPolicy struct {
+	mode string
+	// how long volumes stay attached while unused, for mode idle
+	idle time.Duration
+}
+
+func (p detachPolicy) String() string {
+	if p.mode == detachIdle {
+		return fmt.Sprintf("%s:%s", p.mode, p.idle)
+	}
+	return p.mode
+}
+
+// parseDetachPolicy parses a detach policy of the form immediate, never or idle:<duration>
+func parseDetachPolicy(s string) (detachPolicy, error) {
+	mode, arg, hasArg := strings.Cut(strings.TrimSpace(s), ":")
+	switch {
+	case mode == "" && !hasArg:
+		return detachPolicy{mode: detachImmediate}, nil
+	case (mode == detachImmediate || mode == detachNever) && !hasArg:
+		return detachPolicy{mode: mode}, nil
+	case mode == detachIdle && hasArg:
+		d, err := time.ParseDuration(arg)
+		if err != nil {
+			return detachPolicy{}, fmt.Errorf("parsing idle duration of detach policy %q: %w", s, err)
+		}
+		if d <= 0 {
+			return detachPolicy{}, fmt.Errorf("idle duration of detach policy %q must be positive", s)
+		}
+		return detachPolicy{mode: detachIdle, idle: d}, nil
+	}
+	return detachPolicy{}, fmt.Errorf("unknown detach policy %q; expected %s, %s or %s:<duration>", s, detachImmediate, detachNever, detachIdle)
+}
+
+// getDetachPolicy returns the configured detach policy. Invalid configuration is reported by the preflight checks, so
+// volumes are detached immediately as before until it's fixed.
+func getDetachPolicy() detachPolicy {
+	p, err := parseDetachPolicy(os.Getenv("detach_policy"))
+	if err != nil {
+		logrus.Warnf("%v; detaching immediately", err)
+		return detachPolicy{mode: detachImmediate}
+	}
+	return p
+}
+
+// idleCheckInterval is how often unused volumes are looked for, so they are detached reasonably close to their idle
+// window running out
+func (p detachPolicy) idleCheckInterval() time.Duration {
+	d := p.idle / 4
+	if d < minIdleCheckInterval {
+		return minIdleCheckInterval
+	}
+	if d > maxIdleCheckInterval {
+		return maxIdleCheckInterval
+	}
+	return d
+}
+
+// unusedLocalVolumes returns the managed volumes attached to the local server, but not mounted on it or otherwise
+// holding their devices.
+func (hd *hetznerDriver) unusedLocalVolumes() ([]*hcloud.Volume, error) {
+	srv, err := hd.getServerForLocalhost()
+	if err != nil {
+		return nil, err
+	}
+
+	vols, err := hd.managedVolumes()
+	if err != nil {
+		return nil, err
+	}
+
+	mounts, err := getMounts()
+	if err != nil {
+		return nil, fmt.Errorf("getting local mounts: %w", err)
+	}
+
+	var unused []*hcloud.Volume
+	for _, vol := range vols {
+		if vol.Server == nil || vol.Server.ID != srv.ID {
+			continue
+		}
+		if _, mounted := deviceMountpoint(mounts, vol.LinuxDevice); mounted {
+			continue
+		}
+		// lazily unmounted filesystems don't show up as mounts, but still hold the device
+		if !deviceReleased(vol.LinuxDevice) {
+			continue
+		}
+		unused = append(unused, vol)
+	}
+	return unused, nil
+}
+
+// markIdle records that the volume became unused at the given time, unless it already was
+func (hd *hetznerDriver) markIdle(name string, since time.Time) {
+	hd.idleMu.Lock()
+	defer hd.idleMu.Unlock()
+
+	if hd.idleSince == nil {
+		hd.idleSince = map[string]time.Time{}
+	}
+	if _, ok := hd.idleSince[name]; !ok {
+		hd.idleSince[name] = since
+	}
+}
+
+// markUsed forgets about the volume being unused
+func (hd *hetznerDriver) markUsed(name string) {
+	hd.idleMu.Lock()
+	defer hd.idleMu.Unlock()
+
+	delete(hd.idleSince, name)
+}
+
+// detachIdleVolumes detaches the volumes which have been unused for longer than idle at the given time. Volumes
+// unused but not seen before (e.g. left attached before a restart) start their idle window now.
+func (hd *hetznerDriver) detachIdleVolumes(now time.Time, idle time.Duration) error {
+	vols, err := hd.unusedLocalVolumes()
+	if err != nil {
+		return err
+	}
+
+	unused := make(map[string]bool, len(vols))
+	for _, vol := range vols {
+		// the pool is attached and mounted outside of mountMu, and released by its own handling
+		if vol.Labels[poolLabel] == "true" {
+			continue
+		}
+		unused[vol.Name] = true
+		hd.markIdle(vol.Name, now)
+	}
+
+	var candidates []*hcloud.Volume
+	hd.idleMu.Lock()
+	for _, vol := range vols {
+		if unused[vol.Name] && now.Sub(hd.idleSince[vol.Name]) >= idle {
+			candidates = append(candidates, vol)
+		}
+	}
+	// volumes detached or mounted by others in the meantime
+	for name := range hd.idleSince {
+		if !unused[name] {
+			delete(hd.idleSince, name)
+		}
+	}
+	hd.idleMu.Unlock()
+
+	for _, vol := range candidates {
+		if err := hd.detachIdleVolume(vol, now, idle); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// detachIdleVolume detaches a volume found idle, unless it was mounted since. Mounts of the volume wait for the detach
+// to finish, without keeping other volumes from being mounted meanwhile.
+func (hd *hetznerDriver) detachIdleVolume(vol *hcloud.Volume, now time.Time, idle time.Duration) error {
+	// keep volumes from being mounted while checking again whether this one is in use
+	hd.mountMu.Lock()
+	since, stillIdle := hd.idleState(vol.Name)
+	if stillIdle && now.Sub(since) >= idle {
+		stillIdle = deviceUnused(vol.LinuxDevice)
+	}
+	var done chan struct{}
+	if stillIdle {
+		done = hd.beginDetach(vol.Name)
+	}
+	hd.mountMu.Unlock()
+
+	if !stillIdle {
+		return nil
+	}
+	defer hd.endDetach(vol.Name, done)
+
+	logrus.Infof("detaching volume %q unused since %s", vol.Name, since.Format(time.RFC3339))
+	if err := hd.detachVolume(vol); err != nil {
+		return err
+	}
+	hd.markUsed(vol.Name)
+	return nil
+}
+
+// deviceUnused reports whether dev is neither mounted locally nor otherwise held
+func deviceUnused(dev string) bool {
+	mounts, err := getMounts()
+	if err != nil {
+		logrus.Warnf("getting local mounts: %v", err)
+		return false
+	}
+	if _, mounted := deviceMountpoint(mounts, dev); mounted {
+		return false
+	}
+	return deviceReleased(dev)
+}
+
+// idleState returns since when the volume has been unused, if it still is
+func (hd *hetznerDriver) idleState(name string) (time.Time, bool) {
+	hd.idleMu.Lock()
+	defer hd.idleMu.Unlock()
+
+	since, ok := hd.idleSince[name]
+	return since, ok
+}
+
+// beginDetach records that the volume is being detached, for mounts of it to wait on; to be called with mountMu held
+func (hd *hetznerDriver) beginDetach(name string) chan struct{} {
+	hd.idleMu.Lock()
+	defer hd.idleMu.Unlock()
+
+	if hd.detaching == nil {
+		hd.detaching = map[string]chan struct{}{}
+	}
+	done := make(chan struct{})
+	hd.detaching[name] = done
+	return done
+}
+
+func (hd *hetznerDriver) endDetach(name string, done chan struct{}) {
+	hd.idleMu.Lock()
+	defer hd.idleMu.Unlock()
+
+	delete(hd.detaching, name)
+	close(done)
+}
+
+// waitForDetach waits until the volume with the given cloud name isn't being detached as idle anymore, and reports
+// whether it had to wait
+func (hd *hetznerDriver) waitForDetach(name string) bool {
+	hd.idleMu.Lock()
+	done, ok := hd.detaching[name]
+	hd.idleMu.Unlock()
+
+	if ok {
+		logrus.Infof("waiting for idle volume %q to be detached", name)
+		<-done
+	}
+	return ok
+}
+
+// runIdleDetacher periodically detaches volumes unused for longer than the policy's idle window, until stop is closed
+func (hd *hetznerDriver) runIdleDetacher(p detachPolicy, stop <-chan struct{}) {
+	interval := p.idleCheckInterval()
+	logrus.Infof("detaching volumes unused for %s, checking every %s", p.idle, interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			if err := hd.ops.begin(); err != nil {
+				return
+			}
+			if err := hd.detachIdleVolumes(now, p.idle); err != nil {
+				logrus.Warnf("detaching idle volumes: %v", err)
+			}
+			hd.ops.end()
+		}
+	}
+}
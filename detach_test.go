@@ -0,0 +1,209 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+func Test_parseDetachPolicy(t *testing.T) {
+	tests := []struct {
+		policy  string
+		want    detachPolicy
+		wantErr bool
+	}{
+		{"", detachPolicy{mode: detachImmediate}, false},
+		{"immediate", detachPolicy{mode: detachImmediate}, false},
+		{"never", detachPolicy{mode: detachNever}, false},
+		{" idle:5m ", detachPolicy{mode: detachIdle, idle: 5 * time.Minute}, false},
+		{"idle:1h30m", detachPolicy{mode: detachIdle, idle: 90 * time.Minute}, false},
+		{"idle", detachPolicy{}, true},
+		{"idle:", detachPolicy{}, true},
+		{"idle:0s", detachPolicy{}, true},
+		{"idle:-1m", detachPolicy{}, true},
+		{"idle:soon", detachPolicy{}, true},
+		{"never:5m", detachPolicy{}, true},
+		{"sometimes", detachPolicy{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			got, err := parseDetachPolicy(tt.policy)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseDetachPolicy() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseDetachPolicy() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_detachPolicy_idleCheckInterval(t *testing.T) {
+	tests := []struct {
+		idle time.Duration
+		want time.Duration
+	}{
+		{time.Second, minIdleCheckInterval},
+		{time.Minute, 15 * time.Second},
+		{time.Hour, maxIdleCheckInterval},
+	}
+	for _, tt := range tests {
+		if got := (detachPolicy{mode: detachIdle, idle: tt.idle}).idleCheckInterval(); got != tt.want {
+			t.Errorf("idleCheckInterval() for %s = %s, want %s", tt.idle, got, tt.want)
+		}
+	}
+}
+
+func Test_loopHarness_detachPolicy(t *testing.T) {
+	t.Setenv("use_protection", "false")
+
+	tests := []struct {
+		policy       string
+		wantAttached bool
+	}{
+		{"immediate", false},
+		{"never", true},
+		{"idle:1h", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			t.Setenv("detach_policy", tt.policy)
+
+			h := newLoopHarness(t)
+			hd := h.driver()
+
+			if err := hd.Create(&volume.CreateRequest{Name: "foo"}); err != nil {
+				t.Fatalf("hetznerDriver.Create() error = %v", err)
+			}
+			if _, err := hd.Mount(&volume.MountRequest{Name: "foo", ID: "some-id"}); err != nil {
+				t.Fatalf("hetznerDriver.Mount() error = %v", err)
+			}
+			if err := hd.Unmount(&volume.UnmountRequest{Name: "foo", ID: "some-id"}); err != nil {
+				t.Fatalf("hetznerDriver.Unmount() error = %v", err)
+			}
+
+			vol, err := hd.getVolume("foo")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if attached := vol.Server != nil; attached != tt.wantAttached {
+				t.Errorf("volume attached = %t after unmount, want %t", attached, tt.wantAttached)
+			}
+			if !tt.wantAttached {
+				return
+			}
+
+			// mounting again on the same server reuses the attachment
+			before := len(h.mock.getCalls())
+			if _, err := hd.Mount(&volume.MountRequest{Name: "foo", ID: "other-id"}); err != nil {
+				t.Fatalf("hetznerDriver.Mount() error = %v", err)
+			}
+			for _, call := range h.mock.getCalls()[before:] {
+				if strings.HasPrefix(call, "Volume.Attach") || strings.HasPrefix(call, "Volume.Detach") {
+					t.Errorf("hetznerDriver.Mount() called %s on attached volume", call)
+				}
+			}
+
+			// mounted volumes are never idle
+			if err := hd.detachIdleVolumes(time.Now().Add(2*time.Hour), time.Hour); err != nil {
+				t.Fatalf("hetznerDriver.detachIdleVolumes() error = %v", err)
+			}
+			if vol, _ := hd.getVolume("foo"); vol.Server == nil {
+				t.Fatal("mounted volume detached")
+			}
+
+			if err := hd.Unmount(&volume.UnmountRequest{Name: "foo", ID: "other-id"}); err != nil {
+				t.Fatalf("hetznerDriver.Unmount() error = %v", err)
+			}
+			if err := hd.detachIdleVolumes(time.Now().Add(30*time.Minute), time.Hour); err != nil {
+				t.Fatalf("hetznerDriver.detachIdleVolumes() error = %v", err)
+			}
+			if vol, _ := hd.getVolume("foo"); vol.Server == nil {
+				t.Fatal("volume detached within its idle window")
+			}
+			if err := hd.detachIdleVolumes(time.Now().Add(2*time.Hour), time.Hour); err != nil {
+				t.Fatalf("hetznerDriver.detachIdleVolumes() error = %v", err)
+			}
+			if vol, _ := hd.getVolume("foo"); vol.Server != nil {
+				t.Error("volume still attached after its idle window")
+			}
+		})
+	}
+}
+
+func Test_hetznerDriver_detachIdleVolumes(t *testing.T) {
+	m := newMockClient()
+	m.addVolume("foo", "fsn1", m.servers[1])
+	m.addVolume("bar", "fsn1", m.servers[1])
+	hd := &hetznerDriver{client: m}
+
+	now := time.Now()
+	if err := hd.detachIdleVolumes(now, time.Hour); err != nil {
+		t.Fatalf("hetznerDriver.detachIdleVolumes() error = %v", err)
+	}
+
+	// mounts of other volumes go ahead while one is being detached
+	var detached []string
+	m.hookCall("Volume.Detach", 1, func(*mockClient) {
+		if !hd.mountMu.TryRLock() {
+			t.Error("mounts blocked while detaching")
+			return
+		}
+		hd.mountMu.RUnlock()
+		for name := range hd.detaching {
+			detached = append(detached, name)
+		}
+	})
+	// mounted in the meantime
+	hd.markUsed(prefixName("bar"))
+
+	if err := hd.detachIdleVolumes(now.Add(2*time.Hour), time.Hour); err != nil {
+		t.Fatalf("hetznerDriver.detachIdleVolumes() error = %v", err)
+	}
+	if want := []string{"Volume.Detach docker-foo"}; !reflect.DeepEqual(mutatingCalls(m), want) {
+		t.Errorf("calls = %v, want %v", mutatingCalls(m), want)
+	}
+	if want := []string{"docker-foo"}; !reflect.DeepEqual(detached, want) {
+		t.Errorf("volumes being detached = %v, want %v", detached, want)
+	}
+	if len(hd.detaching) != 0 {
+		t.Errorf("volumes still being detached: %v", hd.detaching)
+	}
+}
+
+func Test_hetznerDriver_Mount_waitForDetach(t *testing.T) {
+	// there is no device behind the mock, so the mount itself fails
+	t.Setenv("device_timeout", "10ms")
+
+	m := newMockClient()
+	legacy := strings.Repeat("a", volumeNameMaxLen)
+	vol := m.addVolume(legacy, "fsn1", m.servers[1])
+	vol.Name = legacyPrefixName(legacy)
+	hd := &hetznerDriver{client: m}
+
+	done := hd.beginDetach(vol.Name)
+	mounted := make(chan struct{})
+	go func() {
+		defer close(mounted)
+		_, _ = hd.Mount(&volume.MountRequest{Name: legacy, ID: "some-id"})
+	}()
+
+	select {
+	case <-mounted:
+		t.Fatal("hetznerDriver.Mount() didn't wait for the volume to be detached")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	m.mu.Lock()
+	vol.Server = nil
+	m.mu.Unlock()
+	hd.endDetach(vol.Name, done)
+	<-mounted
+
+	if want := []string{"Volume.Attach " + vol.Name + " " + m.servers[1].Name}; !reflect.DeepEqual(mutatingCalls(m), want) {
+		t.Errorf("calls = %v, want %v", mutatingCalls(m), want)
+	}
+}
@@ -2,13 +2,18 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"os"
+	"regexp"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/docker/docker/pkg/mount"
 	"github.com/hashicorp/go-multierror"
 	"github.com/hetznercloud/hcloud-go/v2/hcloud"
 	"github.com/sirupsen/logrus"
@@ -22,11 +27,52 @@ var falseVar = false
 
 type hetznerDriver struct {
 	client hetznerClienter
+
+	preflightState *preflightState
+
+	// serializes operations on the pool, so it isn't released while in use
+	poolMu sync.Mutex
+
+	// serializes checking the limits with creating or growing volumes, so concurrent requests can't exceed them together
+	limitsMu sync.Mutex
+
+	// held by mounts, so the idle detacher doesn't detach volumes about to be mounted
+	mountMu sync.RWMutex
+
+	// when volumes attached to the local server were first seen unused, for detach_policy idle, and the ones being
+	// detached as idle
+	idleMu    sync.Mutex
+	idleSince map[string]time.Time
+	detaching map[string]chan struct{}
+
+	// running requests, drained on shutdown
+	ops opTracker
+
+	// running operations and the actions they wait for, resumed after restarts
+	journal actionJournal
+
+	// lifecycle events of volumes, for auditing
+	events auditLog
+
+	// usage of the mounted volumes, as last checked
+	usage usageState
+
+	// when volumes were last grown automatically
+	autogrow autogrowState
+
+	// when mounted volumes are next trimmed, and how much was trimmed so far
+	trim trimState
 }
 
 func newHetznerDriver() *hetznerDriver {
+	opts := []hcloud.ClientOption{hcloud.WithToken(strings.TrimSpace(os.Getenv("apikey")))}
+	if endpoint := os.Getenv("endpoint"); endpoint != "" {
+		opts = append(opts, hcloud.WithEndpoint(endpoint))
+	}
+
 	return &hetznerDriver{
-		client: &hetznerClient{hcloud.NewClient(hcloud.WithToken(strings.TrimSpace(os.Getenv("apikey"))))},
+		client:         &hetznerClient{hcloud.NewClient(opts...)},
+		preflightState: &preflightState{},
 	}
 }
 
@@ -37,15 +83,34 @@ func (hd *hetznerDriver) Capabilities() *volume.CapabilitiesResponse {
 }
 
 func (hd *hetznerDriver) Create(req *volume.CreateRequest) error {
-	validateOptions(req.Name, req.Options)
+	if err := hd.checkPreflight(); err != nil {
+		return err
+	}
+
+	if err := validateOptions(req.Name, req.Options); err != nil {
+		return err
+	}
+
+	if poolName() != "" {
+		return hd.poolCreate(req)
+	}
 
 	prefixedName := prefixName(req.Name)
 
+	if vol, _, err := hd.client.Volume().GetByName(context.Background(), prefixedName); err == nil && vol != nil && vol.Labels[stateLabel] == stateIncomplete {
+		return hd.resumeIncomplete(vol)
+	}
+
 	logrus.Infof("starting volume creation for %q", prefixedName)
 
-	size, err := strconv.Atoi(getOption("size", req.Options))
+	size, err := parseSize(getOption("size", req.Options))
 	if err != nil {
-		return fmt.Errorf("converting size %q to int: %w", getOption("size", req.Options), err)
+		return err
+	}
+
+	autogrow, err := autogrowFromOptions(req.Options, size)
+	if err != nil {
+		return fmt.Errorf("volume %q: %w", req.Name, err)
 	}
 
 	srv, err := hd.getServerForLocalhost()
@@ -53,77 +118,116 @@ func (hd *hetznerDriver) Create(req *volume.CreateRequest) error {
 		return err
 	}
 
+	profile, err := getProfile(req.Options)
+	if err != nil {
+		return err
+	}
+
+	loc, err := volumeLocation(req.Options, srv)
+	if err != nil {
+		return err
+	}
+
 	opts := hcloud.VolumeCreateOpts{
 		Name:     prefixedName,
 		Size:     size,
-		Location: srv.Datacenter.Location, // attach explicitly to be able to wait
-		Labels:   map[string]string{"docker-volume-hetzner": ""},
+		Location: loc, // attach explicitly to be able to wait
+		Labels:   map[string]string{},
+	}
+	protect := useProtection()
+	if profile != nil {
+		for k, v := range profile.Labels {
+			opts.Labels[k] = v
+		}
+		if profile.Protection != nil {
+			protect = *profile.Protection
+			if protect {
+				opts.Labels[protectionLabel] = "true"
+			}
+		}
+	}
+	opts.Labels[pluginLabel] = ""
+	setLabelString(opts.Labels, nameLabel, req.Name)
+	if mountOptions := getOption("mount_options", req.Options); mountOptions != "" {
+		setLabelString(opts.Labels, mountOptionsLabel, mountOptions)
+	}
+	if getOption("readonly", req.Options) == "true" {
+		opts.Labels[readonlyLabel] = "true"
+	}
+	if autogrow != nil {
+		autogrow.setLabels(opts.Labels)
+	}
+	if getOption("trim", req.Options) == "false" {
+		opts.Labels[trimLabel] = "false"
 	}
 	switch f := getOption("fstype", req.Options); f {
 	case "xfs", "ext4":
 		opts.Format = hcloud.String(f)
 	}
 
-	resp, _, err := hd.client.Volume().Create(context.Background(), opts)
-	if err != nil {
-		return fmt.Errorf("creating volume %q: %w", prefixedName, err)
+	setup := setupFromOptions(req.Options, protect)
+
+	// volumes in other locations can't be attached here, so they have to wait for a server in their location
+	lazy := lazyProvisioning(req.Options)
+	if local := serverLocation(srv); local == nil || local.Name != loc.Name {
+		logrus.Infof("volume %q is to be created in location %q; deferring provisioning to its first mount there", prefixedName, loc.Name)
+		lazy = true
 	}
-	if err := hd.waitForAction(resp.Action); err != nil {
-		return fmt.Errorf("waiting for create volume %q: %w", prefixedName, err)
+
+	// record how to finish the volume, so it can be provisioned later or its creation resumed
+	setup.setLabels(opts.Labels)
+	if lazy {
+		// defer everything else until we know which server will actually use the volume
+		opts.Labels[stateLabel] = statePending
+	} else {
+		opts.Labels[stateLabel] = stateIncomplete
 	}
 
-	logrus.Infof("volume %q (%dGB) created on %q; attaching", prefixedName, size, srv.Name)
+	id := hd.journal.begin(journalCreate, req.Name)
+	defer hd.journal.end(id)
 
-	act, _, err := hd.client.Volume().Attach(context.Background(), resp.Volume, srv)
+	vol, err := hd.createWithinLimits(req.Name, opts)
 	if err != nil {
-		return fmt.Errorf("attaching volume %q to %q: %w", prefixedName, srv.Name, err)
-	}
-	if err := hd.waitForAction(act); err != nil {
-		return fmt.Errorf("waiting for volume attachment: %q to %q: %w", prefixedName, srv.Name, err)
+		return err
 	}
 
-	logrus.Infof("volume %q attached to %q", prefixedName, srv.Name)
-
-	if useProtection() {
-		// be optimistic for now and ignore errors here
-		_, _, _ = hd.client.Volume().ChangeProtection(context.Background(), resp.Volume, hcloud.VolumeChangeProtectionOpts{Delete: &trueVar})
+	if lazy {
+		logrus.Infof("volume %q (%dGB) created; provisioning deferred until first mount", prefixedName, size)
+		return nil
 	}
 
-	if opts.Format == nil {
-		logrus.Infof("formatting %q as %q", prefixedName, getOption("fstype", req.Options))
-		err = mkfs(resp.Volume.LinuxDevice, getOption("fstype", req.Options))
-		if err != nil {
-			return fmt.Errorf("mkfs on %q: %w", resp.Volume.LinuxDevice, err)
-		}
-	}
+	logrus.Infof("volume %q (%dGB) created; provisioning on %q", prefixedName, size, srv.Name)
 
-	uid := getOption("uid", req.Options)
-	gid := getOption("gid", req.Options)
-	if uid != "0" || gid != "0" {
-		// string to int
-		uintParsed, err := strconv.Atoi(uid)
-		if err != nil {
-			return fmt.Errorf("parsing uid option value as integer: %s: %w", gid, err)
-		}
-		gidParsed, err := strconv.Atoi(gid)
-		if err != nil {
-			return fmt.Errorf("parsing gid option value as integer: %s: %w", gid, err)
-		}
+	return hd.finishCreate(vol, srv)
+}
 
-		if err := setPermissions(resp.Volume.LinuxDevice, getOption("fstype", req.Options), uintParsed, gidParsed); err != nil {
-			return fmt.Errorf("chown %q to '%s:%s': %w", resp.Volume.LinuxDevice, uid, gid, err)
-		}
+// resumeIncomplete finishes creating a volume left incomplete by an earlier create, using the options given back then
+func (hd *hetznerDriver) resumeIncomplete(vol *hcloud.Volume) error {
+	srv, err := hd.getServerForLocalhost()
+	if err != nil {
+		return err
+	}
+	if err := checkAttachLocation(vol, srv); err != nil {
+		return err
 	}
 
-	return nil
+	id := hd.journal.begin(journalCreate, unprefixedName(vol))
+	defer hd.journal.end(id)
+
+	logrus.Infof("resuming creation of volume %q from step %q", vol.Name, vol.Labels[stepLabel])
+	return hd.finishCreate(vol, srv)
 }
 
 func (hd *hetznerDriver) List() (*volume.ListResponse, error) {
+	if poolName() != "" {
+		return hd.poolList()
+	}
+
 	logrus.Infof("got list request")
 
-	vols, err := hd.client.Volume().All(context.Background())
+	vols, err := hd.managedVolumes()
 	if err != nil {
-		return nil, fmt.Errorf("could not list all volumes: %w", err)
+		return nil, err
 	}
 
 	mounts, err := getMounts()
@@ -135,13 +239,10 @@ func (hd *hetznerDriver) List() (*volume.ListResponse, error) {
 		Volumes: make([]*volume.Volume, 0, len(vols)),
 	}
 	for _, vol := range vols {
-		if !nameHasPrefix(vol.Name) {
-			continue
-		}
 		v := &volume.Volume{
-			Name: unprefixedName(vol.Name),
+			Name: unprefixedName(vol),
 		}
-		if mountpoint, ok := mounts[vol.LinuxDevice]; ok {
+		if mountpoint, ok := deviceMountpoint(mounts, vol.LinuxDevice); ok {
 			v.Mountpoint = mountpoint
 		}
 		resp.Volumes = append(resp.Volumes, v)
@@ -151,13 +252,17 @@ func (hd *hetznerDriver) List() (*volume.ListResponse, error) {
 }
 
 func (hd *hetznerDriver) Get(req *volume.GetRequest) (*volume.GetResponse, error) {
+	if poolName() != "" {
+		return hd.poolGet(req)
+	}
+
 	prefixedName := prefixName(req.Name)
 
 	logrus.Infof("fetching information for volume %q", prefixedName)
 
-	vol, _, err := hd.client.Volume().GetByName(context.Background(), prefixedName)
-	if err != nil || vol == nil {
-		return nil, fmt.Errorf("getting cloud volume %q: %w", prefixedName, err)
+	vol, err := hd.getVolume(req.Name)
+	if err != nil {
+		return nil, err
 	}
 
 	mounts, err := getMounts()
@@ -167,14 +272,26 @@ func (hd *hetznerDriver) Get(req *volume.GetRequest) (*volume.GetResponse, error
 
 	status := make(map[string]interface{})
 
-	mountpoint, mounted := mounts[vol.LinuxDevice]
+	mountpoint, mounted := deviceMountpoint(mounts, vol.LinuxDevice)
 	if mounted {
 		status["mounted"] = true
+		if u, err := statUsage(mountpoint); err != nil {
+			logrus.Warnf("%v", err)
+		} else {
+			u.addStatus(status)
+		}
+	}
+	if state, ok := vol.Labels[stateLabel]; ok {
+		status["state"] = state
+	}
+	if step, ok := vol.Labels[stepLabel]; ok {
+		status["failed_step"] = step
 	}
+	status["mode"] = mountMode(vol.Labels[readonlyLabel] == "true")
 
 	resp := volume.GetResponse{
 		Volume: &volume.Volume{
-			Name:       unprefixedName(vol.Name),
+			Name:       unprefixedName(vol),
 			Mountpoint: mountpoint,
 			CreatedAt:  vol.Created.Format(time.RFC3339),
 			Status:     status,
@@ -187,40 +304,39 @@ func (hd *hetznerDriver) Get(req *volume.GetRequest) (*volume.GetResponse, error
 }
 
 func (hd *hetznerDriver) Remove(req *volume.RemoveRequest) error {
+	if err := hd.checkPreflight(); err != nil {
+		return err
+	}
+
+	if poolName() != "" {
+		return hd.poolRemove(req)
+	}
+
 	prefixedName := prefixName(req.Name)
 
 	logrus.Infof("starting volume removal for %q", prefixedName)
 
-	vol, _, err := hd.client.Volume().GetByName(context.Background(), prefixedName)
-	if err != nil || vol == nil {
-		return fmt.Errorf("getting cloud volume %q: %w", prefixedName, err)
+	vol, err := hd.getVolume(req.Name)
+	if err != nil {
+		return err
 	}
 
-	if useProtection() {
+	if unprotectsOnRemove(vol) {
 		logrus.Infof("disabling protection for %q", prefixedName)
-		act, _, err := hd.client.Volume().ChangeProtection(context.Background(), vol, hcloud.VolumeChangeProtectionOpts{Delete: &falseVar})
-		if err != nil {
-			return fmt.Errorf("unprotecting volume %q: %w", prefixedName, err)
-		}
-		if err := hd.waitForAction(act); err != nil {
-			return fmt.Errorf("waiting for volume unprotecton %q: %w", prefixedName, err)
+		if err := hd.setProtection(vol, false); err != nil {
+			return err
 		}
 	}
 
 	if vol.Server != nil && vol.Server.ID != 0 {
 		logrus.Infof("detaching volume %q (attached to %d)", prefixedName, vol.Server.ID)
-		act, _, err := hd.client.Volume().Detach(context.Background(), vol)
-		if err != nil {
-			return fmt.Errorf("detaching volume %q: %w", prefixedName, err)
-		}
-		if err := hd.waitForAction(act); err != nil {
-			return fmt.Errorf("waiting for volume detach on %q: %w", prefixedName, err)
+		if err := hd.detachVolume(vol); err != nil {
+			return err
 		}
 	}
 
-	_, err = hd.client.Volume().Delete(context.Background(), vol)
-	if err != nil {
-		return fmt.Errorf("deleting volume %q: %w", prefixedName, err)
+	if err := hd.deleteVolume(vol); err != nil {
+		return err
 	}
 
 	logrus.Infof("volume %q removed successfully", prefixedName)
@@ -228,6 +344,11 @@ func (hd *hetznerDriver) Remove(req *volume.RemoveRequest) error {
 	return nil
 }
 
+// unprotectsOnRemove reports whether Remove lifts the deletion protection of the volume before deleting it
+func unprotectsOnRemove(vol *hcloud.Volume) bool {
+	return useProtection() || vol.Labels[protectionLabel] == "true"
+}
+
 func (hd *hetznerDriver) Path(req *volume.PathRequest) (*volume.PathResponse, error) {
 	prefixedName := prefixName(req.Name)
 
@@ -241,15 +362,40 @@ func (hd *hetznerDriver) Path(req *volume.PathRequest) (*volume.PathResponse, er
 	return &volume.PathResponse{Mountpoint: resp.Volume.Mountpoint}, nil
 }
 
-func (hd *hetznerDriver) Mount(req *volume.MountRequest) (*volume.MountResponse, error) {
+func (hd *hetznerDriver) Mount(req *volume.MountRequest) (_ *volume.MountResponse, err error) {
+	if err := hd.checkPreflight(); err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	var vol *hcloud.Volume
+	defer func() { hd.audit(auditEvent{Event: auditMounted, MountID: req.ID}, req.Name, vol, start, err) }()
+
+	if poolName() != "" {
+		return hd.poolMount(req)
+	}
+
 	prefixedName := prefixName(req.Name)
 
 	logrus.Infof("received mount request for %q as %q", prefixedName, req.ID)
 
-	vol, _, err := hd.client.Volume().GetByName(context.Background(), prefixedName)
-	if err != nil || vol == nil {
-		return nil, fmt.Errorf("getting volume %q: %w", prefixedName, err)
+	hd.mountMu.RLock()
+	defer hd.mountMu.RUnlock()
+
+	id := hd.journal.begin(journalMount, req.Name)
+	defer hd.journal.end(id)
+
+	vol, err = hd.getVolume(req.Name)
+	if err != nil {
+		return nil, err
 	}
+	// idle volumes are tracked by their cloud name, which differs from prefixedName for legacy names
+	if hd.waitForDetach(vol.Name) {
+		if vol, err = hd.getVolume(req.Name); err != nil {
+			return nil, err
+		}
+	}
+	hd.markUsed(vol.Name)
 
 	if vol.Server != nil && vol.Server.ID != 0 {
 		volSrv, _, err := hd.client.Server().GetByID(context.Background(), vol.Server.ID)
@@ -264,27 +410,34 @@ func (hd *hetznerDriver) Mount(req *volume.MountRequest) (*volume.MountResponse,
 		return nil, err
 	}
 
-	if vol.Server == nil || vol.Server.Name != srv.Name {
+	// don't detach the volume from anywhere if it can't be attached here anyway
+	if err := checkAttachLocation(vol, srv); err != nil {
+		return nil, err
+	}
+
+	if needsProvisioning(vol) {
+		logrus.Infof("provisioning %s volume %q on %q", vol.Labels[stateLabel], prefixedName, srv.Name)
+		if vol, err = hd.provisionVolume(vol, srv); err != nil {
+			return nil, fmt.Errorf("provisioning volume %q: %w", prefixedName, err)
+		}
+	} else if vol.Server == nil || vol.Server.ID != srv.ID {
 		if vol.Server != nil && vol.Server.Name != "" {
 			logrus.Infof("detaching volume %q from %q", prefixedName, vol.Server.Name)
-			act, _, err := hd.client.Volume().Detach(context.Background(), vol)
-			if err != nil {
-				return nil, fmt.Errorf("detaching volume %q from %q: %w", vol.Name, vol.Server.Name, err)
-			}
-			if err := hd.waitForAction(act); err != nil {
-				return nil, fmt.Errorf("waiting for volume detachment on %q from %q: %w", vol.Name, vol.Server.Name, err)
+			if err := hd.stealVolume(vol); err != nil {
+				return nil, err
 			}
 		}
 		logrus.Infof("attaching volume %q to %q", prefixedName, srv.Name)
-		act, _, err := hd.client.Volume().Attach(context.Background(), vol, srv)
-		if err != nil {
-			return nil, fmt.Errorf("attaching volume %q to %q: %w", vol.Name, srv.Name, err)
-		}
-		if err := hd.waitForAction(act); err != nil {
-			return nil, fmt.Errorf("waiting for volume attachment on %q to %q: %w", vol.Name, srv.Name, err)
+		if err := hd.attachVolume(vol, srv); err != nil {
+			return nil, err
 		}
 	}
 
+	logrus.Infof("waiting for device %q", vol.LinuxDevice)
+	if err := waitForDevice(vol.LinuxDevice, vol.ID, deviceTimeout()); err != nil {
+		return nil, fmt.Errorf("waiting for device of volume %q: %w", prefixedName, err)
+	}
+
 	mountpoint := fmt.Sprintf("%s/%s", propagatedMountPath, req.ID)
 
 	logrus.Infof("creating mountpoint %s", mountpoint)
@@ -294,18 +447,12 @@ func (hd *hetznerDriver) Mount(req *volume.MountRequest) (*volume.MountResponse,
 
 	logrus.Infof("mounting %q on %q", prefixedName, mountpoint)
 
-	// copy busybox' approach and just try everything we expect might work
-	var merr error
-	mounted := false
-	for _, fstype := range supportedFileystemTypes {
-		if err := mount.Mount(vol.LinuxDevice, mountpoint, fstype, ""); err == nil {
-			mounted = true
-			break
-		}
-		merr = multierror.Append(merr, err)
+	mountOptions, _ := getLabelString(vol.Labels, mountOptionsLabel)
+	if vol.Labels[readonlyLabel] == "true" {
+		mountOptions = joinMountOptions(mountOptions, "ro")
 	}
-	if !mounted {
-		return nil, fmt.Errorf("mounting %q as any of %s: %w", vol.LinuxDevice, supportedFileystemTypes, err)
+	if err := mountDevice(vol.LinuxDevice, mountpoint, mountOptions); err != nil {
+		return nil, err
 	}
 
 	logrus.Infof("successfully mounted %q on %q", prefixedName, mountpoint)
@@ -313,20 +460,37 @@ func (hd *hetznerDriver) Mount(req *volume.MountRequest) (*volume.MountResponse,
 	return &volume.MountResponse{Mountpoint: mountpoint}, nil
 }
 
-func (hd *hetznerDriver) Unmount(req *volume.UnmountRequest) error {
+func (hd *hetznerDriver) Unmount(req *volume.UnmountRequest) (err error) {
+	start := time.Now()
+	var vol *hcloud.Volume
+	unmounted := false
+	defer func() {
+		// detaching afterwards is audited separately
+		if !unmounted {
+			hd.audit(auditEvent{Event: auditUnmounted, MountID: req.ID}, req.Name, vol, start, err)
+		}
+	}()
+
+	if poolName() != "" {
+		return hd.poolUnmount(req)
+	}
+
 	prefixedName := prefixName(req.Name)
 
 	logrus.Infof("received unmount request for %q as %q", prefixedName, req.ID)
 
-	vol, _, err := hd.client.Volume().GetByName(context.Background(), prefixedName)
-	if err != nil || vol == nil {
-		return fmt.Errorf("getting volume %q: %w", prefixedName, err)
+	id := hd.journal.begin(journalUnmount, req.Name)
+	defer hd.journal.end(id)
+
+	vol, err = hd.getVolume(req.Name)
+	if err != nil {
+		return err
 	}
 
 	mountpoint := fmt.Sprintf("%s/%s", propagatedMountPath, req.ID)
 
-	if err := mount.Unmount(mountpoint); err != nil {
-		return fmt.Errorf("unmounting %q: %w", mountpoint, err)
+	if err := unmountVolume(mountpoint); err != nil {
+		return err
 	}
 
 	logrus.Infof("unmounted %q", mountpoint)
@@ -334,29 +498,193 @@ func (hd *hetznerDriver) Unmount(req *volume.UnmountRequest) error {
 	if err := os.Remove(mountpoint); err != nil {
 		return fmt.Errorf("removing mountpoint %s: %w", mountpoint, err)
 	}
+	hd.audit(auditEvent{Event: auditUnmounted, MountID: req.ID}, req.Name, vol, start, nil)
+	unmounted = true
 
 	srv, err := hd.getServerForLocalhost()
 	if err != nil {
 		return nil
 	}
 
-	if vol.Server == nil || vol.Server.Name != srv.Name {
+	if vol.Server == nil || vol.Server.ID != srv.ID {
+		return nil
+	}
+
+	switch policy := getDetachPolicy(); policy.mode {
+	case detachNever:
+		logrus.Infof("leaving volume %q attached", prefixedName)
+		return nil
+	case detachIdle:
+		logrus.Infof("leaving volume %q attached for %s while unused", prefixedName, policy.idle)
+		hd.markIdle(vol.Name, time.Now())
+		return nil
+	}
+
+	// detaching a device still in use (e.g. mounted for another container, or lazily unmounted) would lose data
+	if err := waitForDeviceRelease(vol.LinuxDevice, releaseTimeout()); err != nil {
+		logrus.Warnf("%v; leaving volume %q attached", err, prefixedName)
 		return nil
 	}
 
 	logrus.Infof("detaching volume %q", prefixedName)
 
+	return hd.detachVolume(vol)
+}
+
+// createVolume creates a cloud volume and waits for it to be created. Volumes whose creation fails are removed again,
+// since they can't be used.
+func (hd *hetznerDriver) createVolume(opts hcloud.VolumeCreateOpts) (vol *hcloud.Volume, err error) {
+	start := time.Now()
+	defer func() {
+		audited := vol
+		if audited == nil {
+			audited = &hcloud.Volume{Name: opts.Name, Labels: opts.Labels}
+		}
+		hd.audit(auditEvent{Event: auditCreated}, unprefixedName(audited), vol, start, err)
+	}()
+
+	resp, _, err := hd.client.Volume().Create(context.Background(), opts)
+	hd.noteMutation(err)
+	if err != nil {
+		return nil, fmt.Errorf("creating volume %q: %w", opts.Name, err)
+	}
+	if err := hd.waitForAction(resp.Action); err != nil {
+		if rerr := hd.rollbackCreate(opts.Name); rerr != nil {
+			logrus.Warnf("%v", rerr)
+		}
+		return nil, fmt.Errorf("waiting for create volume %q: %w", opts.Name, err)
+	}
+	return resp.Volume, nil
+}
+
+func (hd *hetznerDriver) deleteVolume(vol *hcloud.Volume) (err error) {
+	start := time.Now()
+	defer func() { hd.audit(auditEvent{Event: auditDeleted}, unprefixedName(vol), vol, start, err) }()
+
+	_, err = hd.client.Volume().Delete(context.Background(), vol)
+	hd.noteMutation(err)
+	if err != nil {
+		return fmt.Errorf("deleting volume %q: %w", vol.Name, err)
+	}
+	return nil
+}
+
+func (hd *hetznerDriver) attachVolume(vol *hcloud.Volume, srv *hcloud.Server) (err error) {
+	start := time.Now()
+	defer func() {
+		hd.audit(auditEvent{Event: auditAttached, Server: srv.Name}, unprefixedName(vol), vol, start, err)
+	}()
+
+	act, _, err := hd.client.Volume().Attach(context.Background(), vol, srv)
+	hd.noteMutation(err)
+	if err != nil {
+		return fmt.Errorf("attaching volume %q to %q: %w", vol.Name, srv.Name, err)
+	}
+	if err := hd.waitForAction(act); err != nil {
+		return fmt.Errorf("waiting for volume attachment on %q to %q: %w", vol.Name, srv.Name, err)
+	}
+	return nil
+}
+
+func (hd *hetznerDriver) detachVolume(vol *hcloud.Volume) (err error) {
+	start := time.Now()
+	defer func() {
+		hd.audit(auditEvent{Event: auditDetached, Server: serverName(vol.Server)}, unprefixedName(vol), vol, start, err)
+	}()
+
 	act, _, err := hd.client.Volume().Detach(context.Background(), vol)
+	hd.noteMutation(err)
 	if err != nil {
 		return fmt.Errorf("detaching volume %q: %w", vol.Name, err)
 	}
 	if err := hd.waitForAction(act); err != nil {
 		return fmt.Errorf("waiting for volume detach on %q: %w", vol.Name, err)
 	}
+	return nil
+}
 
+// stealVolume detaches a volume from the other server it's attached to, so it can be attached to the local one
+func (hd *hetznerDriver) stealVolume(vol *hcloud.Volume) (err error) {
+	start := time.Now()
+	defer func() {
+		hd.audit(auditEvent{Event: auditStolen, Server: serverName(vol.Server)}, unprefixedName(vol), vol, start, err)
+	}()
+
+	act, _, err := hd.client.Volume().Detach(context.Background(), vol)
+	hd.noteMutation(err)
+	if err != nil {
+		return fmt.Errorf("detaching volume %q from %q: %w", vol.Name, serverName(vol.Server), err)
+	}
+	if err := hd.waitForAction(act); err != nil {
+		return fmt.Errorf("waiting for volume detachment on %q from %q: %w", vol.Name, serverName(vol.Server), err)
+	}
 	return nil
 }
 
+func (hd *hetznerDriver) setProtection(vol *hcloud.Volume, protect bool) (err error) {
+	start := time.Now()
+	defer func() {
+		hd.audit(auditEvent{Event: auditProtectionChanged, Protection: &protect}, unprefixedName(vol), vol, start, err)
+	}()
+
+	act, _, err := hd.client.Volume().ChangeProtection(context.Background(), vol, hcloud.VolumeChangeProtectionOpts{Delete: &protect})
+	hd.noteMutation(err)
+	if err != nil {
+		return fmt.Errorf("changing protection of volume %q: %w", vol.Name, err)
+	}
+	if err := hd.waitForAction(act); err != nil {
+		return fmt.Errorf("waiting for protection change on %q: %w", vol.Name, err)
+	}
+	return nil
+}
+
+// updateVolume renames a volume or replaces its labels
+func (hd *hetznerDriver) updateVolume(vol *hcloud.Volume, opts hcloud.VolumeUpdateOpts) (*hcloud.Volume, error) {
+	updated, _, err := hd.client.Volume().Update(context.Background(), vol, opts)
+	hd.noteMutation(err)
+	return updated, err
+}
+
+// serverName names a volume's server for messages, falling back to its ID if it wasn't fetched
+func serverName(srv *hcloud.Server) string {
+	switch {
+	case srv == nil:
+		return ""
+	case srv.Name != "":
+		return srv.Name
+	}
+	return strconv.FormatInt(srv.ID, 10)
+}
+
+// getVolume fetches the cloud volume backing the given docker volume, falling back to the naming scheme used by older
+// versions.
+func (hd *hetznerDriver) getVolume(name string) (*hcloud.Volume, error) {
+	prefixedName := prefixName(name)
+
+	vol, _, err := hd.client.Volume().GetByName(context.Background(), prefixedName)
+	if err != nil {
+		return nil, fmt.Errorf("getting cloud volume %q: %w", prefixedName, err)
+	}
+	if vol != nil {
+		return vol, nil
+	}
+
+	if legacyName := legacyPrefixName(name); legacyName != prefixedName {
+		vol, _, err = hd.client.Volume().GetByName(context.Background(), legacyName)
+		if err != nil {
+			return nil, fmt.Errorf("getting cloud volume %q: %w", legacyName, err)
+		}
+		if vol != nil {
+			// a truncated name may just as well belong to another docker volume sharing its beginning
+			if original, ok := getLabelString(vol.Labels, nameLabel); !ok || original == name {
+				return vol, nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("cloud volume %q not found", prefixedName)
+}
+
 func (hd *hetznerDriver) getServerForLocalhost() (*hcloud.Server, error) {
 	hostname, err := os.Hostname()
 	if err != nil {
@@ -371,48 +699,218 @@ func (hd *hetznerDriver) getServerForLocalhost() (*hcloud.Server, error) {
 	if err != nil {
 		return nil, fmt.Errorf("getting cloud server %q: %w", hostname, err)
 	}
+	if srv == nil {
+		return nil, fmt.Errorf("cloud server %q not found; make sure the hostname matches the hcloud server name", hostname)
+	}
 
 	return srv, nil
 }
 
+// serverLocation returns the location of the given server, falling back to the deprecated datacenter field
+func serverLocation(srv *hcloud.Server) *hcloud.Location {
+	if srv.Location != nil {
+		return srv.Location
+	}
+	if srv.Datacenter != nil {
+		return srv.Datacenter.Location
+	}
+	return nil
+}
+
 func (hd *hetznerDriver) waitForAction(act *hcloud.Action) error {
+	hd.journal.addAction(act)
+	defer hd.journal.removeAction(act)
+
 	_, errs := hd.client.Action().WatchProgress(context.Background(), act)
 	return <-errs
 }
 
-func validateOptions(volume string, opts map[string]string) {
+// validateOptions warns about unsupported driver_opts. In strict mode, unsupported options and invalid values are instead
+// reported together as an error, to refuse the volume before anything is created.
+func validateOptions(volume string, opts map[string]string) error {
+	var merr *multierror.Error
+
+	keys := make([]string, 0, len(opts))
 	for k := range opts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
 		switch k {
-		case "fstype", "size", "uid", "gid": // OK, noop
+		case "fstype", "size", "uid", "gid", "source", "mount_options", "profile", "lazy", "location", "readonly",
+			"autogrow_threshold", "autogrow_step", "autogrow_max", "trim": // OK, noop
 		default:
-			logrus.Warnf("unsupported driver_opt %q for volume %s", k, volume)
+			if !strictOptions() {
+				logrus.Warnf("unsupported driver_opt %q for volume %s", k, volume)
+				continue
+			}
+			merr = multierror.Append(merr, fmt.Errorf("unsupported option %q", k))
+		}
+	}
+
+	// a missing or broken profile would silently change the volume, so reject it regardless of strictness
+	if _, err := getProfile(opts); err != nil {
+		return fmt.Errorf("volume %q: %w", volume, err)
+	}
+
+	if !strictOptions() {
+		return nil
+	}
+
+	if fstype := getOption("fstype", opts); !isSupportedFilesystemType(fstype) {
+		merr = multierror.Append(merr, fmt.Errorf("unsupported fstype %q; must be one of %s", fstype, supportedFileystemTypes))
+	}
+
+	for _, k := range []string{"uid", "gid"} {
+		if v := getOption(k, opts); v != "" {
+			if id, err := strconv.Atoi(v); err != nil || id < 0 {
+				merr = multierror.Append(merr, fmt.Errorf("invalid %s %q: must be a non-negative integer", k, v))
+			}
 		}
 	}
+
+	for _, k := range []string{"lazy", "readonly", "trim"} {
+		if v := getOption(k, opts); v != "" && v != "true" && v != "false" {
+			merr = multierror.Append(merr, fmt.Errorf("invalid %s %q: must be true or false", k, v))
+		}
+	}
+
+	size, err := parseSize(getOption("size", opts))
+	if err != nil {
+		merr = multierror.Append(merr, err)
+	} else if size < apiMinSize && poolName() == "" {
+		merr = multierror.Append(merr, fmt.Errorf("invalid size %q: below the minimum of %dGB", getOption("size", opts), apiMinSize))
+	}
+
+	if err := validateMountOptions(getOption("mount_options", opts)); err != nil {
+		merr = multierror.Append(merr, err)
+	}
+
+	if loc := getOption("location", opts); loc != "" && !locationAllowed(loc) {
+		merr = multierror.Append(merr, fmt.Errorf("location %q not among the configured locations %v", loc, allowedLocations()))
+	}
+
+	if _, err := autogrowFromOptions(opts, size); err != nil {
+		merr = multierror.Append(merr, err)
+	}
+
+	if err := merr.ErrorOrNil(); err != nil {
+		return fmt.Errorf("invalid options for volume %q: %w", volume, err)
+	}
+	return nil
 }
 
+// getOption returns the value for k from the volume's options, the selected profile or the plugin settings, in that
+// order
 func getOption(k string, opts map[string]string) string {
 	if v, ok := opts[k]; ok {
 		return v
 	}
+	if v, ok := profileOption(k, opts); ok {
+		return v
+	}
 	return os.Getenv(k)
 }
 
+// the API limits volume names to 64 chars
+const volumeNameMaxLen = 64
+
+var invalidVolumeNameChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]`)
+
+// prefixName returns the name of the cloud volume backing the given docker volume. Names that would otherwise be
+// truncated or contain characters not allowed by the API get their tail replaced by a short hash of the original name,
+// to keep them unique.
 func prefixName(name string) string {
 	s := fmt.Sprintf("%s-%s", os.Getenv("prefix"), name)
-	if len(s) > 64 {
-		return s[:64]
+	sanitized := invalidVolumeNameChars.ReplaceAllString(s, "-")
+	if sanitized == s && len(s) <= volumeNameMaxLen {
+		return s
+	}
+
+	sum := sha256.Sum256([]byte(name))
+	suffix := "-" + hex.EncodeToString(sum[:4])
+	if len(sanitized) > volumeNameMaxLen-len(suffix) {
+		sanitized = sanitized[:volumeNameMaxLen-len(suffix)]
+	}
+	return sanitized + suffix
+}
+
+// legacyPrefixName returns the name used for the given docker volume by older versions, which simply truncated it.
+func legacyPrefixName(name string) string {
+	s := fmt.Sprintf("%s-%s", os.Getenv("prefix"), name)
+	if len(s) > volumeNameMaxLen {
+		return s[:volumeNameMaxLen]
 	}
 	return s
 }
 
-func unprefixedName(name string) string {
-	return strings.TrimPrefix(name, fmt.Sprintf("%s-", os.Getenv("prefix")))
+// unprefixedName returns the docker volume name for the given cloud volume, preferring the original name stored in its
+// labels.
+func unprefixedName(vol *hcloud.Volume) string {
+	if name, ok := getLabelString(vol.Labels, nameLabel); ok {
+		return name
+	}
+	return strings.TrimPrefix(vol.Name, fmt.Sprintf("%s-", os.Getenv("prefix")))
 }
 
 func nameHasPrefix(name string) bool {
 	return strings.HasPrefix(name, fmt.Sprintf("%s-", os.Getenv("prefix")))
 }
 
+// mountMode describes the access mode of a volume's mounts
+func mountMode(readonly bool) string {
+	if readonly {
+		return "ro"
+	}
+	return "rw"
+}
+
+// mount operations rather than options, which would break mounting volumes
+var mountOperations = []string{"bind", "rbind", "remount", "move"}
+
+// validateMountOptions checks that the given comma-separated mount options are well-formed options for mounting a
+// filesystem
+func validateMountOptions(options string) error {
+	if options == "" {
+		return nil
+	}
+	for _, o := range strings.Split(options, ",") {
+		name, _, _ := strings.Cut(o, "=")
+		switch {
+		case name == "" || strings.ContainsAny(o, " \t\n"):
+			return fmt.Errorf("invalid mount_options %q: malformed option %q", options, o)
+		case slices.Contains(mountOperations, name):
+			return fmt.Errorf("invalid mount_options %q: %q is not a mount option", options, o)
+		}
+	}
+	return nil
+}
+
+func joinMountOptions(options ...string) string {
+	var nonEmpty []string
+	for _, o := range options {
+		if o != "" {
+			nonEmpty = append(nonEmpty, o)
+		}
+	}
+	return strings.Join(nonEmpty, ",")
+}
+
+func strictOptions() bool {
+	return os.Getenv("strict_options") == "true"
+}
+
 func useProtection() bool {
 	return os.Getenv("use_protection") == "true"
 }
+
+const defaultDeviceTimeout = 30 * time.Second
+
+func deviceTimeout() time.Duration {
+	d, err := time.ParseDuration(os.Getenv("device_timeout"))
+	if err != nil || d <= 0 {
+		return defaultDeviceTimeout
+	}
+	return d
+}
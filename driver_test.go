@@ -1,10 +1,20 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud/schema"
 )
 
 func TestMain(m *testing.M) {
@@ -12,6 +22,8 @@ func TestMain(m *testing.M) {
 		"prefix": "docker",
 		"fstype": "ext4",
 		"size":   "10",
+		"uid":    "0",
+		"gid":    "0",
 	} {
 		os.Setenv(k, v)
 	}
@@ -40,6 +52,65 @@ func Test_getOption(t *testing.T) {
 	}
 }
 
+func Test_validateOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		strict  bool
+		opts    map[string]string
+		wantErr []string
+	}{
+		{"lenient ignores unknown", false, map[string]string{"foo": "bar", "fstype": "btrfs"}, nil},
+		{"strict valid", true, map[string]string{"size": "20G", "fstype": "xfs", "uid": "1000", "gid": "1000"}, nil},
+		{"strict defaults", true, nil, nil},
+		{
+			"strict aggregates",
+			true,
+			map[string]string{"foo": "bar", "fstype": "btrfs", "uid": "abc", "gid": "-1", "size": "1"},
+			[]string{`"foo"`, `"btrfs"`, `uid "abc"`, `gid "-1"`, `size "1"`},
+		},
+		{"strict size above maximum", true, map[string]string{"size": "20T"}, []string{`size "20T"`}},
+		{
+			"strict aggregates location, autogrow and mount options",
+			true,
+			map[string]string{"location": "hel1", "autogrow_threshold": "120", "mount_options": "noatime,,bind"},
+			[]string{`location "hel1"`, `autogrow_threshold "120"`, `mount_options "noatime,,bind"`},
+		},
+		{"strict autogrow_max below size", true, map[string]string{"size": "20G", "autogrow_threshold": "80", "autogrow_max": "10G"}, []string{"autogrow_max"}},
+		{"strict bind mount", true, map[string]string{"mount_options": "rbind"}, []string{`"rbind" is not a mount option`}},
+		{"strict valid extras", true, map[string]string{"location": "fsn1", "autogrow_threshold": "80", "mount_options": "noatime,commit=60"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("strict_options", strconv.FormatBool(tt.strict))
+			t.Setenv("locations", "fsn1,nbg1")
+
+			err := validateOptions("foo", tt.opts)
+			if (err != nil) != (tt.wantErr != nil) {
+				t.Fatalf("validateOptions() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			for _, want := range tt.wantErr {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("validateOptions() error = %v, want it to mention %s", err, want)
+				}
+			}
+		})
+	}
+}
+
+func Test_hetznerDriver_Create_strictOptions(t *testing.T) {
+	t.Setenv("strict_options", "true")
+
+	f := newFakeAPI(t)
+	hd := f.driver()
+	err := hd.Create(&volume.CreateRequest{Name: "foo", Options: map[string]string{"fstype": "btrfs", "uid": "abc"}})
+	if err == nil {
+		t.Fatal("hetznerDriver.Create() succeeded with invalid options")
+	}
+	if got := f.mutations(); len(got) != 0 {
+		t.Errorf("API mutations = %v, want none", got)
+	}
+}
+
 func Test_prefixName(t *testing.T) {
 	type args struct {
 		name string
@@ -53,8 +124,14 @@ func Test_prefixName(t *testing.T) {
 		{
 			"long", // API limits it to 64
 			args{name: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"},
-			"docker-aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa",
+			"docker-aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa-ffe054fe",
+		},
+		{
+			"long with same head",
+			args{name: "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaab"},
+			"docker-aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa-97aa7c54",
 		},
+		{"invalid chars", args{name: "foo@bar"}, "docker-foo-bar-eb6a491e"},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -66,19 +143,25 @@ func Test_prefixName(t *testing.T) {
 }
 
 func Test_unprefixedName(t *testing.T) {
+	longName := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	longLabels := map[string]string{}
+	setLabelString(longLabels, nameLabel, longName)
+
 	type args struct {
-		name string
+		vol *hcloud.Volume
 	}
 	tests := []struct {
 		name string
 		args args
 		want string
 	}{
-		{"remove prefix", args{name: "docker-foobar"}, "foobar"},
+		{"remove prefix", args{vol: &hcloud.Volume{Name: "docker-foobar"}}, "foobar"},
+		{"from label", args{vol: &hcloud.Volume{Name: "docker-foo-bar-5a0d2a6e", Labels: map[string]string{nameLabel: "foo_bar"}}}, "foo_bar"},
+		{"from encoded label", args{vol: &hcloud.Volume{Name: prefixName(longName), Labels: longLabels}}, longName},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := unprefixedName(tt.args.name); got != tt.want {
+			if got := unprefixedName(tt.args.vol); got != tt.want {
 				t.Errorf("unprefixedName() = %v, want %v", got, tt.want)
 			}
 		})
@@ -86,239 +169,733 @@ func Test_unprefixedName(t *testing.T) {
 }
 
 func Test_hetznerDriver_Create(t *testing.T) {
-	type fields struct {
-		client hetznerClienter
+	tests := []struct {
+		name       string
+		setup      func(f *fakeAPI)
+		req        *volume.CreateRequest
+		wantErr    bool
+		wantSize   int
+		wantServer bool
+		// rolled back after failing
+		wantDeleted bool
+	}{
+		{
+			name:       "defaults",
+			req:        &volume.CreateRequest{Name: "foo"},
+			wantSize:   10,
+			wantServer: true,
+		},
+		{
+			name:       "size option",
+			req:        &volume.CreateRequest{Name: "foo", Options: map[string]string{"size": "42"}},
+			wantSize:   42,
+			wantServer: true,
+		},
+		{
+			name:    "invalid size",
+			req:     &volume.CreateRequest{Name: "foo", Options: map[string]string{"size": "many"}},
+			wantErr: true,
+		},
+		{
+			name:    "size rejected by API",
+			req:     &volume.CreateRequest{Name: "foo", Options: map[string]string{"size": "1"}},
+			wantErr: true,
+		},
+		{
+			name:    "name taken",
+			setup:   func(f *fakeAPI) { f.addVolume("foo", "fsn1", 10, nil) },
+			req:     &volume.CreateRequest{Name: "foo"},
+			wantErr: true,
+		},
+		{
+			name:        "failed attach",
+			setup:       func(f *fakeAPI) { f.failNextAction("attach_volume", "server_error") },
+			req:         &volume.CreateRequest{Name: "foo"},
+			wantErr:     true,
+			wantDeleted: true,
+		},
 	}
-	type args struct {
-		req *volume.CreateRequest
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeAPI(t)
+			if tt.setup != nil {
+				tt.setup(f)
+			}
+			hd := f.driver()
+			if err := hd.Create(tt.req); (err != nil) != tt.wantErr {
+				t.Errorf("hetznerDriver.Create() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantDeleted {
+				if vol := f.volumeByName(prefixName(tt.req.Name)); vol != nil {
+					t.Errorf("volume %q not rolled back", vol.Name)
+				}
+				return
+			}
+			if tt.wantSize == 0 {
+				return
+			}
+			vol := f.volumeByName(prefixName(tt.req.Name))
+			if vol == nil {
+				t.Fatalf("volume %q not created", prefixName(tt.req.Name))
+			}
+			if vol.Size != tt.wantSize {
+				t.Errorf("created volume size = %d, want %d", vol.Size, tt.wantSize)
+			}
+			if (vol.Server != nil) != tt.wantServer {
+				t.Errorf("created volume attached = %v, want %v", vol.Server != nil, tt.wantServer)
+			}
+			if got, _ := getLabelString(vol.Labels, nameLabel); got != tt.req.Name {
+				t.Errorf("created volume name label = %q, want %q", got, tt.req.Name)
+			}
+		})
 	}
+}
+
+func Test_hetznerDriver_List(t *testing.T) {
+	f := newFakeAPI(t)
+	f.addVolume("foo", "fsn1", 10, nil)
+	f.addVolume("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", "fsn1", 10, nil)
+	f.mu.Lock()
+	f.newVolume("unmanaged", "fsn1", 10, nil)
+	f.mu.Unlock()
+
+	got, err := f.driver().List()
+	if err != nil {
+		t.Fatalf("hetznerDriver.List() error = %v", err)
+	}
+
+	names := make([]string, 0, len(got.Volumes))
+	for _, v := range got.Volumes {
+		names = append(names, v.Name)
+	}
+	sort.Strings(names)
+	want := []string{"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", "foo"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("hetznerDriver.List() = %v, want %v", names, want)
+	}
+}
+
+func Test_hetznerDriver_Get(t *testing.T) {
+	f := newFakeAPI(t)
+	f.addVolume("foo", "fsn1", 10, nil)
+
+	// volumes created by older versions under truncated names, one of them without labels
+	legacy := strings.Repeat("a", volumeNameMaxLen)
+	otherLegacy := strings.Repeat("b", volumeNameMaxLen)
+	f.mu.Lock()
+	f.newVolume(legacyPrefixName(legacy), "fsn1", 10, map[string]string{pluginLabel: ""})
+	otherLabels := map[string]string{pluginLabel: ""}
+	setLabelString(otherLabels, nameLabel, otherLegacy+"-other")
+	f.newVolume(legacyPrefixName(otherLegacy), "fsn1", 10, otherLabels)
+	f.mu.Unlock()
+
 	tests := []struct {
 		name    string
-		fields  fields
-		args    args
+		req     *volume.GetRequest
+		want    string
 		wantErr bool
 	}{
-		// TODO: Add test cases.
+		{"existing", &volume.GetRequest{Name: "foo"}, "foo", false},
+		{"missing", &volume.GetRequest{Name: "bar"}, "", true},
+		{"legacy name", &volume.GetRequest{Name: legacy}, legacyPrefixName(legacy)[len("docker-"):], false},
+		{"legacy name of another volume", &volume.GetRequest{Name: otherLegacy}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := f.driver().Get(tt.req)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("hetznerDriver.Get() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err == nil && got.Volume.Name != tt.want {
+				t.Errorf("hetznerDriver.Get() = %v, want %v", got.Volume.Name, tt.want)
+			}
+		})
+	}
+}
+
+func Test_hetznerDriver_Remove(t *testing.T) {
+	tests := []struct {
+		name          string
+		useProtection string
+		protected     bool
+		attached      bool
+		wantErr       bool
+	}{
+		{"unattached", "false", false, false, false},
+		{"attached", "false", false, true, false},
+		{"protected", "true", true, true, false},
+		{"protected without use_protection", "false", true, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("use_protection", tt.useProtection)
+
+			f := newFakeAPI(t)
+			var srv *schema.Server
+			if tt.attached {
+				srv = f.addServer("other", "fsn1")
+			}
+			vol := f.addVolume("foo", "fsn1", 10, srv)
+			vol.Protection.Delete = tt.protected
+
+			if err := f.driver().Remove(&volume.RemoveRequest{Name: "foo"}); (err != nil) != tt.wantErr {
+				t.Errorf("hetznerDriver.Remove() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if gone := f.volumeByName(prefixName("foo")) == nil; gone == tt.wantErr {
+				t.Errorf("volume removed = %v, want %v", gone, !tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_hetznerDriver_Path(t *testing.T) {
+	f := newFakeAPI(t)
+	f.addVolume("foo", "fsn1", 10, nil)
+
+	got, err := f.driver().Path(&volume.PathRequest{Name: "foo"})
+	if err != nil {
+		t.Fatalf("hetznerDriver.Path() error = %v", err)
+	}
+	// not mounted locally
+	if got.Mountpoint != "" {
+		t.Errorf("hetznerDriver.Path() = %v, want empty", got.Mountpoint)
+	}
+}
+
+func Test_hetznerDriver_Mount(t *testing.T) {
+	// there are no real devices behind the fake API, so mounting itself always fails
+	t.Setenv("device_timeout", "10ms")
+
+	tests := []struct {
+		name          string
+		attachedTo    string
+		wantMutations []string
+	}{
+		{
+			name:          "unattached",
+			wantMutations: []string{"POST /volumes/2/actions/attach"},
+		},
+		{
+			name:          "attached to other server",
+			attachedTo:    "other",
+			wantMutations: []string{"POST /volumes/3/actions/detach", "POST /volumes/3/actions/attach"},
+		},
+		{
+			name:       "attached locally",
+			attachedTo: "local",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeAPI(t)
+			var srv *schema.Server
+			switch tt.attachedTo {
+			case "other":
+				srv = f.addServer("other", "fsn1")
+			case "local":
+				srv = f.servers[1]
+			}
+			f.addVolume("foo", "fsn1", 10, srv)
+
+			_, err := f.driver().Mount(&volume.MountRequest{Name: "foo", ID: "some-id"})
+			if err == nil || !strings.Contains(err.Error(), "waiting for device") {
+				t.Errorf("hetznerDriver.Mount() error = %v, want device error", err)
+			}
+			if got := f.mutations(); !reflect.DeepEqual(got, tt.wantMutations) {
+				t.Errorf("API mutations = %v, want %v", got, tt.wantMutations)
+			}
+			if vol := f.volumeByName(prefixName("foo")); vol.Server == nil || *vol.Server != 1 {
+				t.Errorf("volume attached to %v, want local server", vol.Server)
+			}
+		})
+	}
+}
+
+func Test_hetznerDriver_lazy(t *testing.T) {
+	// there are no real devices behind the fake API, so mounting itself always fails
+	t.Setenv("device_timeout", "10ms")
+	t.Setenv("use_protection", "false")
+
+	f := newFakeAPI(t)
+	hd := f.driver()
+
+	if err := hd.Create(&volume.CreateRequest{Name: "foo", Options: map[string]string{"lazy": "true", "source": "bar"}}); err != nil {
+		t.Fatalf("hetznerDriver.Create() error = %v", err)
+	}
+	if got, want := f.mutations(), []string{"POST /volumes"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("API mutations = %v, want %v", got, want)
+	}
+	vol := f.volumeByName(prefixName("foo"))
+	if vol.Server != nil {
+		t.Errorf("lazily created volume attached to %v", *vol.Server)
+	}
+	if got := setupFromLabels(vol.Labels); got.source != "bar" || got.fstype != "ext4" {
+		t.Errorf("recorded setup = %+v", got)
+	}
+
+	got, err := hd.Get(&volume.GetRequest{Name: "foo"})
+	if err != nil {
+		t.Fatalf("hetznerDriver.Get() error = %v", err)
+	}
+	if got.Volume.Status["state"] != statePending {
+		t.Errorf("hetznerDriver.Get() status = %v, want pending state", got.Volume.Status)
+	}
+
+	// created by a node in another location, without source to get past initialization
+	f.mu.Lock()
+	vol.Location = f.locations["nbg1"]
+	delete(vol.Labels, setupLabelPrefix+"source")
+	f.mu.Unlock()
+
+	if _, err := hd.Mount(&volume.MountRequest{Name: "foo", ID: "some-id"}); err == nil || !strings.Contains(err.Error(), "waiting for device") {
+		t.Errorf("hetznerDriver.Mount() error = %v, want device error", err)
+	}
+
+	moved := f.volumeByName(prefixName("foo"))
+	wantMutations := []string{
+		"POST /volumes",
+		fmt.Sprintf("PUT /volumes/%d", vol.ID),
+		"POST /volumes",
+		fmt.Sprintf("DELETE /volumes/%d", vol.ID),
+		fmt.Sprintf("POST /volumes/%d/actions/attach", moved.ID),
+		fmt.Sprintf("PUT /volumes/%d", moved.ID),
+	}
+	if got := f.mutations(); !reflect.DeepEqual(got, wantMutations) {
+		t.Errorf("API mutations = %v, want %v", got, wantMutations)
+	}
+	if moved.Location.Name != "fsn1" || moved.Server == nil || *moved.Server != 1 {
+		t.Errorf("provisioned volume in %q attached to %v, want fsn1 and local server", moved.Location.Name, moved.Server)
+	}
+	if _, ok := moved.Labels[stateLabel]; ok {
+		t.Errorf("provisioned volume still has state label: %v", moved.Labels)
+	}
+	if got, _ := getLabelString(moved.Labels, nameLabel); got != "foo" {
+		t.Errorf("provisioned volume name label = %q, want %q", got, "foo")
+	}
+}
+
+func Test_hetznerDriver_relocateVolume(t *testing.T) {
+	tests := []struct {
+		name      string
+		protected bool
+		failFirst string
+		wantErr   bool
+		wantCalls []string
+		wantNames []string
+	}{
+		{"unprotected", false, "", false, []string{
+			"Volume.Update docker-foo",
+			"Volume.Create docker-foo",
+			"Volume.Delete docker-foo-relocating",
+		}, []string{"docker-foo"}},
+		{"protected by an earlier attempt", true, "", false, []string{
+			"Volume.Update docker-foo",
+			"Volume.Create docker-foo",
+			"Volume.ChangeProtection docker-foo-relocating false",
+			"Volume.Delete docker-foo-relocating",
+		}, []string{"docker-foo"}},
+		{"create fails", false, "Volume.Create", true, []string{
+			"Volume.Update docker-foo",
+			"Volume.Create docker-foo",
+			"Volume.Update docker-foo-relocating",
+		}, []string{"docker-foo"}},
+		{"delete fails", false, "Volume.Delete", false, []string{
+			"Volume.Update docker-foo",
+			"Volume.Create docker-foo",
+			"Volume.Delete docker-foo-relocating",
+		}, []string{"docker-foo", "docker-foo-relocating"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMockClient()
+			vol := m.addVolume("foo", "nbg1", nil)
+			vol.Protection.Delete = tt.protected
+			if tt.failFirst != "" {
+				m.failCall(tt.failFirst, 1, errors.New("temporary failure"))
+			}
+			hd := &hetznerDriver{client: m}
+
+			got, err := hd.relocateVolume(m.copyVolume(vol), &hcloud.Location{Name: "fsn1"})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("hetznerDriver.relocateVolume() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && got.Location.Name != "fsn1" {
+				t.Errorf("hetznerDriver.relocateVolume() location = %q, want fsn1", got.Location.Name)
+			}
+			if calls := mutatingCalls(m); !reflect.DeepEqual(calls, tt.wantCalls) {
+				t.Errorf("calls = %v, want %v", calls, tt.wantCalls)
+			}
+			var names []string
+			for _, v := range m.volumes {
+				names = append(names, v.Name)
+			}
+			sort.Strings(names)
+			if !reflect.DeepEqual(names, tt.wantNames) {
+				t.Errorf("volumes = %v, want %v", names, tt.wantNames)
+			}
+		})
+	}
+}
+
+func Test_hetznerDriver_provisionVolume_incompleteElsewhere(t *testing.T) {
+	m := newMockClient()
+	vol := m.addVolume("foo", "nbg1", nil)
+	vol.Labels[stateLabel] = stateIncomplete
+	vol.Labels[stepLabel] = stepFinalize
+	hd := &hetznerDriver{client: m}
+
+	_, err := hd.provisionVolume(m.copyVolume(vol), m.servers[1])
+	var perr *provisionError
+	if !errors.As(err, &perr) || perr.step != stepRelocate {
+		t.Errorf("hetznerDriver.provisionVolume() error = %v, want failure at step %s", err, stepRelocate)
+	}
+	if calls := mutatingCalls(m); len(calls) != 0 {
+		t.Errorf("incomplete volume changed: %v", calls)
+	}
+}
+
+func Test_hetznerDriver_Unmount(t *testing.T) {
+	defer func(orig string) { propagatedMountPath = orig }(propagatedMountPath)
+	propagatedMountPath = t.TempDir()
+
+	tests := []struct {
+		name          string
+		attachedTo    string
+		wantMutations []string
+	}{
+		{"attached locally", "local", []string{"POST /volumes/2/actions/detach"}},
+		{"attached elsewhere", "other", nil},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			hd := &hetznerDriver{
-				client: tt.fields.client,
+			f := newFakeAPI(t)
+			srv := f.servers[1]
+			if tt.attachedTo == "other" {
+				srv = f.addServer("other", "fsn1")
+			}
+			f.addVolume("foo", "fsn1", 10, srv)
+
+			mountpoint := filepath.Join(propagatedMountPath, "some-id")
+			if err := os.Mkdir(mountpoint, 0o755); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := f.driver().Unmount(&volume.UnmountRequest{Name: "foo", ID: "some-id"}); err != nil {
+				t.Errorf("hetznerDriver.Unmount() error = %v", err)
+			}
+			if _, err := os.Stat(mountpoint); !os.IsNotExist(err) {
+				t.Errorf("mountpoint not removed: %v", err)
 			}
-			if err := hd.Create(tt.args.req); (err != nil) != tt.wantErr {
+			if got := f.mutations(); !reflect.DeepEqual(got, tt.wantMutations) {
+				t.Errorf("API mutations = %v, want %v", got, tt.wantMutations)
+			}
+		})
+	}
+}
+
+func Test_hetznerDriver_getServerForLocalhost(t *testing.T) {
+	f := newFakeAPI(t)
+	hostname, _ := os.Hostname()
+
+	got, err := f.driver().getServerForLocalhost()
+	if err != nil {
+		t.Fatalf("hetznerDriver.getServerForLocalhost() error = %v", err)
+	}
+	if got.Name != hostname {
+		t.Errorf("hetznerDriver.getServerForLocalhost() = %v, want %v", got.Name, hostname)
+	}
+
+	f.servers[1].Name = "renamed"
+	if _, err := f.driver().getServerForLocalhost(); err == nil {
+		t.Errorf("hetznerDriver.getServerForLocalhost() error = nil for unknown server")
+	}
+}
+
+func Test_hetznerDriver_Create_calls(t *testing.T) {
+	t.Setenv("use_protection", "true")
+	hostname, _ := os.Hostname()
+
+	tests := []struct {
+		name      string
+		setup     func(m *mockClient)
+		wantErr   bool
+		wantCalls []string
+	}{
+		{
+			name: "success",
+			wantCalls: []string{
+				"Volume.GetByName docker-foo",
+				"Server.GetByName " + hostname,
+				"Volume.Create docker-foo",
+				"Action.WatchProgress create_volume",
+				"Volume.Attach docker-foo " + hostname,
+				"Action.WatchProgress attach_volume",
+				"Volume.ChangeProtection docker-foo true",
+				"Action.WatchProgress change_protection",
+				"Volume.Update docker-foo",
+			},
+		},
+		{
+			name: "create fails",
+			setup: func(m *mockClient) {
+				m.failCall("Volume.Create", 1, hcloud.Error{Code: hcloud.ErrorCodeResourceLimitExceeded})
+			},
+			wantErr: true,
+			wantCalls: []string{
+				"Volume.GetByName docker-foo",
+				"Server.GetByName " + hostname,
+				"Volume.Create docker-foo",
+			},
+		},
+		{
+			name:    "attach action fails",
+			setup:   func(m *mockClient) { m.failAction("attach_volume", hcloud.Error{Code: hcloud.ErrorCodeServerError}) },
+			wantErr: true,
+			wantCalls: []string{
+				"Volume.GetByName docker-foo",
+				"Server.GetByName " + hostname,
+				"Volume.Create docker-foo",
+				"Action.WatchProgress create_volume",
+				"Volume.Attach docker-foo " + hostname,
+				"Action.WatchProgress attach_volume",
+				"Volume.GetByName docker-foo",
+				"Volume.Delete docker-foo",
+			},
+		},
+		{
+			name:    "finalizing fails",
+			setup:   func(m *mockClient) { m.failCall("Volume.Update", 1, hcloud.Error{Code: hcloud.ErrorCodeServerError}) },
+			wantErr: true,
+			wantCalls: []string{
+				"Volume.GetByName docker-foo",
+				"Server.GetByName " + hostname,
+				"Volume.Create docker-foo",
+				"Action.WatchProgress create_volume",
+				"Volume.Attach docker-foo " + hostname,
+				"Action.WatchProgress attach_volume",
+				"Volume.ChangeProtection docker-foo true",
+				"Action.WatchProgress change_protection",
+				"Volume.Update docker-foo",
+				"Volume.GetByName docker-foo",
+				"Volume.ChangeProtection docker-foo false",
+				"Action.WatchProgress change_protection",
+				"Volume.Detach docker-foo",
+				"Action.WatchProgress detach_volume",
+				"Volume.Delete docker-foo",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMockClient()
+			if tt.setup != nil {
+				tt.setup(m)
+			}
+			hd := &hetznerDriver{client: m}
+			if err := hd.Create(&volume.CreateRequest{Name: "foo"}); (err != nil) != tt.wantErr {
 				t.Errorf("hetznerDriver.Create() error = %v, wantErr %v", err, tt.wantErr)
 			}
+			if got := m.getCalls(); !reflect.DeepEqual(got, tt.wantCalls) {
+				t.Errorf("calls = %#v, want %#v", got, tt.wantCalls)
+			}
 		})
 	}
 }
 
-// func Test_hetznerDriver_List(t *testing.T) {
-// 	type fields struct {
-// 		client *hcloud.Client
-// 	}
-// 	tests := []struct {
-// 		name    string
-// 		fields  fields
-// 		want    *volume.ListResponse
-// 		wantErr bool
-// 	}{
-// 		// TODO: Add test cases.
-// 	}
-// 	for _, tt := range tests {
-// 		t.Run(tt.name, func(t *testing.T) {
-// 			hd := &hetznerDriver{
-// 				client: tt.fields.client,
-// 			}
-// 			got, err := hd.List()
-// 			if (err != nil) != tt.wantErr {
-// 				t.Errorf("hetznerDriver.List() error = %v, wantErr %v", err, tt.wantErr)
-// 				return
-// 			}
-// 			if !reflect.DeepEqual(got, tt.want) {
-// 				t.Errorf("hetznerDriver.List() = %v, want %v", got, tt.want)
-// 			}
-// 		})
-// 	}
-// }
-
-// func Test_hetznerDriver_Get(t *testing.T) {
-// 	type fields struct {
-// 		client *hcloud.Client
-// 	}
-// 	type args struct {
-// 		req *volume.GetRequest
-// 	}
-// 	tests := []struct {
-// 		name    string
-// 		fields  fields
-// 		args    args
-// 		want    *volume.GetResponse
-// 		wantErr bool
-// 	}{
-// 		// TODO: Add test cases.
-// 	}
-// 	for _, tt := range tests {
-// 		t.Run(tt.name, func(t *testing.T) {
-// 			hd := &hetznerDriver{
-// 				client: tt.fields.client,
-// 			}
-// 			got, err := hd.Get(tt.args.req)
-// 			if (err != nil) != tt.wantErr {
-// 				t.Errorf("hetznerDriver.Get() error = %v, wantErr %v", err, tt.wantErr)
-// 				return
-// 			}
-// 			if !reflect.DeepEqual(got, tt.want) {
-// 				t.Errorf("hetznerDriver.Get() = %v, want %v", got, tt.want)
-// 			}
-// 		})
-// 	}
-// }
-
-// func Test_hetznerDriver_Remove(t *testing.T) {
-// 	type fields struct {
-// 		client *hcloud.Client
-// 	}
-// 	type args struct {
-// 		req *volume.RemoveRequest
-// 	}
-// 	tests := []struct {
-// 		name    string
-// 		fields  fields
-// 		args    args
-// 		wantErr bool
-// 	}{
-// 		// TODO: Add test cases.
-// 	}
-// 	for _, tt := range tests {
-// 		t.Run(tt.name, func(t *testing.T) {
-// 			hd := &hetznerDriver{
-// 				client: tt.fields.client,
-// 			}
-// 			if err := hd.Remove(tt.args.req); (err != nil) != tt.wantErr {
-// 				t.Errorf("hetznerDriver.Remove() error = %v, wantErr %v", err, tt.wantErr)
-// 			}
-// 		})
-// 	}
-// }
-
-// func Test_hetznerDriver_Path(t *testing.T) {
-// 	type fields struct {
-// 		client *hcloud.Client
-// 	}
-// 	type args struct {
-// 		req *volume.PathRequest
-// 	}
-// 	tests := []struct {
-// 		name    string
-// 		fields  fields
-// 		args    args
-// 		want    *volume.PathResponse
-// 		wantErr bool
-// 	}{
-// 		// TODO: Add test cases.
-// 	}
-// 	for _, tt := range tests {
-// 		t.Run(tt.name, func(t *testing.T) {
-// 			hd := &hetznerDriver{
-// 				client: tt.fields.client,
-// 			}
-// 			got, err := hd.Path(tt.args.req)
-// 			if (err != nil) != tt.wantErr {
-// 				t.Errorf("hetznerDriver.Path() error = %v, wantErr %v", err, tt.wantErr)
-// 				return
-// 			}
-// 			if !reflect.DeepEqual(got, tt.want) {
-// 				t.Errorf("hetznerDriver.Path() = %v, want %v", got, tt.want)
-// 			}
-// 		})
-// 	}
-// }
-
-// func Test_hetznerDriver_Mount(t *testing.T) {
-// 	type fields struct {
-// 		client *hcloud.Client
-// 	}
-// 	type args struct {
-// 		req *volume.MountRequest
-// 	}
-// 	tests := []struct {
-// 		name    string
-// 		fields  fields
-// 		args    args
-// 		want    *volume.MountResponse
-// 		wantErr bool
-// 	}{
-// 		// TODO: Add test cases.
-// 	}
-// 	for _, tt := range tests {
-// 		t.Run(tt.name, func(t *testing.T) {
-// 			hd := &hetznerDriver{
-// 				client: tt.fields.client,
-// 			}
-// 			got, err := hd.Mount(tt.args.req)
-// 			if (err != nil) != tt.wantErr {
-// 				t.Errorf("hetznerDriver.Mount() error = %v, wantErr %v", err, tt.wantErr)
-// 				return
-// 			}
-// 			if !reflect.DeepEqual(got, tt.want) {
-// 				t.Errorf("hetznerDriver.Mount() = %v, want %v", got, tt.want)
-// 			}
-// 		})
-// 	}
-// }
-
-// func Test_hetznerDriver_Unmount(t *testing.T) {
-// 	type fields struct {
-// 		client *hcloud.Client
-// 	}
-// 	type args struct {
-// 		req *volume.UnmountRequest
-// 	}
-// 	tests := []struct {
-// 		name    string
-// 		fields  fields
-// 		args    args
-// 		wantErr bool
-// 	}{
-// 		// TODO: Add test cases.
-// 	}
-// 	for _, tt := range tests {
-// 		t.Run(tt.name, func(t *testing.T) {
-// 			hd := &hetznerDriver{
-// 				client: tt.fields.client,
-// 			}
-// 			if err := hd.Unmount(tt.args.req); (err != nil) != tt.wantErr {
-// 				t.Errorf("hetznerDriver.Unmount() error = %v, wantErr %v", err, tt.wantErr)
-// 			}
-// 		})
-// 	}
-// }
-
-// func Test_hetznerDriver_getServerForLocalhost(t *testing.T) {
-// 	type fields struct {
-// 		client *hcloud.Client
-// 	}
-// 	tests := []struct {
-// 		name    string
-// 		fields  fields
-// 		want    *hcloud.Server
-// 		wantErr bool
-// 	}{
-// 		// TODO: Add test cases.
-// 	}
-// 	for _, tt := range tests {
-// 		t.Run(tt.name, func(t *testing.T) {
-// 			hd := &hetznerDriver{
-// 				client: tt.fields.client,
-// 			}
-// 			got, err := hd.getServerForLocalhost()
-// 			if (err != nil) != tt.wantErr {
-// 				t.Errorf("hetznerDriver.getServerForLocalhost() error = %v, wantErr %v", err, tt.wantErr)
-// 				return
-// 			}
-// 			if !reflect.DeepEqual(got, tt.want) {
-// 				t.Errorf("hetznerDriver.getServerForLocalhost() = %v, want %v", got, tt.want)
-// 			}
-// 		})
-// 	}
-// }
+func Test_hetznerDriver_Create_incomplete(t *testing.T) {
+	t.Setenv("use_protection", "false")
+	t.Setenv("keep_incomplete", "true")
+	t.Setenv("device_timeout", "10ms")
+
+	m := newMockClient()
+	hd := &hetznerDriver{client: m}
+
+	// there are no devices behind the mock, so chowning them fails
+	err := hd.Create(&volume.CreateRequest{Name: "foo", Options: map[string]string{"uid": "999"}})
+	if err == nil || !strings.Contains(err.Error(), "step initialize") {
+		t.Fatalf("hetznerDriver.Create() error = %v, want failure at initialize", err)
+	}
+
+	got, err := hd.Get(&volume.GetRequest{Name: "foo"})
+	if err != nil {
+		t.Fatalf("hetznerDriver.Get() error = %v", err)
+	}
+	if got.Volume.Status["state"] != stateIncomplete || got.Volume.Status["failed_step"] != stepInitialize {
+		t.Errorf("hetznerDriver.Get() status = %v, want incomplete at initialize", got.Volume.Status)
+	}
+
+	// resumed with the options of the first attempt, without creating or attaching it again
+	before := len(m.getCalls())
+	if err := hd.Create(&volume.CreateRequest{Name: "foo"}); err == nil || !strings.Contains(err.Error(), "step initialize") {
+		t.Fatalf("hetznerDriver.Create() error = %v, want failure at initialize", err)
+	}
+	for _, call := range m.getCalls()[before:] {
+		if strings.HasPrefix(call, "Volume.Create") || strings.HasPrefix(call, "Volume.Attach") {
+			t.Errorf("resuming create called %s", call)
+		}
+	}
+
+	// finished once only the labels are left to update
+	vol, err := hd.getVolume("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := hd.markIncomplete(vol.Name, stepFinalize); err != nil {
+		t.Fatal(err)
+	}
+	if err := hd.Create(&volume.CreateRequest{Name: "foo"}); err != nil {
+		t.Fatalf("hetznerDriver.Create() error = %v", err)
+	}
+	vol, err = hd.getVolume("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k := range vol.Labels {
+		if k == stateLabel || k == stepLabel || strings.HasPrefix(k, setupLabelPrefix) {
+			t.Errorf("label %q left on created volume", k)
+		}
+	}
+
+	// created volumes aren't touched by later creates
+	if err := hd.Create(&volume.CreateRequest{Name: "foo"}); err == nil {
+		t.Error("hetznerDriver.Create() succeeded on existing volume")
+	}
+}
+
+func Test_hetznerDriver_Mount_takeover(t *testing.T) {
+	t.Setenv("device_timeout", "10ms")
+	hostname, _ := os.Hostname()
+
+	tests := []struct {
+		name      string
+		setup     func(m *mockClient, other *hcloud.Server)
+		wantErr   string
+		wantCalls []string
+	}{
+		{
+			name:    "detach from other server",
+			wantErr: "waiting for device", // there is no real device behind the mock
+			wantCalls: []string{
+				"Volume.GetByName docker-foo",
+				"Server.GetByID 2",
+				"Server.GetByName " + hostname,
+				"Volume.Detach docker-foo",
+				"Action.WatchProgress detach_volume",
+				"Volume.Attach docker-foo " + hostname,
+				"Action.WatchProgress attach_volume",
+			},
+		},
+		{
+			name: "attached concurrently by another server",
+			setup: func(m *mockClient, other *hcloud.Server) {
+				m.hookCall("Volume.Attach", 1, func(m *mockClient) { m.attachElsewhere("foo", other) })
+			},
+			wantErr: "already attached",
+			wantCalls: []string{
+				"Volume.GetByName docker-foo",
+				"Server.GetByID 2",
+				"Server.GetByName " + hostname,
+				"Volume.Detach docker-foo",
+				"Action.WatchProgress detach_volume",
+				"Volume.Attach docker-foo " + hostname,
+			},
+		},
+		{
+			name: "detach fails",
+			setup: func(m *mockClient, _ *hcloud.Server) {
+				m.failAction("detach_volume", hcloud.Error{Code: hcloud.ErrorCodeLocked})
+			},
+			wantErr: "waiting for volume detachment",
+			wantCalls: []string{
+				"Volume.GetByName docker-foo",
+				"Server.GetByID 2",
+				"Server.GetByName " + hostname,
+				"Volume.Detach docker-foo",
+				"Action.WatchProgress detach_volume",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMockClient()
+			other := m.addServer("other", "fsn1")
+			m.addVolume("foo", "fsn1", other)
+			if tt.setup != nil {
+				tt.setup(m, other)
+			}
+			hd := &hetznerDriver{client: m}
+			if _, err := hd.Mount(&volume.MountRequest{Name: "foo", ID: "some-id"}); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("hetznerDriver.Mount() error = %v, want %q", err, tt.wantErr)
+			}
+			if got := m.getCalls(); !reflect.DeepEqual(got, tt.wantCalls) {
+				t.Errorf("calls = %#v, want %#v", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func Test_hetznerDriver_Remove_protection(t *testing.T) {
+	t.Setenv("use_protection", "true")
+
+	tests := []struct {
+		name      string
+		setup     func(m *mockClient)
+		wantErr   bool
+		wantCalls []string
+	}{
+		{
+			name: "success",
+			wantCalls: []string{
+				"Volume.GetByName docker-foo",
+				"Volume.ChangeProtection docker-foo false",
+				"Action.WatchProgress change_protection",
+				"Volume.Detach docker-foo",
+				"Action.WatchProgress detach_volume",
+				"Volume.Delete docker-foo",
+			},
+		},
+		{
+			name: "unprotect fails",
+			setup: func(m *mockClient) {
+				m.failCall("Volume.ChangeProtection", 1, hcloud.Error{Code: hcloud.ErrorCodeForbidden})
+			},
+			wantErr: true,
+			wantCalls: []string{
+				"Volume.GetByName docker-foo",
+				"Volume.ChangeProtection docker-foo false",
+			},
+		},
+		{
+			name: "slow actions",
+			setup: func(m *mockClient) {
+				m.actionDelay = 10 * time.Millisecond
+			},
+			wantCalls: []string{
+				"Volume.GetByName docker-foo",
+				"Volume.ChangeProtection docker-foo false",
+				"Action.WatchProgress change_protection",
+				"Volume.Detach docker-foo",
+				"Action.WatchProgress detach_volume",
+				"Volume.Delete docker-foo",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMockClient()
+			vol := m.addVolume("foo", "fsn1", m.addServer("other", "fsn1"))
+			vol.Protection.Delete = true
+			if tt.setup != nil {
+				tt.setup(m)
+			}
+			hd := &hetznerDriver{client: m}
+			if err := hd.Remove(&volume.RemoveRequest{Name: "foo"}); (err != nil) != tt.wantErr {
+				t.Errorf("hetznerDriver.Remove() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := m.getCalls(); !reflect.DeepEqual(got, tt.wantCalls) {
+				t.Errorf("calls = %#v, want %#v", got, tt.wantCalls)
+			}
+		})
+	}
+}
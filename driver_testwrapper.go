@@ -15,12 +15,15 @@ type hetznerClienter interface {
 
 type hetznerVolumeClienter interface {
 	All(context.Context) ([]*hcloud.Volume, error)
+	AllWithOpts(context.Context, hcloud.VolumeListOpts) ([]*hcloud.Volume, error)
 	Attach(context.Context, *hcloud.Volume, *hcloud.Server) (*hcloud.Action, *hcloud.Response, error)
 	ChangeProtection(context.Context, *hcloud.Volume, hcloud.VolumeChangeProtectionOpts) (*hcloud.Action, *hcloud.Response, error)
 	Create(context.Context, hcloud.VolumeCreateOpts) (hcloud.VolumeCreateResult, *hcloud.Response, error)
 	Delete(context.Context, *hcloud.Volume) (*hcloud.Response, error)
 	Detach(context.Context, *hcloud.Volume) (*hcloud.Action, *hcloud.Response, error)
 	GetByName(context.Context, string) (*hcloud.Volume, *hcloud.Response, error)
+	Resize(context.Context, *hcloud.Volume, int) (*hcloud.Action, *hcloud.Response, error)
+	Update(context.Context, *hcloud.Volume, hcloud.VolumeUpdateOpts) (*hcloud.Volume, *hcloud.Response, error)
 }
 
 type hetznerServerClienter interface {
@@ -29,6 +32,7 @@ type hetznerServerClienter interface {
 }
 
 type hetznerActionClienter interface {
+	GetByID(ctx context.Context, id int64) (*hcloud.Action, *hcloud.Response, error)
 	WatchProgress(ctx context.Context, action *hcloud.Action) (<-chan int, <-chan error)
 }
 
@@ -0,0 +1,496 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud/schema"
+)
+
+// fakeAPI is an in-memory implementation of the parts of the Hetzner Cloud API used by the driver. Actions progress a
+// step each time they are polled and only take effect once finished; resources with running actions are locked.
+type fakeAPI struct {
+	t      *testing.T
+	server *httptest.Server
+
+	mu        sync.Mutex
+	lastID    int64
+	locations map[string]schema.Location
+	servers   map[int64]*schema.Server
+	volumes   map[int64]*schema.Volume
+	actions   map[int64]*fakeAction
+	// resource lock, keyed by volume ID, holding the ID of the running action
+	locks map[int64]int64
+	// commands whose next action should fail with the given error code
+	failActions map[string]string
+	// how much each poll advances a running action
+	progressStep int
+	// log of all mutating requests, as "METHOD path"
+	requests []string
+}
+
+type fakeAction struct {
+	action   schema.Action
+	volumeID int64
+	failWith string
+	apply    func()
+}
+
+// newFakeAPI starts a fake API, containing a server named after the local hostname in location fsn1
+func newFakeAPI(t *testing.T) *fakeAPI {
+	t.Helper()
+
+	f := &fakeAPI{
+		t: t,
+		locations: map[string]schema.Location{
+			"fsn1": {ID: 1, Name: "fsn1", NetworkZone: "eu-central"},
+			"nbg1": {ID: 2, Name: "nbg1", NetworkZone: "eu-central"},
+			"hel1": {ID: 3, Name: "hel1", NetworkZone: "eu-central"},
+		},
+		servers:      map[int64]*schema.Server{},
+		volumes:      map[int64]*schema.Volume{},
+		actions:      map[int64]*fakeAction{},
+		locks:        map[int64]int64{},
+		failActions:  map[string]string{},
+		progressStep: 50,
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.addServer(hostname, "fsn1")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /servers", f.listServers)
+	mux.HandleFunc("GET /servers/{id}", f.getServer)
+	mux.HandleFunc("GET /volumes", f.listVolumes)
+	mux.HandleFunc("GET /volumes/{id}", f.getVolume)
+	mux.HandleFunc("POST /volumes", f.createVolume)
+	mux.HandleFunc("PUT /volumes/{id}", f.updateVolume)
+	mux.HandleFunc("DELETE /volumes/{id}", f.deleteVolume)
+	mux.HandleFunc("POST /volumes/{id}/actions/{action}", f.volumeAction)
+	mux.HandleFunc("GET /actions", f.listActions)
+	mux.HandleFunc("GET /actions/{id}", f.getAction)
+
+	f.server = httptest.NewServer(mux)
+	t.Cleanup(f.server.Close)
+
+	return f
+}
+
+// driver returns a driver talking to the fake API through a real hcloud client
+func (f *fakeAPI) driver() *hetznerDriver {
+	return &hetznerDriver{
+		client: &hetznerClient{hcloud.NewClient(
+			hcloud.WithToken("fake"),
+			hcloud.WithEndpoint(f.server.URL),
+			hcloud.WithPollOpts(hcloud.PollOpts{BackoffFunc: hcloud.ConstantBackoff(time.Millisecond)}),
+			hcloud.WithRetryOpts(hcloud.RetryOpts{BackoffFunc: hcloud.ConstantBackoff(time.Millisecond), MaxRetries: 1}),
+		)},
+	}
+}
+
+func (f *fakeAPI) nextID() int64 {
+	f.lastID++
+	return f.lastID
+}
+
+func (f *fakeAPI) addServer(name, location string) *schema.Server {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	srv := &schema.Server{ID: f.nextID(), Name: name, Status: "running", Location: f.locations[location]}
+	f.servers[srv.ID] = srv
+	return srv
+}
+
+// addVolume adds an existing volume for the given docker volume name, as if created by the plugin
+func (f *fakeAPI) addVolume(name, location string, size int, server *schema.Server) *schema.Volume {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	labels := map[string]string{pluginLabel: ""}
+	setLabelString(labels, nameLabel, name)
+	vol := f.newVolume(prefixName(name), location, size, labels)
+	vol.Format = hcloud.Ptr("ext4")
+	vol.Status = "available"
+	if server != nil {
+		vol.Server = hcloud.Ptr(server.ID)
+	}
+	return vol
+}
+
+func (f *fakeAPI) newVolume(name, location string, size int, labels map[string]string) *schema.Volume {
+	vol := &schema.Volume{
+		ID:       f.nextID(),
+		Name:     name,
+		Status:   "creating",
+		Location: f.locations[location],
+		Size:     size,
+		Labels:   labels,
+		Created:  time.Now(),
+	}
+	vol.LinuxDevice = fmt.Sprintf("/dev/disk/by-id/scsi-0HC_Volume_%d", vol.ID)
+	f.volumes[vol.ID] = vol
+	return vol
+}
+
+func (f *fakeAPI) volumeByName(name string) *schema.Volume {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, vol := range f.volumes {
+		if vol.Name == name {
+			return vol
+		}
+	}
+	return nil
+}
+
+// failNextAction makes the next action with the given command finish with the given error code
+func (f *fakeAPI) failNextAction(command, code string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.failActions[command] = code
+}
+
+func (f *fakeAPI) mutations() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]string(nil), f.requests...)
+}
+
+// startAction registers a running action on the given volume, locking it until apply has been called
+func (f *fakeAPI) startAction(command string, volumeID int64, apply func()) *schema.Action {
+	act := &fakeAction{
+		action: schema.Action{
+			ID:        f.nextID(),
+			Status:    "running",
+			Command:   command,
+			Started:   time.Now(),
+			Resources: []schema.ActionResourceReference{{ID: volumeID, Type: "volume"}},
+		},
+		volumeID: volumeID,
+		failWith: f.failActions[command],
+		apply:    apply,
+	}
+	delete(f.failActions, command)
+	f.actions[act.action.ID] = act
+	f.locks[volumeID] = act.action.ID
+	return &act.action
+}
+
+// advance moves the given action forward a step, finishing it if it reaches 100%
+func (f *fakeAPI) advance(act *fakeAction) {
+	if act.action.Status != "running" {
+		return
+	}
+
+	act.action.Progress = min(100, act.action.Progress+f.progressStep)
+	if act.action.Progress < 100 {
+		return
+	}
+
+	now := time.Now()
+	act.action.Finished = &now
+	delete(f.locks, act.volumeID)
+
+	if act.failWith != "" {
+		act.action.Status = "error"
+		act.action.Error = &schema.ActionError{Code: act.failWith, Message: "injected failure"}
+		return
+	}
+
+	act.action.Status = "success"
+	if act.apply != nil {
+		act.apply()
+	}
+}
+
+func (f *fakeAPI) writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		f.t.Errorf("fake API: encoding response: %v", err)
+	}
+}
+
+func (f *fakeAPI) writeError(w http.ResponseWriter, status int, code, format string, args ...interface{}) {
+	f.writeJSON(w, status, schema.ErrorResponse{Error: schema.Error{Code: code, Message: fmt.Sprintf(format, args...)}})
+}
+
+func (f *fakeAPI) recordMutation(r *http.Request) {
+	f.requests = append(f.requests, fmt.Sprintf("%s %s", r.Method, r.URL.Path))
+}
+
+func pathID(r *http.Request) int64 {
+	id, _ := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	return id
+}
+
+func (f *fakeAPI) listServers(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	resp := schema.ServerListResponse{Servers: []schema.Server{}}
+	for _, srv := range f.servers {
+		if name := r.URL.Query().Get("name"); name != "" && srv.Name != name {
+			continue
+		}
+		resp.Servers = append(resp.Servers, *srv)
+	}
+	f.writeJSON(w, http.StatusOK, resp)
+}
+
+func (f *fakeAPI) getServer(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	srv, ok := f.servers[pathID(r)]
+	if !ok {
+		f.writeError(w, http.StatusNotFound, "not_found", "server not found")
+		return
+	}
+	f.writeJSON(w, http.StatusOK, schema.ServerGetResponse{Server: *srv})
+}
+
+func (f *fakeAPI) listVolumes(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	resp := schema.VolumeListResponse{Volumes: []schema.Volume{}}
+	for _, vol := range f.volumes {
+		if name := r.URL.Query().Get("name"); name != "" && vol.Name != name {
+			continue
+		}
+		// only label selectors checking for a key are supported
+		if key := r.URL.Query().Get("label_selector"); key != "" {
+			if _, ok := vol.Labels[key]; !ok {
+				continue
+			}
+		}
+		resp.Volumes = append(resp.Volumes, *vol)
+	}
+	f.writeJSON(w, http.StatusOK, resp)
+}
+
+func (f *fakeAPI) getVolume(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	vol, ok := f.volumes[pathID(r)]
+	if !ok {
+		f.writeError(w, http.StatusNotFound, "not_found", "volume not found")
+		return
+	}
+	f.writeJSON(w, http.StatusOK, schema.VolumeGetResponse{Volume: *vol})
+}
+
+func (f *fakeAPI) createVolume(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.recordMutation(r)
+
+	var req schema.VolumeCreateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		f.writeError(w, http.StatusBadRequest, "json_error", "%v", err)
+		return
+	}
+
+	if req.Size < 10 || req.Size > 10240 {
+		f.writeError(w, http.StatusUnprocessableEntity, "invalid_input", "invalid size %d", req.Size)
+		return
+	}
+	for _, vol := range f.volumes {
+		if vol.Name == req.Name {
+			f.writeError(w, http.StatusConflict, "uniqueness_error", "name %q already used", req.Name)
+			return
+		}
+	}
+
+	var location schema.Location
+	switch {
+	case req.Location != nil:
+		for _, loc := range f.locations {
+			if loc.ID == req.Location.ID || loc.Name == req.Location.Name {
+				location = loc
+			}
+		}
+	case req.Server != nil:
+		if srv, ok := f.servers[*req.Server]; ok {
+			location = srv.Location
+		}
+	}
+	if location.Name == "" {
+		f.writeError(w, http.StatusUnprocessableEntity, "invalid_input", "invalid location")
+		return
+	}
+
+	labels := map[string]string{}
+	if req.Labels != nil {
+		labels = *req.Labels
+	}
+	vol := f.newVolume(req.Name, location.Name, req.Size, labels)
+	vol.Format = req.Format
+	act := f.startAction("create_volume", vol.ID, func() { vol.Status = "available" })
+
+	f.writeJSON(w, http.StatusCreated, schema.VolumeCreateResponse{Volume: *vol, Action: act})
+}
+
+func (f *fakeAPI) updateVolume(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.recordMutation(r)
+
+	vol, ok := f.volumes[pathID(r)]
+	if !ok {
+		f.writeError(w, http.StatusNotFound, "not_found", "volume not found")
+		return
+	}
+
+	var req schema.VolumeUpdateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		f.writeError(w, http.StatusBadRequest, "json_error", "%v", err)
+		return
+	}
+	if req.Name != "" {
+		vol.Name = req.Name
+	}
+	if req.Labels != nil {
+		vol.Labels = *req.Labels
+	}
+
+	f.writeJSON(w, http.StatusOK, schema.VolumeUpdateResponse{Volume: *vol})
+}
+
+func (f *fakeAPI) deleteVolume(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.recordMutation(r)
+
+	vol, ok := f.volumes[pathID(r)]
+	switch {
+	case !ok:
+		f.writeError(w, http.StatusNotFound, "not_found", "volume not found")
+	case f.locks[vol.ID] != 0:
+		f.writeError(w, http.StatusLocked, "locked", "volume is locked by action %d", f.locks[vol.ID])
+	case vol.Protection.Delete:
+		f.writeError(w, http.StatusLocked, "protected", "volume is protected")
+	case vol.Server != nil:
+		f.writeError(w, http.StatusLocked, "locked", "volume is attached")
+	default:
+		delete(f.volumes, vol.ID)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (f *fakeAPI) volumeAction(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.recordMutation(r)
+
+	vol, ok := f.volumes[pathID(r)]
+	if !ok {
+		f.writeError(w, http.StatusNotFound, "not_found", "volume not found")
+		return
+	}
+	if f.locks[vol.ID] != 0 {
+		f.writeError(w, http.StatusLocked, "locked", "volume is locked by action %d", f.locks[vol.ID])
+		return
+	}
+
+	var act *schema.Action
+	switch r.PathValue("action") {
+	case "attach":
+		var req schema.VolumeActionAttachVolumeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			f.writeError(w, http.StatusBadRequest, "json_error", "%v", err)
+			return
+		}
+		srv, ok := f.servers[req.Server]
+		switch {
+		case !ok:
+			f.writeError(w, http.StatusNotFound, "not_found", "server not found")
+			return
+		case vol.Server != nil:
+			f.writeError(w, http.StatusConflict, "volume_already_attached", "volume already attached to %d", *vol.Server)
+			return
+		case srv.Location.Name != vol.Location.Name:
+			f.writeError(w, http.StatusUnprocessableEntity, "invalid_input", "server and volume must be in the same location")
+			return
+		}
+		act = f.startAction("attach_volume", vol.ID, func() { vol.Server = hcloud.Ptr(srv.ID) })
+	case "detach":
+		if vol.Server == nil {
+			f.writeError(w, http.StatusUnprocessableEntity, "invalid_input", "volume not attached")
+			return
+		}
+		act = f.startAction("detach_volume", vol.ID, func() { vol.Server = nil })
+	case "change_protection":
+		var req schema.VolumeActionChangeProtectionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			f.writeError(w, http.StatusBadRequest, "json_error", "%v", err)
+			return
+		}
+		act = f.startAction("change_protection", vol.ID, func() {
+			if req.Delete != nil {
+				vol.Protection.Delete = *req.Delete
+			}
+		})
+	case "resize":
+		var req schema.VolumeActionResizeVolumeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			f.writeError(w, http.StatusBadRequest, "json_error", "%v", err)
+			return
+		}
+		if req.Size <= vol.Size {
+			f.writeError(w, http.StatusUnprocessableEntity, "invalid_input", "volumes can only grow")
+			return
+		}
+		act = f.startAction("resize_volume", vol.ID, func() { vol.Size = req.Size })
+	default:
+		f.writeError(w, http.StatusNotFound, "not_found", "unknown action %q", r.PathValue("action"))
+		return
+	}
+
+	f.writeJSON(w, http.StatusCreated, schema.ActionGetResponse{Action: *act})
+}
+
+func (f *fakeAPI) listActions(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	resp := schema.ActionListResponse{Actions: []schema.Action{}}
+	for _, idStr := range r.URL.Query()["id"] {
+		id, _ := strconv.ParseInt(idStr, 10, 64)
+		if act, ok := f.actions[id]; ok {
+			f.advance(act)
+			resp.Actions = append(resp.Actions, act.action)
+		}
+	}
+	f.writeJSON(w, http.StatusOK, resp)
+}
+
+func (f *fakeAPI) getAction(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	act, ok := f.actions[pathID(r)]
+	if !ok {
+		f.writeError(w, http.StatusNotFound, "not_found", "action not found")
+		return
+	}
+	f.advance(act)
+	f.writeJSON(w, http.StatusOK, schema.ActionGetResponse{Action: act.action})
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"github.com/sirupsen/logrus"
+)
+
+// driver operations recorded in the journal
+const (
+	journalCreate  = "create"
+	journalMount   = "mount"
+	journalUnmount = "unmount"
+)
+
+// journalPath is where the journal is kept. It lives in the propagated mount, so it outlives the plugin's container.
+func journalPath() string {
+	return filepath.Join(propagatedMountPath, ".journal.json")
+}
+
+// journalOp is a driver operation which was started but hasn't finished
+type journalOp struct {
+	ID      int64     `json:"id"`
+	Op      string    `json:"op"`
+	Volume  string    `json:"volume"`
+	Started time.Time `json:"started"`
+}
+
+func (o journalOp) String() string {
+	return fmt.Sprintf("%s of volume %q", o.Op, o.Volume)
+}
+
+// journalAction is a cloud action waited for by a driver operation
+type journalAction struct {
+	ID        int64    `json:"id"`
+	Command   string   `json:"command"`
+	Resources []string `json:"resources,omitempty"`
+}
+
+func (a journalAction) String() string {
+	if len(a.Resources) == 0 {
+		return fmt.Sprintf("%d (%s)", a.ID, a.Command)
+	}
+	return fmt.Sprintf("%d (%s on %s)", a.ID, a.Command, strings.Join(a.Resources, ", "))
+}
+
+type journalState struct {
+	Operations []journalOp     `json:"operations,omitempty"`
+	Actions    []journalAction `json:"actions,omitempty"`
+}
+
+// actionJournal records running driver operations and the cloud actions they wait for, so operations interrupted by a
+// restart can be resumed. It's saved to path on every change; without a path, it's only kept in memory.
+type actionJournal struct {
+	path string
+
+	mu      sync.Mutex
+	lastID  int64
+	ops     map[int64]journalOp
+	actions map[int64]journalAction
+
+	// volumes of the operations being resumed, and closed once they all are
+	held    map[string]bool
+	resumed chan struct{}
+}
+
+// begin records the start of an operation, which must be finished with end
+func (j *actionJournal) begin(op, volume string) int64 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.ops == nil {
+		j.ops = map[int64]journalOp{}
+	}
+	j.lastID++
+	j.ops[j.lastID] = journalOp{ID: j.lastID, Op: op, Volume: volume, Started: time.Now()}
+	j.save()
+	return j.lastID
+}
+
+func (j *actionJournal) end(id int64) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	delete(j.ops, id)
+	j.save()
+}
+
+// hold makes requests for the volumes of the journaled operations wait in waitResumed until release is called, so they
+// don't interfere with resuming those operations
+func (j *actionJournal) hold() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.held = map[string]bool{}
+	for _, op := range j.ops {
+		j.held[op.Volume] = true
+	}
+	j.resumed = make(chan struct{})
+}
+
+func (j *actionJournal) release() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.resumed != nil {
+		close(j.resumed)
+	}
+	j.held, j.resumed = nil, nil
+}
+
+// waitResumed waits until the interrupted operations are resumed, if any of them concern the given volume
+func (j *actionJournal) waitResumed(volume string) {
+	j.mu.Lock()
+	held, resumed := j.held[volume], j.resumed
+	j.mu.Unlock()
+
+	if held {
+		logrus.Infof("waiting for interrupted operations on volume %q to be resumed", volume)
+		<-resumed
+	}
+}
+
+func (j *actionJournal) addAction(act *hcloud.Action) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.actions == nil {
+		j.actions = map[int64]journalAction{}
+	}
+	a := journalAction{ID: act.ID, Command: act.Command}
+	for _, r := range act.Resources {
+		a.Resources = append(a.Resources, fmt.Sprintf("%s %d", r.Type, r.ID))
+	}
+	j.actions[act.ID] = a
+	j.save()
+}
+
+func (j *actionJournal) removeAction(act *hcloud.Action) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	delete(j.actions, act.ID)
+	j.save()
+}
+
+// state returns the journal's contents, ordered by ID
+func (j *actionJournal) state() journalState {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.stateLocked()
+}
+
+func (j *actionJournal) stateLocked() journalState {
+	var st journalState
+	for _, op := range j.ops {
+		st.Operations = append(st.Operations, op)
+	}
+	for _, a := range j.actions {
+		st.Actions = append(st.Actions, a)
+	}
+	sort.Slice(st.Operations, func(i, k int) bool { return st.Operations[i].ID < st.Operations[k].ID })
+	sort.Slice(st.Actions, func(i, k int) bool { return st.Actions[i].ID < st.Actions[k].ID })
+	return st
+}
+
+// save writes the journal to its path, removing it once empty; must be called with j.mu held. Failures are only
+// logged, since they don't affect the operations themselves.
+func (j *actionJournal) save() {
+	if j.path == "" {
+		return
+	}
+
+	st := j.stateLocked()
+	if len(st.Operations) == 0 && len(st.Actions) == 0 {
+		if err := os.Remove(j.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			logrus.Warnf("removing journal: %v", err)
+		}
+		return
+	}
+
+	b, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		logrus.Warnf("encoding journal: %v", err)
+		return
+	}
+	// replace the journal atomically, so a crash never leaves it half written
+	tmp := j.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		logrus.Warnf("writing journal: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, j.path); err != nil {
+		logrus.Warnf("writing journal: %v", err)
+	}
+}
+
+// load adds the contents of the journal saved at its path to the journal
+func (j *actionJournal) load() error {
+	if j.path == "" {
+		return nil
+	}
+
+	b, err := os.ReadFile(j.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading journal: %w", err)
+	}
+
+	var st journalState
+	if err := json.Unmarshal(b, &st); err != nil {
+		return fmt.Errorf("parsing journal %s: %w", j.path, err)
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.ops == nil {
+		j.ops = map[int64]journalOp{}
+	}
+	if j.actions == nil {
+		j.actions = map[int64]journalAction{}
+	}
+	for _, op := range st.Operations {
+		j.ops[op.ID] = op
+		j.lastID = max(j.lastID, op.ID)
+	}
+	for _, a := range st.Actions {
+		j.actions[a.ID] = a
+	}
+	return nil
+}
+
+// resumeJournal finishes the operations interrupted by the plugin's last shutdown. It first waits for the actions they
+// were waiting for, and then completes or rolls back each operation, depending on how far it got. If the actions
+// can't be looked up, the journal is left for the next attempt.
+func (hd *hetznerDriver) resumeJournal() error {
+	st := hd.journal.state()
+
+	for _, a := range st.Actions {
+		act, _, err := hd.client.Action().GetByID(context.Background(), a.ID)
+		if err != nil {
+			return fmt.Errorf("getting action %s: %w", a, err)
+		}
+		if act == nil {
+			logrus.Warnf("action %s no longer exists", a)
+			hd.journal.removeAction(&hcloud.Action{ID: a.ID})
+			continue
+		}
+		logrus.Infof("waiting for action %s started before the last shutdown", a)
+		if err := hd.waitForAction(act); err != nil {
+			logrus.Warnf("action %s failed: %v", a, err)
+		}
+	}
+
+	var errs error
+	for _, op := range st.Operations {
+		logrus.Infof("resuming %s interrupted by the last shutdown", op)
+		if err := hd.resumeOp(op); err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("resuming %s: %w", op, err))
+		}
+		hd.journal.end(op.ID)
+	}
+	return errs
+}
+
+// resumeOp completes or rolls back an interrupted operation after its actions have finished
+func (hd *hetznerDriver) resumeOp(op journalOp) error {
+	switch op.Op {
+	case journalCreate:
+		return hd.resumeCreate(op)
+	case journalMount, journalUnmount:
+		return hd.resumeAttachment(op)
+	}
+	return fmt.Errorf("unknown operation %q", op.Op)
+}
+
+// resumeCreate finishes provisioning a volume left incomplete. Volumes never created are left alone, as are lazily
+// provisioned ones, which are finished on their first mount.
+func (hd *hetznerDriver) resumeCreate(op journalOp) error {
+	vol, _, err := hd.client.Volume().GetByName(context.Background(), prefixName(op.Volume))
+	if err != nil {
+		return fmt.Errorf("getting cloud volume %q: %w", prefixName(op.Volume), err)
+	}
+	switch {
+	case vol == nil:
+		logrus.Infof("volume %q was never created; nothing to resume", op.Volume)
+		return nil
+	case vol.Labels[stateLabel] == statePending:
+		logrus.Infof("volume %q is provisioned on its first mount", op.Volume)
+		return nil
+	case vol.Labels[stateLabel] != stateIncomplete:
+		logrus.Infof("volume %q was already created completely", op.Volume)
+		return nil
+	}
+
+	srv, err := hd.getServerForLocalhost()
+	if err != nil {
+		return err
+	}
+	if err := checkAttachLocation(vol, srv); err != nil {
+		logrus.Infof("%v; provisioning deferred until first mount", err)
+		return nil
+	}
+	return hd.finishCreate(vol, srv)
+}
+
+// resumeAttachment applies the detach policy to a volume whose mount or unmount was interrupted, as the interrupted
+// request would have after failing or unmounting
+func (hd *hetznerDriver) resumeAttachment(op journalOp) error {
+	// resolved like Mount does, so volumes with legacy names are found too
+	vol, err := hd.getVolume(op.Volume)
+	if err != nil {
+		return err
+	}
+
+	vols, err := hd.unusedLocalVolumes()
+	if err != nil {
+		return err
+	}
+
+	for _, unused := range vols {
+		if unused.ID != vol.ID {
+			continue
+		}
+		switch policy := getDetachPolicy(); policy.mode {
+		case detachNever:
+		case detachIdle:
+			hd.markIdle(vol.Name, time.Now())
+		default:
+			logrus.Infof("detaching unused volume %q", vol.Name)
+			return hd.detachVolume(vol)
+		}
+	}
+	return nil
+}
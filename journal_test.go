@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+)
+
+func Test_actionJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.json")
+	j := &actionJournal{path: path}
+
+	create := j.begin(journalCreate, "foo")
+	mount := j.begin(journalMount, "bar")
+	j.addAction(&hcloud.Action{ID: 7, Command: "attach_volume", Resources: []*hcloud.ActionResource{
+		{ID: 3, Type: hcloud.ActionResourceTypeVolume},
+		{ID: 1, Type: hcloud.ActionResourceTypeServer},
+	}})
+	j.addAction(&hcloud.Action{ID: 8, Command: "detach_volume"})
+	j.removeAction(&hcloud.Action{ID: 8})
+	j.end(mount)
+
+	// as after a restart
+	loaded := &actionJournal{path: path}
+	if err := loaded.load(); err != nil {
+		t.Fatalf("actionJournal.load() error = %v", err)
+	}
+	got := loaded.state()
+	for i := range got.Operations {
+		got.Operations[i].Started = got.Operations[i].Started.UTC()
+	}
+	want := journalState{
+		Operations: []journalOp{{ID: create, Op: journalCreate, Volume: "foo", Started: j.ops[create].Started.UTC()}},
+		Actions:    []journalAction{{ID: 7, Command: "attach_volume", Resources: []string{"volume 3", "server 1"}}},
+	}
+	if !reflect.DeepEqual(got.Operations, want.Operations) || !reflect.DeepEqual(got.Actions, want.Actions) {
+		t.Errorf("actionJournal.load() state = %+v, want %+v", got, want)
+	}
+
+	if id := loaded.begin(journalUnmount, "foo"); id <= create {
+		t.Errorf("actionJournal.begin() after load = %d, want ID after %d", id, create)
+	} else {
+		loaded.end(id)
+	}
+
+	loaded.end(create)
+	loaded.removeAction(&hcloud.Action{ID: 7})
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("empty journal not removed: %v", err)
+	}
+}
+
+func Test_actionJournal_hold(t *testing.T) {
+	var j actionJournal
+	j.begin(journalMount, "foo")
+	j.hold()
+
+	// other volumes go ahead
+	j.waitResumed("bar")
+
+	resumed := make(chan struct{})
+	go func() {
+		j.waitResumed("foo")
+		close(resumed)
+	}()
+	select {
+	case <-resumed:
+		t.Fatal("actionJournal.waitResumed() returned before release")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	j.release()
+	select {
+	case <-resumed:
+	case <-time.After(time.Second):
+		t.Fatal("actionJournal.waitResumed() still waiting after release")
+	}
+
+	// and nothing is held anymore
+	j.waitResumed("foo")
+}
+
+func Test_hetznerDriver_Create_journal(t *testing.T) {
+	t.Setenv("use_protection", "false")
+
+	m := newMockClient()
+	hd := &hetznerDriver{client: m, journal: actionJournal{path: filepath.Join(t.TempDir(), "journal.json")}}
+
+	var journaled journalState
+	m.hookCall("Volume.Attach", 1, func(*mockClient) {
+		j := &actionJournal{path: hd.journal.path}
+		if err := j.load(); err != nil {
+			t.Errorf("actionJournal.load() error = %v", err)
+		}
+		journaled = j.state()
+	})
+	m.failCall("Volume.Attach", 1, errors.New("interrupted"))
+
+	if err := hd.Create(&volume.CreateRequest{Name: "foo", Options: map[string]string{"uid": "999"}}); err == nil {
+		t.Fatal("hetznerDriver.Create() succeeded despite failing attach")
+	}
+
+	if len(journaled.Operations) != 1 || journaled.Operations[0].Op != journalCreate || journaled.Operations[0].Volume != "foo" {
+		t.Fatalf("journal during create = %+v, want create of foo", journaled)
+	}
+	if _, err := os.Stat(hd.journal.path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("journal not removed after create: %v", err)
+	}
+}
+
+func Test_hetznerDriver_resumeJournal_attachment(t *testing.T) {
+	legacy := strings.Repeat("a", volumeNameMaxLen)
+
+	tests := []struct {
+		name          string
+		policy        string
+		volume        string
+		wantMutations []string
+	}{
+		{"immediate", "immediate", "foo", []string{"POST /volumes/2/actions/attach", "POST /volumes/2/actions/detach"}},
+		{"never", "never", "foo", []string{"POST /volumes/2/actions/attach"}},
+		{"legacy name", "immediate", legacy, []string{"POST /volumes/2/actions/attach", "POST /volumes/2/actions/detach"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("detach_policy", tt.policy)
+			path := filepath.Join(t.TempDir(), "journal.json")
+
+			f := newFakeAPI(t)
+			if vol := f.addVolume(tt.volume, "fsn1", 10, nil); tt.volume == legacy {
+				vol.Name = legacyPrefixName(tt.volume)
+			}
+
+			// a mount interrupted while attaching
+			hd := f.driver()
+			hd.journal.path = path
+			vol, err := hd.getVolume(tt.volume)
+			if err != nil {
+				t.Fatal(err)
+			}
+			srv, err := hd.getServerForLocalhost()
+			if err != nil {
+				t.Fatal(err)
+			}
+			hd.journal.begin(journalMount, tt.volume)
+			act, _, err := hd.client.Volume().Attach(context.Background(), vol, srv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			hd.journal.addAction(act)
+			hd.journal.addAction(&hcloud.Action{ID: 999, Command: "forgotten"})
+
+			restarted := f.driver()
+			restarted.journal.path = path
+			if err := restarted.journal.load(); err != nil {
+				t.Fatalf("actionJournal.load() error = %v", err)
+			}
+			if err := restarted.resumeJournal(); err != nil {
+				t.Fatalf("hetznerDriver.resumeJournal() error = %v", err)
+			}
+
+			if got := f.mutations(); !reflect.DeepEqual(got, tt.wantMutations) {
+				t.Errorf("API mutations = %v, want %v", got, tt.wantMutations)
+			}
+			if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("journal not removed after resuming: %v", err)
+			}
+		})
+	}
+}
+
+func Test_loopHarness_resumeCreate(t *testing.T) {
+	h := newLoopHarness(t)
+	hd := h.driver()
+
+	// a create interrupted before formatting and attaching the volume
+	vol := h.mock.addVolume("foo", "fsn1", nil)
+	setupFromOptions(map[string]string{"fstype": "ext4", "uid": "999", "gid": "999"}, false).setLabels(vol.Labels)
+	vol.Labels[stateLabel] = stateIncomplete
+	hd.journal.begin(journalCreate, "foo")
+	// and one interrupted before even creating it
+	hd.journal.begin(journalCreate, "bar")
+	// and one interrupted after creating it completely
+	h.mock.addVolume("baz", "fsn1", h.mock.servers[1])
+	hd.journal.begin(journalCreate, "baz")
+
+	if err := hd.resumeJournal(); err != nil {
+		t.Fatalf("hetznerDriver.resumeJournal() error = %v", err)
+	}
+	if st := hd.journal.state(); len(st.Operations) != 0 {
+		t.Errorf("journal after resuming = %+v, want empty", st)
+	}
+
+	vol, err := hd.getVolume("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vol.Labels[stateLabel] != "" || vol.Server == nil {
+		t.Errorf("resumed volume labels %v, server %v; want provisioned and attached", vol.Labels, vol.Server)
+	}
+	if _, err := hd.getVolume("bar"); err == nil {
+		t.Error("volume never created was created on resume")
+	}
+	for _, call := range h.mock.getCalls() {
+		if strings.HasSuffix(call, prefixName("baz")) && !strings.HasPrefix(call, "Volume.Get") {
+			t.Errorf("completely created volume changed on resume: %s", call)
+		}
+	}
+
+	resp, err := hd.Mount(&volume.MountRequest{Name: "foo", ID: "some-id"})
+	if err != nil {
+		t.Fatalf("hetznerDriver.Mount() error = %v", err)
+	}
+	t.Cleanup(func() { _ = hd.Unmount(&volume.UnmountRequest{Name: "foo", ID: "some-id"}) })
+
+	if fstype, err := mountFstype(resp.Mountpoint); err != nil || fstype != "ext4" {
+		t.Errorf("mounted fstype = %q (%v), want ext4", fstype, err)
+	}
+	fi, err := os.Stat(resp.Mountpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := fi.Sys().(*syscall.Stat_t); st.Uid != 999 || st.Gid != 999 {
+		t.Errorf("mountpoint owned by %d:%d, want 999:999", st.Uid, st.Gid)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/base32"
+	"fmt"
+	"strings"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+)
+
+const (
+	// marks volumes as managed by this plugin
+	pluginLabel = "docker-volume-hetzner"
+	// holds the original docker volume name
+	nameLabel = "docker-volume-hetzner.name"
+	// holds the options the volume is mounted with
+	mountOptionsLabel = "docker-volume-hetzner.mount-options"
+	// marks volumes to be mounted read-only
+	readonlyLabel = "docker-volume-hetzner.readonly"
+	// holds the provisioning state of lazily created or incomplete volumes
+	stateLabel = "docker-volume-hetzner.state"
+	// holds the provisioning step an incomplete volume failed at
+	stepLabel = "docker-volume-hetzner.step"
+	// prefixes labels recording how lazily created or incomplete volumes are to be initialized
+	setupLabelPrefix = "docker-volume-hetzner.setup."
+	// marks the cloud volume holding all docker volumes in pool mode
+	poolLabel = "docker-volume-hetzner.pool"
+	// marks volumes whose profile asked for deletion protection, to be unprotected on removal regardless of use_protection
+	protectionLabel = "docker-volume-hetzner.protection"
+	// hold the autogrow settings of volumes growing automatically
+	autogrowThresholdLabel = "docker-volume-hetzner.autogrow-threshold"
+	autogrowStepLabel      = "docker-volume-hetzner.autogrow-step"
+	autogrowMaxLabel       = "docker-volume-hetzner.autogrow-max"
+	// marks volumes opted out of scheduled trimming
+	trimLabel = "docker-volume-hetzner.trim"
+)
+
+const (
+	// volume still waiting for its first mount to be attached and initialized
+	statePending = "pending"
+	// volume whose creation hasn't finished (yet), to be resumed by the next create or mount
+	stateIncomplete = "incomplete"
+)
+
+// label values are limited to 63 chars out of a restricted alphabet, so anything not fitting is stored base32-encoded
+// and split over numbered keys
+const labelValueMaxLen = 63
+
+var labelEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func setLabelString(labels map[string]string, key, value string) {
+	if ok, _ := hcloud.ValidateResourceLabels(map[string]interface{}{key: value}); ok && value != "" {
+		labels[key] = value
+		return
+	}
+
+	enc := labelEncoding.EncodeToString([]byte(value))
+	for i := 0; len(enc) > 0; i++ {
+		n := min(len(enc), labelValueMaxLen)
+		labels[fmt.Sprintf("%s.%d", key, i)] = enc[:n]
+		enc = enc[n:]
+	}
+}
+
+func getLabelString(labels map[string]string, key string) (string, bool) {
+	if v, ok := labels[key]; ok {
+		return v, true
+	}
+
+	var enc strings.Builder
+	for i := 0; ; i++ {
+		chunk, ok := labels[fmt.Sprintf("%s.%d", key, i)]
+		if !ok {
+			break
+		}
+		enc.WriteString(chunk)
+	}
+	if enc.Len() == 0 {
+		return "", false
+	}
+
+	dec, err := labelEncoding.DecodeString(enc.String())
+	if err != nil {
+		return "", false
+	}
+	return string(dec), true
+}
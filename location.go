@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+)
+
+// allowedLocations returns the locations configured for new volumes, or nil if any location is allowed
+func allowedLocations() []string {
+	var locations []string
+	for _, loc := range strings.Split(os.Getenv("locations"), ",") {
+		if loc = strings.TrimSpace(loc); loc != "" {
+			locations = append(locations, loc)
+		}
+	}
+	return locations
+}
+
+func locationAllowed(name string) bool {
+	allowed := allowedLocations()
+	return len(allowed) == 0 || slices.Contains(allowed, name)
+}
+
+// volumeLocation returns the location new volumes should be created in: the one given with the location option, or
+// else the local server's if allowed, or else the first of the configured locations
+func volumeLocation(opts map[string]string, srv *hcloud.Server) (*hcloud.Location, error) {
+	if name := getOption("location", opts); name != "" {
+		if !locationAllowed(name) {
+			return nil, fmt.Errorf("location %q not among the configured locations %v", name, allowedLocations())
+		}
+		return &hcloud.Location{Name: name}, nil
+	}
+
+	local := serverLocation(srv)
+	if local != nil && locationAllowed(local.Name) {
+		return local, nil
+	}
+	if allowed := allowedLocations(); len(allowed) > 0 {
+		return &hcloud.Location{Name: allowed[0]}, nil
+	}
+	return nil, fmt.Errorf("could not determine location of server %q", srv.Name)
+}
+
+// checkAttachLocation returns an error if vol cannot be attached to srv because they are in different locations.
+// Pending volumes are fine, as long as they can be re-created in the server's location.
+func checkAttachLocation(vol *hcloud.Volume, srv *hcloud.Server) error {
+	err := checkSameLocation(vol, srv)
+	if err == nil || !relocatable(vol) {
+		return err
+	}
+	if loc := serverLocation(srv); loc != nil && setupFromLabels(vol.Labels).location == "" && locationAllowed(loc.Name) {
+		return nil
+	}
+	return err
+}
+
+// checkSameLocation returns an error unless vol is in the location of srv
+func checkSameLocation(vol *hcloud.Volume, srv *hcloud.Server) error {
+	loc := serverLocation(srv)
+	if loc == nil {
+		return fmt.Errorf("could not determine location of server %q", srv.Name)
+	}
+	if vol.Location != nil && vol.Location.Name == loc.Name {
+		return nil
+	}
+
+	volLoc := "unknown"
+	if vol.Location != nil {
+		volLoc = vol.Location.Name
+	}
+	return fmt.Errorf("volume %q is in location %q, but server %q is in location %q; volumes can only be attached to servers in the same location",
+		vol.Name, volLoc, srv.Name, loc.Name)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+)
+
+func Test_volumeLocation(t *testing.T) {
+	srv := &hcloud.Server{Name: "local", Location: &hcloud.Location{Name: "fsn1"}}
+
+	tests := []struct {
+		name      string
+		locations string
+		opts      map[string]string
+		want      string
+		wantErr   bool
+	}{
+		{"local by default", "", nil, "fsn1", false},
+		{"explicit", "", map[string]string{"location": "hel1"}, "hel1", false},
+		{"local allowed", "nbg1, fsn1", nil, "fsn1", false},
+		{"first allowed", "nbg1,hel1", nil, "nbg1", false},
+		{"explicit allowed", "nbg1,hel1", map[string]string{"location": "hel1"}, "hel1", false},
+		{"explicit not allowed", "nbg1,hel1", map[string]string{"location": "fsn1"}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("locations", tt.locations)
+
+			got, err := volumeLocation(tt.opts, srv)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("volumeLocation() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && got.Name != tt.want {
+				t.Errorf("volumeLocation() = %q, want %q", got.Name, tt.want)
+			}
+		})
+	}
+}
+
+func Test_checkAttachLocation(t *testing.T) {
+	srv := &hcloud.Server{Name: "local", Location: &hcloud.Location{Name: "fsn1"}}
+
+	pending := func(labels map[string]string) map[string]string {
+		labels[stateLabel] = statePending
+		return labels
+	}
+
+	tests := []struct {
+		name      string
+		locations string
+		location  string
+		labels    map[string]string
+		wantErr   bool
+	}{
+		{"same location", "", "fsn1", nil, false},
+		{"other location", "", "nbg1", nil, true},
+		{"pending in other location", "", "nbg1", pending(map[string]string{}), false},
+		{"pending with explicit location", "", "nbg1", pending(map[string]string{setupLabelPrefix + "location": "nbg1"}), true},
+		{"pending outside allowed locations", "nbg1", "nbg1", pending(map[string]string{}), true},
+		{"incomplete in other location", "", "nbg1", map[string]string{stateLabel: stateIncomplete, stepLabel: stepFinalize}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("locations", tt.locations)
+
+			vol := &hcloud.Volume{Name: "docker-foo", Location: &hcloud.Location{Name: tt.location}, Labels: tt.labels}
+			err := checkAttachLocation(vol, srv)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("checkAttachLocation() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && (!strings.Contains(err.Error(), `"fsn1"`) || !strings.Contains(err.Error(), `"nbg1"`)) {
+				t.Errorf("checkAttachLocation() error = %v, want both locations named", err)
+			}
+		})
+	}
+}
+
+func Test_hetznerDriver_Mount_otherLocation(t *testing.T) {
+	f := newFakeAPI(t)
+	f.addVolume("foo", "nbg1", 10, f.addServer("other", "nbg1"))
+
+	_, err := f.driver().Mount(&volume.MountRequest{Name: "foo", ID: "some-id"})
+	if err == nil || !strings.Contains(err.Error(), `location "nbg1"`) {
+		t.Errorf("hetznerDriver.Mount() error = %v, want location error", err)
+	}
+	if got := f.mutations(); len(got) != 0 {
+		t.Errorf("API mutations = %v, want none", got)
+	}
+}
+
+func Test_hetznerDriver_Create_otherLocation(t *testing.T) {
+	t.Setenv("use_protection", "false")
+
+	f := newFakeAPI(t)
+	hd := f.driver()
+
+	if err := hd.Create(&volume.CreateRequest{Name: "foo", Options: map[string]string{"location": "hel1"}}); err != nil {
+		t.Fatalf("hetznerDriver.Create() error = %v", err)
+	}
+
+	vol := f.volumeByName(prefixName("foo"))
+	if vol.Location.Name != "hel1" || vol.Server != nil {
+		t.Errorf("volume created in %q attached to %v, want unattached in hel1", vol.Location.Name, vol.Server)
+	}
+	if vol.Labels[stateLabel] != statePending {
+		t.Errorf("volume labels = %v, want pending", vol.Labels)
+	}
+
+	// the chosen location sticks, so the volume isn't moved to the mounting server
+	_, err := hd.Mount(&volume.MountRequest{Name: "foo", ID: "some-id"})
+	if err == nil || !strings.Contains(err.Error(), `location "hel1"`) {
+		t.Errorf("hetznerDriver.Mount() error = %v, want location error", err)
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/docker/docker/pkg/mount"
+	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+)
+
+// size of the sparse files backing loop devices; xfs needs at least 300MB
+const loopDeviceSize = 512 << 20
+
+// loopHarness backs the volumes of a mockClient with loop devices, so the driver's mkfs, mount and chown paths run
+// against real kernel filesystems. It needs root and losetup.
+type loopHarness struct {
+	t     *testing.T
+	dir   string
+	sysfs string
+	mock  *mockClient
+}
+
+func newLoopHarness(t *testing.T) *loopHarness {
+	t.Helper()
+
+	if os.Geteuid() != 0 {
+		t.Skip("loop devices require root")
+	}
+	if _, err := exec.LookPath("losetup"); err != nil {
+		t.Skip("losetup not available")
+	}
+
+	h := &loopHarness{t: t, dir: t.TempDir(), mock: newMockClient()}
+	h.mock.device = h.newDevice
+	h.mock.resize = h.resizeDevice
+
+	// fake sysfs holding the serials of the loop devices
+	h.sysfs = filepath.Join(h.dir, "sys")
+	origSysfs, origMountPath := sysfsPath, propagatedMountPath
+	sysfsPath, propagatedMountPath = h.sysfs, filepath.Join(h.dir, "mnt")
+	t.Cleanup(func() { sysfsPath, propagatedMountPath = origSysfs, origMountPath })
+
+	return h
+}
+
+func (h *loopHarness) driver() *hetznerDriver {
+	return &hetznerDriver{client: h.mock}
+}
+
+// newDevice sets up a loop device for the given volume, formatting it like the API would if asked to
+func (h *loopHarness) newDevice(vol *hcloud.Volume) string {
+	img := filepath.Join(h.dir, fmt.Sprintf("volume-%d.img", vol.ID))
+	f, err := os.Create(img)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	if err := f.Truncate(loopDeviceSize); err != nil {
+		h.t.Fatal(err)
+	}
+	f.Close()
+
+	out, err := exec.Command("losetup", "--find", "--show", img).Output()
+	if err != nil {
+		h.t.Skipf("setting up loop device: %v", err)
+	}
+	dev := strings.TrimSpace(string(out))
+	h.t.Cleanup(func() {
+		if out, err := exec.Command("losetup", "--detach", dev).CombinedOutput(); err != nil {
+			h.t.Errorf("detaching loop device %s: %v: %s", dev, err, out)
+		}
+	})
+
+	// report the volume ID as serial, like real volumes do
+	vpdDir := filepath.Join(h.sysfs, "class/block", filepath.Base(dev), "device")
+	if err := os.MkdirAll(vpdDir, 0o755); err != nil {
+		h.t.Fatal(err)
+	}
+	serial := fmt.Sprint(vol.ID)
+	if err := os.WriteFile(filepath.Join(vpdDir, "vpd_pg80"), append([]byte{0, 0x80, 0, byte(len(serial))}, serial...), 0o644); err != nil {
+		h.t.Fatal(err)
+	}
+
+	if vol.Format != nil {
+		if err := mkfs(dev, *vol.Format); err != nil {
+			h.t.Fatalf("formatting %s as %s: %v", dev, *vol.Format, err)
+		}
+	}
+
+	return dev
+}
+
+// resizeDevice grows the loop device of the given volume in proportion to its new size. It's called while watching
+// the resize action, so failures don't stop the test right away.
+func (h *loopHarness) resizeDevice(vol *hcloud.Volume, size int) {
+	img := filepath.Join(h.dir, fmt.Sprintf("volume-%d.img", vol.ID))
+	fi, err := os.Stat(img)
+	if err != nil {
+		h.t.Error(err)
+		return
+	}
+	if err := os.Truncate(img, fi.Size()*int64(size)/int64(vol.Size)); err != nil {
+		h.t.Error(err)
+		return
+	}
+	if out, err := exec.Command("losetup", "--set-capacity", vol.LinuxDevice).CombinedOutput(); err != nil {
+		h.t.Errorf("resizing loop device %s: %v: %s", vol.LinuxDevice, err, out)
+	}
+}
+
+func mountFstype(mountpoint string) (string, error) {
+	mounts, err := mount.GetMounts()
+	if err != nil {
+		return "", err
+	}
+	for _, m := range mounts {
+		if m.Mountpoint == mountpoint {
+			return m.Fstype, nil
+		}
+	}
+	return "", fmt.Errorf("%s not mounted", mountpoint)
+}
+
+func Test_loopHarness_lifecycle(t *testing.T) {
+	t.Setenv("use_protection", "true")
+
+	// ext4 is tried first when mounting, and its driver also handles ext2/3
+	tests := []struct {
+		fstype        string
+		uid           int
+		gid           int
+		lazy          bool
+		mountedFstype string
+	}{
+		{"ext4", 0, 0, false, "ext4"}, // formatted by the API
+		{"ext4", 999, 999, false, "ext4"},
+		{"ext3", 33, 0, false, "ext4"},
+		{"ext2", 0, 0, false, "ext4"},
+		{"xfs", 1000, 1000, false, "xfs"},
+		{"ext4", 999, 999, true, "ext4"},
+		{"ext3", 33, 0, true, "ext4"},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s %d:%d lazy=%t", tt.fstype, tt.uid, tt.gid, tt.lazy), func(t *testing.T) {
+			if _, err := os.Stat("/sbin/mkfs." + tt.fstype); err != nil {
+				t.Skipf("mkfs.%s not available", tt.fstype)
+			}
+
+			h := newLoopHarness(t)
+			hd := h.driver()
+
+			err := hd.Create(&volume.CreateRequest{Name: "foo", Options: map[string]string{
+				"fstype": tt.fstype,
+				"uid":    fmt.Sprint(tt.uid),
+				"gid":    fmt.Sprint(tt.gid),
+				"lazy":   fmt.Sprint(tt.lazy),
+			}})
+			if err != nil {
+				t.Fatalf("hetznerDriver.Create() error = %v", err)
+			}
+
+			resp, err := hd.Mount(&volume.MountRequest{Name: "foo", ID: "some-id"})
+			if err != nil {
+				t.Fatalf("hetznerDriver.Mount() error = %v", err)
+			}
+
+			if fstype, err := mountFstype(resp.Mountpoint); err != nil || fstype != tt.mountedFstype {
+				t.Errorf("mounted fstype = %q (%v), want %q", fstype, err, tt.mountedFstype)
+			}
+			fi, err := os.Stat(resp.Mountpoint)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if st := fi.Sys().(*syscall.Stat_t); int(st.Uid) != tt.uid || int(st.Gid) != tt.gid {
+				t.Errorf("mountpoint owned by %d:%d, want %d:%d", st.Uid, st.Gid, tt.uid, tt.gid)
+			}
+			if err := os.WriteFile(filepath.Join(resp.Mountpoint, "data"), []byte("data"), 0o644); err != nil {
+				t.Errorf("writing to volume: %v", err)
+			}
+
+			got, err := hd.Get(&volume.GetRequest{Name: "foo"})
+			if err != nil {
+				t.Fatalf("hetznerDriver.Get() error = %v", err)
+			}
+			if got.Volume.Mountpoint != resp.Mountpoint {
+				t.Errorf("hetznerDriver.Get() mountpoint = %q, want %q", got.Volume.Mountpoint, resp.Mountpoint)
+			}
+
+			if err := hd.Unmount(&volume.UnmountRequest{Name: "foo", ID: "some-id"}); err != nil {
+				t.Fatalf("hetznerDriver.Unmount() error = %v", err)
+			}
+			if _, err := mountFstype(resp.Mountpoint); err == nil {
+				t.Errorf("%s still mounted after unmount", resp.Mountpoint)
+			}
+
+			if err := hd.Remove(&volume.RemoveRequest{Name: "foo"}); err != nil {
+				t.Fatalf("hetznerDriver.Remove() error = %v", err)
+			}
+		})
+	}
+}
+
+func Test_loopHarness_readonly(t *testing.T) {
+	t.Setenv("use_protection", "false")
+
+	h := newLoopHarness(t)
+	hd := h.driver()
+
+	if err := hd.Create(&volume.CreateRequest{Name: "foo", Options: map[string]string{"readonly": "true"}}); err != nil {
+		t.Fatalf("hetznerDriver.Create() error = %v", err)
+	}
+
+	resp, err := hd.Mount(&volume.MountRequest{Name: "foo", ID: "some-id"})
+	if err != nil {
+		t.Fatalf("hetznerDriver.Mount() error = %v", err)
+	}
+	t.Cleanup(func() { _ = hd.Unmount(&volume.UnmountRequest{Name: "foo", ID: "some-id"}) })
+
+	if err := os.WriteFile(filepath.Join(resp.Mountpoint, "data"), []byte("data"), 0o644); !errors.Is(err, syscall.EROFS) {
+		t.Errorf("writing to read-only volume: error = %v, want %v", err, syscall.EROFS)
+	}
+
+	got, err := hd.Get(&volume.GetRequest{Name: "foo"})
+	if err != nil {
+		t.Fatalf("hetznerDriver.Get() error = %v", err)
+	}
+	if got.Volume.Status["mode"] != "ro" {
+		t.Errorf("hetznerDriver.Get() status = %v, want mode ro", got.Volume.Status)
+	}
+}
@@ -2,14 +2,21 @@ package main // import "github.com/costela/docker-volume-hetzner"
 
 import (
 	"fmt"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 
+	"github.com/docker/go-connections/sockets"
 	"github.com/docker/go-plugins-helpers/volume"
 	"github.com/sirupsen/logrus"
 )
 
 const socketAddress = "/run/docker/plugins/hetzner.sock"
-const propagatedMountPath = "/mnt"
+const healthPath = "/health"
+
+// overridden in tests
+var propagatedMountPath = "/mnt"
 
 func main() {
 	logrus.SetFormatter(&bareFormatter{})
@@ -22,11 +29,83 @@ func main() {
 	logrus.SetLevel(logLevel)
 
 	hd := newHetznerDriver()
-	h := volume.NewHandler(hd)
+
+	if len(os.Args) > 1 {
+		os.Exit(runCLI(hd, os.Args[1:]))
+	}
+
+	hd.journal.path = journalPath()
+	if err := hd.journal.load(); err != nil {
+		logrus.Errorf("%v", err)
+	}
+
+	preflightErr := hd.runPreflight().err()
+	if preflightErr != nil {
+		logrus.Errorf("preflight failed; all requests will be rejected until fixed: %v", preflightErr)
+	}
+	hd.journal.hold()
+
+	stop := make(chan struct{})
+	if policy := getDetachPolicy(); policy.mode == detachIdle {
+		go hd.runIdleDetacher(policy, stop)
+	}
+	go hd.runUsageMonitor(stop)
+	if interval := trimInterval(); interval > 0 {
+		go hd.runTrimScheduler(interval, stop)
+	}
+
+	h := volume.NewHandler(trackedDriver{hd})
+	h.HandleFunc(healthPath, hd.serveHealth)
+	h.HandleFunc(metricsPath, hd.serveMetrics)
+
+	if addr := metricsAddress(); addr != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc(healthPath, hd.serveHealth)
+		mux.HandleFunc(metricsPath, hd.serveMetrics)
+		logrus.Infof("serving metrics on %s", addr)
+		go func() {
+			if err := http.ListenAndServe(addr, mux); err != nil {
+				logrus.Errorf("error serving metrics: %v", err)
+			}
+		}()
+	}
+
+	l, err := sockets.NewUnixSocket(socketAddress, 0)
+	if err != nil {
+		logrus.Fatalf("error listening on docker socket: %v", err)
+	}
 	logrus.Infof("listening on %s", socketAddress)
-	if err := h.ServeUnix(socketAddress, 0); err != nil {
+
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- h.Serve(l) }()
+
+	// resumed while serving, so docker isn't kept waiting for the socket
+	go func() {
+		defer hd.journal.release()
+		if preflightErr != nil || hd.ops.begin() != nil {
+			return
+		}
+		defer hd.ops.end()
+		if err := hd.resumeJournal(); err != nil {
+			logrus.Errorf("resuming interrupted operations: %v", err)
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	select {
+	case err := <-serveErr:
 		logrus.Fatalf("error serving docker socket: %v", err)
+	case sig := <-signals:
+		logrus.Infof("received %s; shutting down", sig)
 	}
+
+	// requests on connections still open are refused by trackedDriver
+	l.Close()
+	close(stop)
+	hd.shutdown(shutdownTimeout())
+	logrus.Infof("shut down")
 }
 
 type bareFormatter struct{}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+const metricsPath = "/metrics"
+
+const metricsNamespace = "docker_volume_hetzner"
+
+// metricsAddress is an additional TCP address to serve metrics and health on, since scrapers can't reach the plugin
+// socket; empty to only serve them on the socket
+func metricsAddress() string {
+	return os.Getenv("metrics_address")
+}
+
+// metricFamily is a metric in the Prometheus text format, with one sample per docker volume
+type metricFamily struct {
+	name    string
+	help    string
+	typ     string
+	samples map[string]float64
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func writeMetrics(w io.Writer, families []metricFamily) error {
+	for _, f := range families {
+		if _, err := fmt.Fprintf(w, "# HELP %s_%s %s\n# TYPE %s_%s %s\n", metricsNamespace, f.name, f.help, metricsNamespace, f.name, f.typ); err != nil {
+			return err
+		}
+		volumes := make([]string, 0, len(f.samples))
+		for name := range f.samples {
+			volumes = append(volumes, name)
+		}
+		sort.Strings(volumes)
+		for _, name := range volumes {
+			if _, err := fmt.Fprintf(w, "%s_%s{volume=\"%s\"} %g\n", metricsNamespace, f.name, labelValueEscaper.Replace(name), f.samples[name]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// metrics returns the driver's metrics, as last collected by the monitors
+func (hd *hetznerDriver) metrics() []metricFamily {
+	usage := hd.usage.snapshot()
+
+	gauge := func(name, help string, value func(volumeUsage) uint64) metricFamily {
+		f := metricFamily{name: name, help: help, typ: "gauge", samples: make(map[string]float64, len(usage))}
+		for volume, u := range usage {
+			f.samples[volume] = float64(value(u))
+		}
+		return f
+	}
+	trimmed, lastTrim := hd.trim.snapshot()
+	trimmedBytes := metricFamily{name: "volume_trimmed_bytes_total", help: "Bytes discarded by scheduled trims of mounted volumes.", typ: "counter", samples: make(map[string]float64, len(trimmed))}
+	for volume, n := range trimmed {
+		trimmedBytes.samples[volume] = float64(n)
+	}
+	lastTrimTime := metricFamily{name: "volume_last_trim_timestamp_seconds", help: "Time of the last scheduled trim of mounted volumes.", typ: "gauge", samples: make(map[string]float64, len(lastTrim))}
+	for volume, t := range lastTrim {
+		lastTrimTime.samples[volume] = float64(t.Unix())
+	}
+
+	return []metricFamily{
+		gauge("volume_size_bytes", "Size of the filesystem of mounted volumes.", func(u volumeUsage) uint64 { return u.SizeBytes }),
+		gauge("volume_used_bytes", "Space used on mounted volumes.", func(u volumeUsage) uint64 { return u.UsedBytes }),
+		gauge("volume_available_bytes", "Space available to containers on mounted volumes.", func(u volumeUsage) uint64 { return u.AvailableBytes }),
+		gauge("volume_inodes", "Number of inodes of mounted volumes.", func(u volumeUsage) uint64 { return u.Inodes }),
+		gauge("volume_inodes_used", "Number of inodes used on mounted volumes.", func(u volumeUsage) uint64 { return u.InodesUsed }),
+		gauge("volume_inodes_free", "Number of inodes free on mounted volumes.", func(u volumeUsage) uint64 { return u.InodesFree }),
+		trimmedBytes,
+		lastTrimTime,
+	}
+}
+
+// serveMetrics reports the driver's metrics in the Prometheus text format
+func (hd *hetznerDriver) serveMetrics(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_ = writeMetrics(w, hd.metrics())
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+)
+
+// mockClient is a programmable in-process implementation of hetznerClienter. It records every call, can inject errors
+// into specific calls, delay or fail actions and run hooks before calls, e.g. to simulate other servers racing for a
+// volume. Actions take effect as soon as they are watched.
+type mockClient struct {
+	mu sync.Mutex
+
+	volumes map[int64]*hcloud.Volume
+	servers map[int64]*hcloud.Server
+	lastID  int64
+
+	// sequence of calls, e.g. "Volume.Attach docker-foo srv"
+	calls []string
+	// number of calls per method, used to target injections
+	counts map[string]int
+	// errors to return from the nth call of a method
+	errs map[mockCall]error
+	// hooks to run before the nth call of a method
+	hooks map[mockCall]func(m *mockClient)
+
+	// pending effects of started actions
+	actions map[int64]func()
+	// all started actions
+	started map[int64]*hcloud.Action
+	// per-command error returned when watching an action, and a delay before any watch completes
+	actionErrs  map[string]error
+	actionDelay time.Duration
+
+	// provides the device of new volumes, if set; see loopHarness
+	device func(vol *hcloud.Volume) string
+	// grows the device of resized volumes, if set
+	resize func(vol *hcloud.Volume, size int)
+}
+
+type mockCall struct {
+	method string
+	n      int
+}
+
+// newMockClient returns a mock containing a server named after the local hostname in location fsn1
+func newMockClient() *mockClient {
+	m := &mockClient{
+		volumes:    map[int64]*hcloud.Volume{},
+		servers:    map[int64]*hcloud.Server{},
+		counts:     map[string]int{},
+		errs:       map[mockCall]error{},
+		hooks:      map[mockCall]func(m *mockClient){},
+		actions:    map[int64]func(){},
+		started:    map[int64]*hcloud.Action{},
+		actionErrs: map[string]error{},
+	}
+	hostname, _ := os.Hostname()
+	m.addServer(hostname, "fsn1")
+	return m
+}
+
+func (m *mockClient) nextID() int64 {
+	m.lastID++
+	return m.lastID
+}
+
+func (m *mockClient) addServer(name, location string) *hcloud.Server {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	srv := &hcloud.Server{ID: m.nextID(), Name: name, Location: &hcloud.Location{Name: location}}
+	m.servers[srv.ID] = srv
+	return srv
+}
+
+func (m *mockClient) addVolume(name, location string, server *hcloud.Server) *hcloud.Volume {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	labels := map[string]string{pluginLabel: ""}
+	setLabelString(labels, nameLabel, name)
+	vol := &hcloud.Volume{
+		ID:       m.nextID(),
+		Name:     prefixName(name),
+		Size:     10,
+		Location: &hcloud.Location{Name: location},
+		Labels:   labels,
+		Status:   hcloud.VolumeStatusAvailable,
+	}
+	vol.LinuxDevice = fmt.Sprintf("/dev/disk/by-id/scsi-0HC_Volume_%d", vol.ID)
+	if m.device != nil {
+		vol.LinuxDevice = m.device(vol)
+	}
+	if server != nil {
+		vol.Server = &hcloud.Server{ID: server.ID}
+	}
+	m.volumes[vol.ID] = vol
+	return vol
+}
+
+// failCall makes the nth (1-based) call of method return err
+func (m *mockClient) failCall(method string, n int, err error) {
+	m.errs[mockCall{method, n}] = err
+}
+
+// hookCall runs fn before the nth (1-based) call of method is handled
+func (m *mockClient) hookCall(method string, n int, fn func(m *mockClient)) {
+	m.hooks[mockCall{method, n}] = fn
+}
+
+// failAction makes watching the next actions with the given command fail with err
+func (m *mockClient) failAction(command string, err error) {
+	m.actionErrs[command] = err
+}
+
+// attachElsewhere attaches the volume with the given docker name to another server, as if done concurrently by
+// another node
+func (m *mockClient) attachElsewhere(name string, srv *hcloud.Server) {
+	for _, vol := range m.volumes {
+		if vol.Name == prefixName(name) {
+			vol.Server = &hcloud.Server{ID: srv.ID}
+		}
+	}
+}
+
+func (m *mockClient) getCalls() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]string(nil), m.calls...)
+}
+
+// call records a call and returns any injected error for it; must be called with m.mu held
+func (m *mockClient) call(method string, args ...interface{}) error {
+	m.counts[method]++
+	c := mockCall{method, m.counts[method]}
+
+	entry := method
+	for _, arg := range args {
+		entry += fmt.Sprintf(" %v", arg)
+	}
+	m.calls = append(m.calls, entry)
+
+	if hook, ok := m.hooks[c]; ok {
+		hook(m)
+	}
+	return m.errs[c]
+}
+
+func (m *mockClient) startAction(command string, effect func()) *hcloud.Action {
+	act := &hcloud.Action{ID: m.nextID(), Command: command, Status: hcloud.ActionStatusRunning}
+	m.actions[act.ID] = effect
+	m.started[act.ID] = act
+	return act
+}
+
+func (m *mockClient) copyVolume(vol *hcloud.Volume) *hcloud.Volume {
+	c := *vol
+	if vol.Server != nil {
+		c.Server = &hcloud.Server{ID: vol.Server.ID}
+	}
+	c.Labels = make(map[string]string, len(vol.Labels))
+	for k, v := range vol.Labels {
+		c.Labels[k] = v
+	}
+	return &c
+}
+
+func (m *mockClient) Volume() hetznerVolumeClienter { return (*mockVolumeClient)(m) }
+func (m *mockClient) Server() hetznerServerClienter { return (*mockServerClient)(m) }
+func (m *mockClient) Action() hetznerActionClienter { return (*mockActionClient)(m) }
+
+type mockVolumeClient mockClient
+
+func (v *mockVolumeClient) All(context.Context) ([]*hcloud.Volume, error) {
+	m := (*mockClient)(v)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.call("Volume.All"); err != nil {
+		return nil, err
+	}
+	vols := make([]*hcloud.Volume, 0, len(m.volumes))
+	for _, vol := range m.volumes {
+		vols = append(vols, m.copyVolume(vol))
+	}
+	return vols, nil
+}
+
+// AllWithOpts supports label selectors consisting of a single key, or key=value
+func (v *mockVolumeClient) AllWithOpts(_ context.Context, opts hcloud.VolumeListOpts) ([]*hcloud.Volume, error) {
+	m := (*mockClient)(v)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.call("Volume.All", opts.LabelSelector); err != nil {
+		return nil, err
+	}
+	key, value, hasValue := strings.Cut(opts.LabelSelector, "=")
+	vols := make([]*hcloud.Volume, 0, len(m.volumes))
+	for _, vol := range m.volumes {
+		if v, ok := vol.Labels[key]; key != "" && (!ok || hasValue && v != value) {
+			continue
+		}
+		vols = append(vols, m.copyVolume(vol))
+	}
+	return vols, nil
+}
+
+func (v *mockVolumeClient) GetByName(_ context.Context, name string) (*hcloud.Volume, *hcloud.Response, error) {
+	m := (*mockClient)(v)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.call("Volume.GetByName", name); err != nil {
+		return nil, nil, err
+	}
+	for _, vol := range m.volumes {
+		if vol.Name == name {
+			return m.copyVolume(vol), nil, nil
+		}
+	}
+	return nil, nil, nil
+}
+
+func (v *mockVolumeClient) Create(_ context.Context, opts hcloud.VolumeCreateOpts) (hcloud.VolumeCreateResult, *hcloud.Response, error) {
+	m := (*mockClient)(v)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.call("Volume.Create", opts.Name); err != nil {
+		return hcloud.VolumeCreateResult{}, nil, err
+	}
+	for _, vol := range m.volumes {
+		if vol.Name == opts.Name {
+			return hcloud.VolumeCreateResult{}, nil, hcloud.Error{Code: hcloud.ErrorCodeUniquenessError, Message: "name already used"}
+		}
+	}
+
+	vol := &hcloud.Volume{
+		ID:       m.nextID(),
+		Name:     opts.Name,
+		Size:     opts.Size,
+		Location: opts.Location,
+		Labels:   opts.Labels,
+		Format:   opts.Format,
+		Status:   hcloud.VolumeStatusCreating,
+	}
+	vol.LinuxDevice = fmt.Sprintf("/dev/disk/by-id/scsi-0HC_Volume_%d", vol.ID)
+	if m.device != nil {
+		vol.LinuxDevice = m.device(vol)
+	}
+	m.volumes[vol.ID] = vol
+	act := m.startAction("create_volume", func() { vol.Status = hcloud.VolumeStatusAvailable })
+
+	return hcloud.VolumeCreateResult{Volume: m.copyVolume(vol), Action: act}, nil, nil
+}
+
+func (v *mockVolumeClient) Update(_ context.Context, vol *hcloud.Volume, opts hcloud.VolumeUpdateOpts) (*hcloud.Volume, *hcloud.Response, error) {
+	m := (*mockClient)(v)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.call("Volume.Update", vol.Name); err != nil {
+		return nil, nil, err
+	}
+	stored, ok := m.volumes[vol.ID]
+	if !ok {
+		return nil, nil, hcloud.Error{Code: hcloud.ErrorCodeNotFound, Message: "volume not found"}
+	}
+	if opts.Name != "" {
+		stored.Name = opts.Name
+	}
+	if opts.Labels != nil {
+		stored.Labels = opts.Labels
+	}
+	return m.copyVolume(stored), nil, nil
+}
+
+func (v *mockVolumeClient) Resize(_ context.Context, vol *hcloud.Volume, size int) (*hcloud.Action, *hcloud.Response, error) {
+	m := (*mockClient)(v)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.call("Volume.Resize", vol.Name, size); err != nil {
+		return nil, nil, err
+	}
+	stored, ok := m.volumes[vol.ID]
+	switch {
+	case !ok:
+		return nil, nil, hcloud.Error{Code: hcloud.ErrorCodeNotFound, Message: "volume not found"}
+	case size <= stored.Size:
+		return nil, nil, hcloud.Error{Code: hcloud.ErrorCodeInvalidInput, Message: "volumes can only grow"}
+	}
+	return m.startAction("resize_volume", func() {
+		if m.resize != nil {
+			m.resize(stored, size)
+		}
+		stored.Size = size
+	}), nil, nil
+}
+
+func (v *mockVolumeClient) Delete(_ context.Context, vol *hcloud.Volume) (*hcloud.Response, error) {
+	m := (*mockClient)(v)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.call("Volume.Delete", vol.Name); err != nil {
+		return nil, err
+	}
+	stored, ok := m.volumes[vol.ID]
+	switch {
+	case !ok:
+		return nil, hcloud.Error{Code: hcloud.ErrorCodeNotFound, Message: "volume not found"}
+	case stored.Protection.Delete:
+		return nil, hcloud.Error{Code: hcloud.ErrorCodeProtected, Message: "volume is protected"}
+	case stored.Server != nil:
+		return nil, hcloud.Error{Code: hcloud.ErrorCodeLocked, Message: "volume is attached"}
+	}
+	delete(m.volumes, vol.ID)
+	return nil, nil
+}
+
+func (v *mockVolumeClient) Attach(_ context.Context, vol *hcloud.Volume, srv *hcloud.Server) (*hcloud.Action, *hcloud.Response, error) {
+	m := (*mockClient)(v)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.call("Volume.Attach", vol.Name, srv.Name); err != nil {
+		return nil, nil, err
+	}
+	stored, ok := m.volumes[vol.ID]
+	switch {
+	case !ok:
+		return nil, nil, hcloud.Error{Code: hcloud.ErrorCodeNotFound, Message: "volume not found"}
+	case stored.Server != nil:
+		return nil, nil, hcloud.Error{Code: hcloud.ErrorCodeVolumeAlreadyAttached, Message: "volume already attached"}
+	}
+	return m.startAction("attach_volume", func() { stored.Server = &hcloud.Server{ID: srv.ID} }), nil, nil
+}
+
+func (v *mockVolumeClient) Detach(_ context.Context, vol *hcloud.Volume) (*hcloud.Action, *hcloud.Response, error) {
+	m := (*mockClient)(v)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.call("Volume.Detach", vol.Name); err != nil {
+		return nil, nil, err
+	}
+	stored, ok := m.volumes[vol.ID]
+	if !ok {
+		return nil, nil, hcloud.Error{Code: hcloud.ErrorCodeNotFound, Message: "volume not found"}
+	}
+	return m.startAction("detach_volume", func() { stored.Server = nil }), nil, nil
+}
+
+func (v *mockVolumeClient) ChangeProtection(_ context.Context, vol *hcloud.Volume, opts hcloud.VolumeChangeProtectionOpts) (*hcloud.Action, *hcloud.Response, error) {
+	m := (*mockClient)(v)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.call("Volume.ChangeProtection", vol.Name, *opts.Delete); err != nil {
+		return nil, nil, err
+	}
+	stored, ok := m.volumes[vol.ID]
+	if !ok {
+		return nil, nil, hcloud.Error{Code: hcloud.ErrorCodeNotFound, Message: "volume not found"}
+	}
+	return m.startAction("change_protection", func() { stored.Protection.Delete = *opts.Delete }), nil, nil
+}
+
+type mockServerClient mockClient
+
+func (s *mockServerClient) GetByID(_ context.Context, id int64) (*hcloud.Server, *hcloud.Response, error) {
+	m := (*mockClient)(s)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.call("Server.GetByID", id); err != nil {
+		return nil, nil, err
+	}
+	if srv, ok := m.servers[id]; ok {
+		c := *srv
+		return &c, nil, nil
+	}
+	return nil, nil, nil
+}
+
+func (s *mockServerClient) GetByName(_ context.Context, name string) (*hcloud.Server, *hcloud.Response, error) {
+	m := (*mockClient)(s)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.call("Server.GetByName", name); err != nil {
+		return nil, nil, err
+	}
+	for _, srv := range m.servers {
+		if srv.Name == name {
+			c := *srv
+			return &c, nil, nil
+		}
+	}
+	return nil, nil, nil
+}
+
+type mockActionClient mockClient
+
+func (a *mockActionClient) GetByID(_ context.Context, id int64) (*hcloud.Action, *hcloud.Response, error) {
+	m := (*mockClient)(a)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.call("Action.GetByID", id); err != nil {
+		return nil, nil, err
+	}
+	act, ok := m.started[id]
+	if !ok {
+		return nil, nil, nil
+	}
+	c := *act
+	if _, running := m.actions[id]; !running {
+		c.Status = hcloud.ActionStatusSuccess
+	}
+	return &c, nil, nil
+}
+
+func (a *mockActionClient) WatchProgress(_ context.Context, act *hcloud.Action) (<-chan int, <-chan error) {
+	m := (*mockClient)(a)
+	progress := make(chan int)
+	errs := make(chan error, 1)
+
+	if act == nil {
+		close(progress)
+		close(errs)
+		return progress, errs
+	}
+
+	m.mu.Lock()
+	err := m.call("Action.WatchProgress", act.Command)
+	if err == nil {
+		err = m.actionErrs[act.Command]
+	}
+	effect := m.actions[act.ID]
+	delete(m.actions, act.ID)
+	delay := m.actionDelay
+	m.mu.Unlock()
+
+	go func() {
+		defer close(progress)
+		defer close(errs)
+
+		time.Sleep(delay)
+		if err != nil {
+			errs <- err
+			return
+		}
+		if effect != nil {
+			m.mu.Lock()
+			effect()
+			m.mu.Unlock()
+		}
+	}()
+
+	return progress, errs
+}
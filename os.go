@@ -2,16 +2,119 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/docker/docker/pkg/mount"
+	"github.com/hashicorp/go-multierror"
 	"github.com/sirupsen/logrus"
 )
 
 var supportedFileystemTypes = [...]string{"ext4", "xfs", "ext3", "ext2"}
 
+func isSupportedFilesystemType(fstype string) bool {
+	for _, t := range supportedFileystemTypes {
+		if t == fstype {
+			return true
+		}
+	}
+	return false
+}
+
+// root of the sysfs tree, bind-mounted read-write from the host by config.json; overridden in tests
+var sysfsPath = "/sys"
+
+// how often to check for a device node while waiting for it
+const devicePollInterval = 250 * time.Millisecond
+
+// waitForDevice waits for the device node of the given volume to show up, rescanning the SCSI hosts if it takes too
+// long, and then makes sure the device really belongs to the volume before anyone touches it.
+func waitForDevice(dev string, volumeID int64, timeout time.Duration) error {
+	start := time.Now()
+	rescanned := false
+	for {
+		_, err := os.Stat(dev)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("checking device %q: %w", dev, err)
+		}
+		if time.Since(start) > timeout {
+			return fmt.Errorf("device %q did not show up after %s", dev, timeout)
+		}
+		if !rescanned && time.Since(start) > timeout/2 {
+			logrus.Warnf("device %q not found after %s; rescanning SCSI hosts", dev, time.Since(start).Round(time.Second))
+			if err := rescanSCSIHosts(); err != nil {
+				logrus.Errorf("rescanning SCSI hosts: %v", err)
+			}
+			rescanned = true
+		}
+		time.Sleep(devicePollInterval)
+	}
+
+	want := strconv.FormatInt(volumeID, 10)
+	serial, err := deviceSerial(dev)
+	if err != nil {
+		// not all kernels and controllers expose the VPD page, but udev names the by-id link after the serial as well
+		logrus.Warnf("reading serial of %q: %v; checking its device link instead", dev, err)
+		if link := filepath.Base(dev); link != volumeDeviceLinkPrefix+want {
+			return fmt.Errorf("can't verify device %q: serial unreadable and %q isn't the link of volume ID %s", dev, link, want)
+		}
+		return nil
+	}
+	if serial != want {
+		return fmt.Errorf("device %q has serial %q, expected volume ID %s", dev, serial, want)
+	}
+
+	return nil
+}
+
+// udev links the disks of Hetzner volumes by their ID, which is also their serial
+const volumeDeviceLinkPrefix = "scsi-0HC_Volume_"
+
+// rescanSCSIHosts asks all SCSI hosts to look for new disks
+func rescanSCSIHosts() error {
+	hosts, err := filepath.Glob(filepath.Join(sysfsPath, "class/scsi_host/*/scan"))
+	if err != nil {
+		return err
+	}
+	var merr error
+	for _, scan := range hosts {
+		if err := os.WriteFile(scan, []byte("- - -"), 0o200); err != nil {
+			merr = multierror.Append(merr, err)
+		}
+	}
+	return merr
+}
+
+// deviceSerial returns the serial number reported by the disk behind dev, as found in its unit serial number VPD page.
+// Hetzner volumes report their ID as serial.
+func deviceSerial(dev string) (string, error) {
+	realDev, err := filepath.EvalSymlinks(dev)
+	if err != nil {
+		return "", err
+	}
+
+	vpd, err := os.ReadFile(filepath.Join(sysfsPath, "class/block", filepath.Base(realDev), "device/vpd_pg80"))
+	if err != nil {
+		return "", err
+	}
+	// 4 bytes header, the last of which holds the length of the serial
+	if len(vpd) < 4 || len(vpd) < 4+int(vpd[3]) {
+		return "", fmt.Errorf("malformed VPD page of length %d", len(vpd))
+	}
+
+	return strings.TrimSpace(string(vpd[4 : 4+int(vpd[3])])), nil
+}
+
 func getMounts() (map[string]string, error) {
 	mounts, err := mount.GetMounts()
 	if err != nil {
@@ -24,6 +127,20 @@ func getMounts() (map[string]string, error) {
 	return mountsMap, nil
 }
 
+// deviceMountpoint looks up the mountpoint of dev in the result of getMounts. Mounts are listed by their resolved device
+// path, while volumes reference theirs by a symlink.
+func deviceMountpoint(mounts map[string]string, dev string) (string, bool) {
+	if mountpoint, ok := mounts[dev]; ok {
+		return mountpoint, true
+	}
+	realDev, err := filepath.EvalSymlinks(dev)
+	if err != nil {
+		return "", false
+	}
+	mountpoint, ok := mounts[realDev]
+	return mountpoint, ok
+}
+
 func mkfs(dev, fstype string) error {
 	mkfsExec := fmt.Sprintf("/sbin/mkfs.%s", fstype)
 	cmd := exec.Command(mkfsExec, dev)
@@ -36,26 +153,42 @@ func mkfs(dev, fstype string) error {
 	return nil
 }
 
-func setPermissions(dev, fstype string, uid int, gid int) (err error) {
+// mountDevice mounts dev on mountpoint, trying all supported filesystem types
+func mountDevice(dev, mountpoint, options string) error {
+	// copy busybox' approach and just try everything we expect might work
+	var merr error
+	for _, fstype := range supportedFileystemTypes {
+		err := mount.Mount(dev, mountpoint, fstype, options)
+		if err == nil {
+			return nil
+		}
+		merr = multierror.Append(merr, err)
+	}
+	return fmt.Errorf("mounting %q as any of %s: %w", dev, supportedFileystemTypes, merr)
+}
+
+// withTempMount mounts dev on a temporary directory for the duration of fn
+func withTempMount(dev, fstype, options string, fn func(dir string) error) (err error) {
 	tmpDir, err := os.MkdirTemp(os.TempDir(), "mnt-*")
 	if err != nil {
-		return fmt.Errorf("creating temp dir for chmod: %w", err)
+		return fmt.Errorf("creating temp dir: %w", err)
 	}
 
-	if err := mount.Mount(
-		dev,
-		tmpDir,
-		fstype,
-		"",
-	); err != nil {
-		// nothing to clean up yet
+	if fstype == "" {
+		err = mountDevice(dev, tmpDir, options)
+	} else {
+		err = mount.Mount(dev, tmpDir, fstype, options)
+	}
+	if err != nil {
+		// nothing to clean up yet besides the dir
+		_ = os.Remove(tmpDir)
 		return fmt.Errorf("mounting: %w", err)
 	}
 
 	defer func() {
 		// clean up
 		if unmountErr := mount.Unmount(tmpDir); err == nil && unmountErr != nil {
-			err = fmt.Errorf("unmounting after chown: %w", unmountErr)
+			err = fmt.Errorf("unmounting: %w", unmountErr)
 			return
 		}
 
@@ -64,9 +197,14 @@ func setPermissions(dev, fstype string, uid int, gid int) (err error) {
 		}
 	}()
 
-	if err := os.Chown(tmpDir, uid, gid); err != nil {
-		return fmt.Errorf("chowning: %w", err)
-	}
+	return fn(tmpDir)
+}
 
-	return nil
+func setPermissions(dev, fstype string, uid int, gid int) error {
+	return withTempMount(dev, fstype, "", func(dir string) error {
+		if err := os.Chown(dir, uid, gid); err != nil {
+			return fmt.Errorf("chowning: %w", err)
+		}
+		return nil
+	})
 }
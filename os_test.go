@@ -1,7 +1,10 @@
 package main
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 func Test_setPermissions(t *testing.T) {
@@ -9,3 +12,55 @@ func Test_setPermissions(t *testing.T) {
 		t.Errorf("setPermissions() = %v, want %v", got, nil)
 	}
 }
+
+func Test_waitForDevice(t *testing.T) {
+	tmp := t.TempDir()
+	defer func(orig string) { sysfsPath = orig }(sysfsPath)
+	sysfsPath = filepath.Join(tmp, "sys")
+
+	realDev := filepath.Join(tmp, "sdz")
+	if err := os.WriteFile(realDev, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	dev := filepath.Join(tmp, "scsi-0HC_Volume_1234")
+	if err := os.Symlink(realDev, dev); err != nil {
+		t.Fatal(err)
+	}
+	vpdDir := filepath.Join(sysfsPath, "class/block/sdz/device")
+	if err := os.MkdirAll(vpdDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(vpdDir, "vpd_pg80"), append([]byte{0, 0x80, 0, 4}, "1234"...), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// devices without a VPD page
+	for _, name := range []string{"scsi-0HC_Volume_4321", "some-disk"} {
+		if err := os.Symlink(realDev+"-novpd", filepath.Join(tmp, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(realDev+"-novpd", nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		dev     string
+		id      int64
+		wantErr bool
+	}{
+		{"matching serial", dev, 1234, false},
+		{"no serial, matching link", filepath.Join(tmp, "scsi-0HC_Volume_4321"), 4321, false},
+		{"no serial, other link", filepath.Join(tmp, "some-disk"), 4321, true},
+		{"wrong serial", dev, 4321, true},
+		{"missing device", filepath.Join(tmp, "scsi-0HC_Volume_5678"), 5678, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := waitForDevice(tt.dev, tt.id, time.Second); (err != nil) != tt.wantErr {
+				t.Errorf("waitForDevice() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,643 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/docker/docker/pkg/mount"
+	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"github.com/sirupsen/logrus"
+)
+
+// In pool mode, all docker volumes are subdirectories of a single cloud volume (the pool), formatted as xfs and with
+// their sizes enforced by project quotas. The pool is attached and mounted as needed, and released again once none of
+// its volumes are mounted anymore. Each docker volume is also recorded in the labels of the pool, so volumes can be
+// listed and inspected on any node without attaching the pool.
+
+const defaultPoolSize = "100"
+
+var errPoolMissing = errors.New("pool volume does not exist")
+
+// extended attributes recording what pool volumes can't keep in labels of their own: whether they are mounted
+// read-only, their xfs project and their size in GB
+const (
+	poolReadonlyXattr = "user.docker-volume-hetzner.readonly"
+	poolProjectXattr  = "user.docker-volume-hetzner.project"
+	poolSizeXattr     = "user.docker-volume-hetzner.size"
+)
+
+// prefixes the labels of the pool recording a docker volume in it, followed by a short hash of the volume's name and the
+// field
+const poolVolumeLabelPrefix = "docker-volume-hetzner.pool-volume."
+
+// poolVolumeRecord is what the pool's labels tell about a docker volume in it
+type poolVolumeRecord struct {
+	name     string
+	size     int
+	readonly bool
+	created  time.Time
+}
+
+func poolVolumeLabelKey(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return poolVolumeLabelPrefix + hex.EncodeToString(sum[:4])
+}
+
+func setPoolVolumeRecord(labels map[string]string, r poolVolumeRecord) {
+	key := poolVolumeLabelKey(r.name)
+	setLabelString(labels, key+".name", r.name)
+	labels[key+".size"] = strconv.Itoa(r.size)
+	labels[key+".created"] = strconv.FormatInt(r.created.Unix(), 10)
+	if r.readonly {
+		labels[key+".readonly"] = "true"
+	}
+}
+
+func deletePoolVolumeRecord(labels map[string]string, name string) {
+	key := poolVolumeLabelKey(name) + "."
+	for k := range labels {
+		if strings.HasPrefix(k, key) {
+			delete(labels, k)
+		}
+	}
+}
+
+// poolVolumeRecords returns the docker volumes recorded in the given labels of the pool, sorted by name
+func poolVolumeRecords(labels map[string]string) []poolVolumeRecord {
+	var records []poolVolumeRecord
+	for k, v := range labels {
+		key, ok := strings.CutSuffix(k, ".size")
+		if !ok || !strings.HasPrefix(key, poolVolumeLabelPrefix) {
+			continue
+		}
+		name, ok := getLabelString(labels, key+".name")
+		if !ok {
+			continue
+		}
+		size, _ := strconv.Atoi(v)
+		created, _ := strconv.ParseInt(labels[key+".created"], 10, 64)
+		records = append(records, poolVolumeRecord{
+			name:     name,
+			size:     size,
+			readonly: labels[key+".readonly"] == "true",
+			created:  time.Unix(created, 0),
+		})
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].name < records[j].name })
+	return records
+}
+
+func findPoolVolumeRecord(labels map[string]string, name string) (poolVolumeRecord, bool) {
+	for _, r := range poolVolumeRecords(labels) {
+		if r.name == name {
+			return r, true
+		}
+	}
+	return poolVolumeRecord{}, false
+}
+
+func getXattr(path, attr string) (string, bool) {
+	buf := make([]byte, 32)
+	n, err := syscall.Getxattr(path, attr, buf)
+	if err != nil {
+		return "", false
+	}
+	return string(buf[:n]), true
+}
+
+func poolVolumeReadonly(dir string) bool {
+	v, _ := getXattr(dir, poolReadonlyXattr)
+	return v == "true"
+}
+
+// poolVolumeProject returns the xfs project recorded for a pool volume, if any
+func poolVolumeProject(dir string) (uint32, bool) {
+	v, ok := getXattr(dir, poolProjectXattr)
+	if !ok {
+		return 0, false
+	}
+	id, err := strconv.ParseUint(v, 10, 32)
+	return uint32(id), err == nil && id != 0
+}
+
+// driver_opts making no sense for subdirectories
+var poolUnsupportedOptions = []string{"fstype", "source", "lazy", "location", "mount_options", "autogrow_threshold", "autogrow_step", "autogrow_max", "trim"}
+
+// poolName returns the name of the pool all volumes are kept in, or "" if pool mode is disabled
+func poolName() string {
+	return os.Getenv("pool")
+}
+
+// poolMountpoint is where the pool is mounted; being below the propagated mount path keeps the bind mounts of its
+// volumes visible on the host
+func poolMountpoint() string {
+	return filepath.Join(propagatedMountPath, ".pool")
+}
+
+func poolVolumeDir(name string) string {
+	return filepath.Join(poolMountpoint(), "volumes", name)
+}
+
+// poolVolumeNames lists the volumes in the mounted pool
+func poolVolumeNames() ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(poolMountpoint(), "volumes"))
+	if err != nil {
+		return nil, fmt.Errorf("listing pool volumes: %w", err)
+	}
+	var names []string
+	for _, e := range entries {
+		if e.IsDir() {
+			names = append(names, e.Name())
+		}
+	}
+	return names, nil
+}
+
+// nextPoolProject returns an xfs project ID not used by any volume in the mounted pool
+func nextPoolProject() (uint32, error) {
+	names, err := poolVolumeNames()
+	if err != nil {
+		return 0, err
+	}
+	var last uint32
+	for _, name := range names {
+		if id, ok := poolVolumeProject(poolVolumeDir(name)); ok && id > last {
+			last = id
+		}
+	}
+	if last == 0x7fffffff {
+		return 0, errors.New("no xfs project IDs left in pool")
+	}
+	return last + 1, nil
+}
+
+// poolVolumeSizes returns the sizes in GB of the volumes in the mounted pool
+func poolVolumeSizes() ([]int, error) {
+	names, err := poolVolumeNames()
+	if err != nil {
+		return nil, err
+	}
+	sizes := make([]int, 0, len(names))
+	for _, name := range names {
+		v, _ := getXattr(poolVolumeDir(name), poolSizeXattr)
+		size, _ := strconv.Atoi(v)
+		sizes = append(sizes, size)
+	}
+	return sizes, nil
+}
+
+func xfsQuota(mountpoint, command string) error {
+	cmd := exec.Command("xfs_quota", "-x", "-c", command, mountpoint)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("xfs_quota %q: %w: %s", command, err, stderr.String())
+	}
+	return nil
+}
+
+// getPool fetches the cloud volume of the pool
+func (hd *hetznerDriver) getPool() (*hcloud.Volume, error) {
+	name := prefixName(poolName())
+	vol, _, err := hd.client.Volume().GetByName(context.Background(), name)
+	if err != nil {
+		return nil, fmt.Errorf("fetching pool volume %q: %w", name, err)
+	}
+	if vol == nil {
+		return nil, fmt.Errorf("%w: %q", errPoolMissing, name)
+	}
+	if vol.Labels[poolLabel] != "true" {
+		return nil, fmt.Errorf("volume %q exists but is not a pool", vol.Name)
+	}
+	return vol, nil
+}
+
+// acquirePool attaches and mounts the pool on the local server, if not already done, and returns its cloud volume. With
+// create set, the pool is created first if it doesn't exist yet.
+func (hd *hetznerDriver) acquirePool(create bool) (*hcloud.Volume, error) {
+	srv, err := hd.getServerForLocalhost()
+	if err != nil {
+		return nil, err
+	}
+
+	vol, err := hd.getPool()
+	if errors.Is(err, errPoolMissing) && create {
+		vol, err = hd.createPool(poolName(), srv)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if vol.Server != nil && vol.Server.ID != 0 && vol.Server.ID != srv.ID {
+		return nil, fmt.Errorf("pool volume %q is attached to server %d; pools can only be used by one server at a time", vol.Name, vol.Server.ID)
+	}
+	if vol.Server == nil || vol.Server.ID == 0 {
+		logrus.Infof("attaching pool volume %q to %q", vol.Name, srv.Name)
+		if err := hd.attachVolume(vol, srv); err != nil {
+			return nil, err
+		}
+	}
+
+	mountpoint := poolMountpoint()
+	if mounted, err := mount.Mounted(mountpoint); err != nil {
+		return nil, fmt.Errorf("checking pool mount: %w", err)
+	} else if mounted {
+		return vol, nil
+	}
+
+	if err := waitForDevice(vol.LinuxDevice, vol.ID, deviceTimeout()); err != nil {
+		return nil, fmt.Errorf("waiting for device of pool volume %q: %w", vol.Name, err)
+	}
+	if err := os.MkdirAll(mountpoint, 0o755); err != nil {
+		return nil, fmt.Errorf("creating pool mountpoint %s: %w", mountpoint, err)
+	}
+	if err := mount.Mount(vol.LinuxDevice, mountpoint, "xfs", "prjquota"); err != nil {
+		return nil, fmt.Errorf("mounting pool volume %q: %w", vol.Name, err)
+	}
+	if err := os.MkdirAll(filepath.Join(mountpoint, "volumes"), 0o755); err != nil {
+		return nil, fmt.Errorf("creating pool volumes dir: %w", err)
+	}
+
+	logrus.Infof("pool volume %q mounted on %q", vol.Name, mountpoint)
+
+	return vol, nil
+}
+
+// updatePoolRecords changes the docker volumes recorded in the labels of the pool
+func (hd *hetznerDriver) updatePoolRecords(pool *hcloud.Volume, change func(labels map[string]string)) error {
+	labels := make(map[string]string, len(pool.Labels))
+	for k, v := range pool.Labels {
+		labels[k] = v
+	}
+	change(labels)
+
+	updated, err := hd.updateVolume(pool, hcloud.VolumeUpdateOpts{Labels: labels})
+	if err != nil {
+		return fmt.Errorf("updating labels of pool volume %q: %w", pool.Name, err)
+	}
+	pool.Labels = updated.Labels
+	return nil
+}
+
+func (hd *hetznerDriver) createPool(name string, srv *hcloud.Server) (*hcloud.Volume, error) {
+	sizeSetting := os.Getenv("pool_size")
+	if sizeSetting == "" {
+		sizeSetting = defaultPoolSize
+	}
+	size, err := parseSize(sizeSetting)
+	if err != nil {
+		return nil, fmt.Errorf("pool_size: %w", err)
+	}
+
+	opts := hcloud.VolumeCreateOpts{
+		Name:     prefixName(name),
+		Size:     size,
+		Location: serverLocation(srv),
+		Labels:   map[string]string{pluginLabel: "", poolLabel: "true"},
+		Format:   hcloud.String("xfs"),
+	}
+	setLabelString(opts.Labels, nameLabel, name)
+
+	logrus.Infof("creating pool volume %q (%dGB)", opts.Name, size)
+
+	vol, err := hd.createWithinLimits(name, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if useProtection() {
+		if err := hd.setProtection(vol, true); err != nil {
+			logrus.Warnf("protecting pool volume %q: %v", opts.Name, err)
+		}
+	}
+
+	return vol, nil
+}
+
+// poolBindMounts returns the mountpoints of all volumes currently bind mounted from the pool, by volume name
+func poolBindMounts() (map[string]string, error) {
+	mounts, err := mount.GetMounts()
+	if err != nil {
+		return nil, fmt.Errorf("getting local mounts: %w", err)
+	}
+
+	var pool *mount.Info
+	for _, m := range mounts {
+		if m.Mountpoint == poolMountpoint() {
+			pool = m
+		}
+	}
+	binds := map[string]string{}
+	if pool == nil {
+		return binds, nil
+	}
+
+	for _, m := range mounts {
+		if m.Major != pool.Major || m.Minor != pool.Minor || m.Mountpoint == pool.Mountpoint {
+			continue
+		}
+		if rel, err := filepath.Rel("/volumes", m.Root); err == nil && filepath.Dir(rel) == "." && rel != "." {
+			binds[rel] = m.Mountpoint
+		}
+	}
+	return binds, nil
+}
+
+// releasePool unmounts and detaches the pool, unless any of its volumes are still mounted
+func (hd *hetznerDriver) releasePool() error {
+	binds, err := poolBindMounts()
+	if err != nil {
+		return err
+	}
+	if len(binds) > 0 {
+		return nil
+	}
+
+	if err := unmountVolume(poolMountpoint()); err != nil {
+		return fmt.Errorf("unmounting pool: %w", err)
+	}
+
+	srv, err := hd.getServerForLocalhost()
+	if err != nil {
+		return err
+	}
+	vol, err := hd.getPool()
+	if errors.Is(err, errPoolMissing) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if vol.Server == nil || vol.Server.ID != srv.ID {
+		return nil
+	}
+
+	if err := waitForDeviceRelease(vol.LinuxDevice, releaseTimeout()); err != nil {
+		logrus.Warnf("%v; leaving pool volume %q attached", err, vol.Name)
+		return nil
+	}
+
+	logrus.Infof("detaching idle pool volume %q", vol.Name)
+	return hd.detachVolume(vol)
+}
+
+// withPool runs fn with the pool available locally, releasing it afterwards if unused
+func (hd *hetznerDriver) withPool(create bool, fn func(pool *hcloud.Volume) error) error {
+	hd.poolMu.Lock()
+	defer hd.poolMu.Unlock()
+
+	pool, err := hd.acquirePool(create)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := hd.releasePool(); err != nil {
+			logrus.Warnf("releasing pool: %v", err)
+		}
+	}()
+	return fn(pool)
+}
+
+func (hd *hetznerDriver) poolCreate(req *volume.CreateRequest) error {
+	for _, k := range poolUnsupportedOptions {
+		if _, ok := req.Options[k]; ok {
+			return fmt.Errorf("volume %q: option %q not supported in pool mode", req.Name, k)
+		}
+	}
+
+	size, err := parseSize(getOption("size", req.Options))
+	if err != nil {
+		return err
+	}
+	if size < 1 {
+		return fmt.Errorf("volume %q: size must be at least 1GB", req.Name)
+	}
+	uid, err := strconv.Atoi(getOption("uid", req.Options))
+	if err != nil {
+		return fmt.Errorf("parsing uid option value as integer: %w", err)
+	}
+	gid, err := strconv.Atoi(getOption("gid", req.Options))
+	if err != nil {
+		return fmt.Errorf("parsing gid option value as integer: %w", err)
+	}
+
+	readonly := getOption("readonly", req.Options) == "true"
+
+	start := time.Now()
+	err = hd.withPool(true, func(pool *hcloud.Volume) error {
+		if err := checkTotalLimits(req.Name, size, poolVolumeSizes); err != nil {
+			return err
+		}
+		id, err := nextPoolProject()
+		if err != nil {
+			return err
+		}
+
+		if other, ok := getLabelString(pool.Labels, poolVolumeLabelKey(req.Name)+".name"); ok && other != req.Name {
+			return fmt.Errorf("volume %q: recorded in the pool's labels under the same key as %q", req.Name, other)
+		}
+		dir := poolVolumeDir(req.Name)
+		if err := os.Mkdir(dir, 0o755); err != nil {
+			return fmt.Errorf("creating pool volume %q: %w", req.Name, err)
+		}
+		for attr, v := range map[string]string{poolProjectXattr: strconv.FormatUint(uint64(id), 10), poolSizeXattr: strconv.Itoa(size)} {
+			if err := syscall.Setxattr(dir, attr, []byte(v), 0); err != nil {
+				return fmt.Errorf("recording %s of pool volume %q: %w", attr, req.Name, err)
+			}
+		}
+
+		if err := xfsQuota(poolMountpoint(), fmt.Sprintf("project -s -p %s %d", dir, id)); err != nil {
+			return err
+		}
+		if err := xfsQuota(poolMountpoint(), fmt.Sprintf("limit -p bhard=%dg %d", size, id)); err != nil {
+			return err
+		}
+
+		if err := os.Chown(dir, uid, gid); err != nil {
+			return fmt.Errorf("chown %q to '%d:%d': %w", dir, uid, gid, err)
+		}
+
+		if readonly {
+			if err := syscall.Setxattr(dir, poolReadonlyXattr, []byte("true"), 0); err != nil {
+				return fmt.Errorf("marking pool volume %q read-only: %w", req.Name, err)
+			}
+		}
+
+		record := poolVolumeRecord{name: req.Name, size: size, readonly: readonly, created: time.Now()}
+		if err := hd.updatePoolRecords(pool, func(labels map[string]string) { setPoolVolumeRecord(labels, record) }); err != nil {
+			if rerr := os.RemoveAll(dir); rerr != nil {
+				logrus.Warnf("removing unrecorded pool volume %q: %v", req.Name, rerr)
+			}
+			return err
+		}
+
+		logrus.Infof("pool volume %q (%dGB) created with project %d", req.Name, size, id)
+		return nil
+	})
+	hd.audit(auditEvent{Event: auditCreated}, req.Name, nil, start, err)
+	return err
+}
+
+// poolList lists the volumes recorded in the labels of the pool, without needing the pool attached locally
+func (hd *hetznerDriver) poolList() (*volume.ListResponse, error) {
+	resp := &volume.ListResponse{}
+	pool, err := hd.getPool()
+	if errors.Is(err, errPoolMissing) {
+		// no volumes created yet
+		return resp, nil
+	} else if err != nil {
+		return nil, err
+	}
+	binds, err := poolBindMounts()
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range poolVolumeRecords(pool.Labels) {
+		resp.Volumes = append(resp.Volumes, &volume.Volume{Name: r.name, Mountpoint: binds[r.name]})
+	}
+	return resp, nil
+}
+
+// poolGet describes a volume recorded in the labels of the pool, without needing the pool attached locally
+func (hd *hetznerDriver) poolGet(req *volume.GetRequest) (*volume.GetResponse, error) {
+	pool, err := hd.getPool()
+	if err != nil {
+		return nil, err
+	}
+	r, ok := findPoolVolumeRecord(pool.Labels, req.Name)
+	if !ok {
+		return nil, fmt.Errorf("volume %q not found in pool %q", req.Name, poolName())
+	}
+	binds, err := poolBindMounts()
+	if err != nil {
+		return nil, err
+	}
+
+	status := map[string]interface{}{
+		"pool": poolName(),
+		"size": r.size,
+		"mode": mountMode(r.readonly),
+	}
+	if id, ok := poolVolumeProject(poolVolumeDir(req.Name)); ok {
+		status["project"] = id
+	}
+	mountpoint, mounted := binds[req.Name]
+	if mounted {
+		status["mounted"] = true
+	}
+	return &volume.GetResponse{Volume: &volume.Volume{
+		Name:       req.Name,
+		Mountpoint: mountpoint,
+		CreatedAt:  r.created.Format(time.RFC3339),
+		Status:     status,
+	}}, nil
+}
+
+func (hd *hetznerDriver) poolRemove(req *volume.RemoveRequest) error {
+	start := time.Now()
+	err := hd.withPool(false, func(pool *hcloud.Volume) error {
+		dir := poolVolumeDir(req.Name)
+		if _, err := os.Stat(dir); errors.Is(err, os.ErrNotExist) {
+			if _, ok := findPoolVolumeRecord(pool.Labels, req.Name); !ok {
+				return fmt.Errorf("volume %q not found in pool %q: %w", req.Name, poolName(), err)
+			}
+			// left recorded by a remove failing halfway
+			return hd.updatePoolRecords(pool, func(labels map[string]string) { deletePoolVolumeRecord(labels, req.Name) })
+		} else if err != nil {
+			return fmt.Errorf("volume %q not found in pool %q: %w", req.Name, poolName(), err)
+		}
+		binds, err := poolBindMounts()
+		if err != nil {
+			return err
+		}
+		if mountpoint, ok := binds[req.Name]; ok {
+			return fmt.Errorf("volume %q still mounted on %q", req.Name, mountpoint)
+		}
+
+		id, hasProject := poolVolumeProject(dir)
+		if err := os.RemoveAll(dir); err != nil {
+			return fmt.Errorf("removing pool volume %q: %w", req.Name, err)
+		}
+		if hasProject {
+			if err := xfsQuota(poolMountpoint(), fmt.Sprintf("limit -p bhard=0 %d", id)); err != nil {
+				logrus.Warnf("clearing quota of removed pool volume %q: %v", req.Name, err)
+			}
+		}
+		if err := hd.updatePoolRecords(pool, func(labels map[string]string) { deletePoolVolumeRecord(labels, req.Name) }); err != nil {
+			return err
+		}
+
+		logrus.Infof("pool volume %q removed", req.Name)
+		return nil
+	})
+	hd.audit(auditEvent{Event: auditDeleted}, req.Name, nil, start, err)
+	return err
+}
+
+func (hd *hetznerDriver) poolMount(req *volume.MountRequest) (*volume.MountResponse, error) {
+	hd.poolMu.Lock()
+	defer hd.poolMu.Unlock()
+
+	if _, err := hd.acquirePool(false); err != nil {
+		return nil, err
+	}
+
+	mountpoint, err := func() (string, error) {
+		dir := poolVolumeDir(req.Name)
+		if _, err := os.Stat(dir); err != nil {
+			return "", fmt.Errorf("volume %q not found in pool %q: %w", req.Name, poolName(), err)
+		}
+
+		mountpoint := fmt.Sprintf("%s/%s", propagatedMountPath, req.ID)
+		if err := os.MkdirAll(mountpoint, 0o755); err != nil {
+			return "", fmt.Errorf("creating mountpoint %s: %w", mountpoint, err)
+		}
+		options := "bind"
+		if poolVolumeReadonly(dir) {
+			options = joinMountOptions(options, "ro")
+		}
+		if err := mount.Mount(dir, mountpoint, "none", options); err != nil {
+			return "", fmt.Errorf("bind mounting pool volume %q on %q: %w", req.Name, mountpoint, err)
+		}
+		return mountpoint, nil
+	}()
+	if err != nil {
+		if err := hd.releasePool(); err != nil {
+			logrus.Warnf("releasing pool: %v", err)
+		}
+		return nil, err
+	}
+
+	logrus.Infof("successfully mounted pool volume %q on %q", req.Name, mountpoint)
+
+	return &volume.MountResponse{Mountpoint: mountpoint}, nil
+}
+
+func (hd *hetznerDriver) poolUnmount(req *volume.UnmountRequest) error {
+	hd.poolMu.Lock()
+	defer hd.poolMu.Unlock()
+
+	mountpoint := fmt.Sprintf("%s/%s", propagatedMountPath, req.ID)
+	if err := unmountVolume(mountpoint); err != nil {
+		return err
+	}
+	if err := os.Remove(mountpoint); err != nil {
+		return fmt.Errorf("removing mountpoint %s: %w", mountpoint, err)
+	}
+
+	logrus.Infof("unmounted pool volume %q from %q", req.Name, mountpoint)
+
+	return hd.releasePool()
+}
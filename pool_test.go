@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+)
+
+func Test_poolVolumes(t *testing.T) {
+	defer func(orig string) { propagatedMountPath = orig }(propagatedMountPath)
+	propagatedMountPath = t.TempDir()
+	t.Setenv("max_volumes", "")
+	t.Setenv("max_total_size", "")
+
+	if err := os.MkdirAll(filepath.Join(poolMountpoint(), "volumes"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if id, err := nextPoolProject(); err != nil || id != 1 {
+		t.Errorf("nextPoolProject() in empty pool = %d, %v, want 1", id, err)
+	}
+
+	for name, attrs := range map[string]map[string]string{
+		"foo": {poolProjectXattr: "7", poolSizeXattr: "5"},
+		"bar": {poolProjectXattr: "3", poolSizeXattr: "2"},
+		"baz": {},
+	} {
+		dir := poolVolumeDir(name)
+		if err := os.Mkdir(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		for attr, v := range attrs {
+			if err := syscall.Setxattr(dir, attr, []byte(v), 0); err != nil {
+				t.Skipf("extended attributes not supported: %v", err)
+			}
+		}
+	}
+
+	if id, err := nextPoolProject(); err != nil || id != 8 {
+		t.Errorf("nextPoolProject() = %d, %v, want 8", id, err)
+	}
+	if sizes, err := poolVolumeSizes(); err != nil || !reflect.DeepEqual(sizes, []int{2, 0, 5}) {
+		t.Errorf("poolVolumeSizes() = %v, %v, want [2 0 5]", sizes, err)
+	}
+
+	t.Setenv("max_volumes", "3")
+	if err := checkTotalLimits("qux", 1, poolVolumeSizes); err == nil {
+		t.Error("checkTotalLimits() allowed a fourth pool volume")
+	}
+	t.Setenv("max_volumes", "")
+	t.Setenv("max_total_size", "10")
+	if err := checkTotalLimits("qux", 3, poolVolumeSizes); err != nil {
+		t.Errorf("checkTotalLimits() error = %v for 10GB in total", err)
+	}
+	if err := checkTotalLimits("qux", 4, poolVolumeSizes); err == nil {
+		t.Error("checkTotalLimits() allowed 11GB in total")
+	}
+}
+
+func Test_poolVolumeRecords(t *testing.T) {
+	created := time.Unix(1700000000, 0)
+	records := []poolVolumeRecord{
+		{name: "bar", size: 3, readonly: true, created: created},
+		{name: "foo", size: 10, created: created},
+		{name: strings.Repeat("long-name.", 20), size: 1, created: created},
+	}
+
+	labels := map[string]string{pluginLabel: "", poolLabel: "true"}
+	for _, r := range records {
+		setPoolVolumeRecord(labels, r)
+	}
+	values := map[string]interface{}{}
+	for k, v := range labels {
+		values[k] = v
+	}
+	if ok, err := hcloud.ValidateResourceLabels(values); !ok {
+		t.Errorf("pool labels invalid: %v", err)
+	}
+	if got := poolVolumeRecords(labels); !reflect.DeepEqual(got, records) {
+		t.Errorf("poolVolumeRecords() = %v, want %v", got, records)
+	}
+
+	deletePoolVolumeRecord(labels, "bar")
+	if got := poolVolumeRecords(labels); !reflect.DeepEqual(got, records[1:]) {
+		t.Errorf("poolVolumeRecords() after delete = %v, want %v", got, records[1:])
+	}
+	if _, ok := findPoolVolumeRecord(labels, "bar"); ok {
+		t.Error("findPoolVolumeRecord() found deleted volume")
+	}
+}
+
+func Test_hetznerDriver_pool(t *testing.T) {
+	// there are no real devices behind the fake API, so mounting the pool always fails
+	t.Setenv("device_timeout", "10ms")
+	t.Setenv("use_protection", "false")
+	t.Setenv("pool", "shared")
+	t.Setenv("pool_size", "50")
+
+	f := newFakeAPI(t)
+	hd := f.driver()
+
+	got, err := hd.List()
+	if err != nil || len(got.Volumes) != 0 {
+		t.Errorf("hetznerDriver.List() = %v, %v, want no volumes without pool", got, err)
+	}
+
+	if err := hd.Create(&volume.CreateRequest{Name: "foo", Options: map[string]string{"source": "/some.tar"}}); err == nil {
+		t.Error("hetznerDriver.Create() succeeded with option unsupported in pool mode")
+	}
+	if got := f.mutations(); len(got) != 0 {
+		t.Fatalf("API mutations = %v, want none", got)
+	}
+
+	err = hd.Create(&volume.CreateRequest{Name: "foo", Options: map[string]string{"size": "1"}})
+	if err == nil || !strings.Contains(err.Error(), "waiting for device") {
+		t.Errorf("hetznerDriver.Create() error = %v, want device error", err)
+	}
+
+	pool := f.volumeByName(prefixName("shared"))
+	if pool == nil {
+		t.Fatal("pool volume not created")
+	}
+	if pool.Size != 50 || pool.Format == nil || *pool.Format != "xfs" || pool.Labels[poolLabel] != "true" {
+		t.Errorf("pool volume = size %d, format %v, labels %v; want 50GB xfs pool", pool.Size, pool.Format, pool.Labels)
+	}
+	wantMutations := []string{"POST /volumes", "POST /volumes/2/actions/attach"}
+	if got := f.mutations(); !reflect.DeepEqual(got, wantMutations) {
+		t.Errorf("API mutations = %v, want %v", got, wantMutations)
+	}
+
+	// volumes are listed from the pool's labels, even while it's attached to another node
+	other := f.addServer("other", "fsn1")
+	func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		pool.Server = hcloud.Ptr(other.ID)
+		setPoolVolumeRecord(pool.Labels, poolVolumeRecord{name: "bar", size: 2, readonly: true, created: time.Now()})
+	}()
+	got, err = hd.List()
+	if err != nil || len(got.Volumes) != 1 || got.Volumes[0].Name != "bar" {
+		t.Errorf("hetznerDriver.List() = %v, %v, want bar", got, err)
+	}
+	resp, err := hd.Get(&volume.GetRequest{Name: "bar"})
+	if err != nil || resp.Volume.Status["size"] != 2 || resp.Volume.Status["mode"] != "ro" {
+		t.Errorf("hetznerDriver.Get() = %v, %v, want 2GB read-only volume", resp, err)
+	}
+	if _, err := hd.Get(&volume.GetRequest{Name: "foo"}); err == nil {
+		t.Error("hetznerDriver.Get() succeeded on volume not in pool")
+	}
+	if got := f.mutations(); !reflect.DeepEqual(got, wantMutations) {
+		t.Errorf("API mutations = %v, want %v", got, wantMutations)
+	}
+}
+
+func Test_loopHarness_pool(t *testing.T) {
+	if _, err := os.Stat("/sbin/mkfs.xfs"); err != nil {
+		t.Skip("mkfs.xfs not available")
+	}
+	if _, err := exec.LookPath("xfs_quota"); err != nil {
+		t.Skip("xfs_quota not available")
+	}
+	t.Setenv("use_protection", "false")
+	t.Setenv("pool", "shared")
+
+	h := newLoopHarness(t)
+	hd := h.driver()
+
+	for name, readonly := range map[string]string{"foo": "false", "bar": "true"} {
+		opts := map[string]string{"size": "1", "uid": "999", "gid": "999", "readonly": readonly}
+		if err := hd.Create(&volume.CreateRequest{Name: name, Options: opts}); err != nil {
+			t.Fatalf("hetznerDriver.Create(%q) error = %v", name, err)
+		}
+	}
+	if pool, _, _ := h.mock.Volume().GetByName(context.Background(), prefixName("shared")); pool.Server != nil {
+		t.Errorf("pool still attached to %v while unused", pool.Server)
+	}
+
+	resp, err := hd.Mount(&volume.MountRequest{Name: "foo", ID: "some-id"})
+	if err != nil {
+		t.Fatalf("hetznerDriver.Mount() error = %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(resp.Mountpoint, "data"), []byte("data"), 0o644); err != nil {
+		t.Errorf("writing to volume: %v", err)
+	}
+
+	list, err := hd.List()
+	if err != nil {
+		t.Fatalf("hetznerDriver.List() error = %v", err)
+	}
+	mountpoints := map[string]string{}
+	for _, v := range list.Volumes {
+		mountpoints[v.Name] = v.Mountpoint
+	}
+	if want := map[string]string{"foo": resp.Mountpoint, "bar": ""}; !reflect.DeepEqual(mountpoints, want) {
+		t.Errorf("hetznerDriver.List() mountpoints = %v, want %v", mountpoints, want)
+	}
+
+	roResp, err := hd.Mount(&volume.MountRequest{Name: "bar", ID: "other-id"})
+	if err != nil {
+		t.Fatalf("hetznerDriver.Mount() error = %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(roResp.Mountpoint, "data"), []byte("data"), 0o644); !errors.Is(err, syscall.EROFS) {
+		t.Errorf("writing to read-only volume: error = %v, want %v", err, syscall.EROFS)
+	}
+	if err := hd.Unmount(&volume.UnmountRequest{Name: "bar", ID: "other-id"}); err != nil {
+		t.Fatalf("hetznerDriver.Unmount() error = %v", err)
+	}
+
+	if err := hd.Remove(&volume.RemoveRequest{Name: "foo"}); err == nil {
+		t.Error("hetznerDriver.Remove() succeeded on mounted volume")
+	}
+	if err := hd.Unmount(&volume.UnmountRequest{Name: "foo", ID: "some-id"}); err != nil {
+		t.Fatalf("hetznerDriver.Unmount() error = %v", err)
+	}
+	if pool, _, _ := h.mock.Volume().GetByName(context.Background(), prefixName("shared")); pool.Server != nil {
+		t.Errorf("pool still attached to %v after last unmount", pool.Server)
+	}
+
+	if err := hd.Remove(&volume.RemoveRequest{Name: "foo"}); err != nil {
+		t.Errorf("hetznerDriver.Remove() error = %v", err)
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"github.com/sirupsen/logrus"
+)
+
+// how long a failed preflight blocks requests before being re-run, in case the failure was transient
+const preflightRetryInterval = time.Minute
+
+type preflightCheck struct {
+	Name    string `json:"name"`
+	OK      bool   `json:"ok"`
+	Fatal   bool   `json:"fatal,omitempty"`
+	Message string `json:"message"`
+}
+
+type preflightReport struct {
+	Time   time.Time        `json:"time"`
+	Checks []preflightCheck `json:"checks"`
+}
+
+func (r *preflightReport) pass(name, format string, args ...interface{}) {
+	r.Checks = append(r.Checks, preflightCheck{Name: name, OK: true, Message: fmt.Sprintf(format, args...)})
+}
+
+func (r *preflightReport) warn(name, format string, args ...interface{}) {
+	r.Checks = append(r.Checks, preflightCheck{Name: name, Message: fmt.Sprintf(format, args...)})
+}
+
+func (r *preflightReport) fail(name, format string, args ...interface{}) {
+	r.Checks = append(r.Checks, preflightCheck{Name: name, Fatal: true, Message: fmt.Sprintf(format, args...)})
+}
+
+// err returns an error summarizing all fatal checks, if any
+func (r *preflightReport) err() error {
+	var msgs []string
+	for _, c := range r.Checks {
+		if c.Fatal {
+			msgs = append(msgs, fmt.Sprintf("%s: %s", c.Name, c.Message))
+		}
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("plugin misconfigured: %s", strings.Join(msgs, "; "))
+}
+
+func (r *preflightReport) log() {
+	for _, c := range r.Checks {
+		switch {
+		case c.OK:
+			logrus.Infof("preflight %s: ok: %s", c.Name, c.Message)
+		case c.Fatal:
+			logrus.Errorf("preflight %s: FAILED: %s", c.Name, c.Message)
+		default:
+			logrus.Warnf("preflight %s: warning: %s", c.Name, c.Message)
+		}
+	}
+}
+
+func (r *preflightReport) print(w io.Writer) {
+	for _, c := range r.Checks {
+		status := "ok"
+		switch {
+		case c.Fatal:
+			status = "FAIL"
+		case !c.OK:
+			status = "WARN"
+		}
+		fmt.Fprintf(w, "[%4s] %s: %s\n", status, c.Name, c.Message)
+	}
+}
+
+// preflight validates the plugin's environment: configuration, API access, the local server and the tools and devices
+// needed to manage volumes.
+func (hd *hetznerDriver) preflight() *preflightReport {
+	r := &preflightReport{Time: time.Now()}
+
+	if strings.TrimSpace(os.Getenv("apikey")) == "" {
+		r.fail("apikey", "no API key configured; set it with 'docker plugin set <alias> apikey=...'")
+	} else {
+		r.pass("apikey", "API key configured")
+	}
+
+	if _, err := hd.client.Volume().All(context.Background()); err != nil {
+		r.fail("token", "listing volumes: %s", describeAPIError(err))
+	} else {
+		r.pass("token", "API key can list volumes")
+
+		// a no-op update on a volume that cannot exist tells read-only tokens apart without touching anything
+		_, _, err := hd.client.Volume().Update(context.Background(), &hcloud.Volume{ID: 0}, hcloud.VolumeUpdateOpts{})
+		if !isPermissionError(err) {
+			// the probe proves nothing if the API checks for the volume first, so also rely on the changes made so far
+			err = hd.permissionError()
+		}
+		if err != nil {
+			r.fail("token permissions", "API key is not allowed to modify volumes: %s", describeAPIError(err))
+		} else {
+			r.pass("token permissions", "API key has write access")
+		}
+	}
+
+	if srv, err := hd.getServerForLocalhost(); err != nil {
+		r.fail("server", "%s", describeAPIError(err))
+	} else {
+		r.pass("server", "running on cloud server %q (%d)", srv.Name, srv.ID)
+
+		if loc := serverLocation(srv); loc == nil {
+			r.fail("location", "could not determine location of server %q", srv.Name)
+		} else {
+			r.pass("location", "server %q is in location %q", srv.Name, loc.Name)
+		}
+	}
+
+	if profiles, err := loadProfiles(); err != nil {
+		r.fail("profiles", "%v", err)
+	} else if len(profiles) > 0 {
+		r.pass("profiles", "%d volume profiles configured", len(profiles))
+	}
+
+	if policy, err := parseDetachPolicy(os.Getenv("detach_policy")); err != nil {
+		r.fail("detach policy", "%v", err)
+	} else {
+		r.pass("detach policy", "detaching volumes %s", policy)
+	}
+
+	for _, fstype := range configuredFilesystemTypes() {
+		for _, tool := range []string{"mkfs", "fsck"} {
+			path := fmt.Sprintf("/sbin/%s.%s", tool, fstype)
+			switch fi, err := os.Stat(path); {
+			case err != nil && tool == "mkfs":
+				r.fail(tool, "%s not available for fstype %q: %v", path, fstype, err)
+			case err != nil:
+				r.warn(tool, "%s not available for fstype %q: %v", path, fstype, err)
+			case fi.Mode()&0o111 == 0:
+				r.fail(tool, "%s is not executable", path)
+			default:
+				r.pass(tool, "%s available", path)
+			}
+		}
+	}
+
+	if poolName() != "" {
+		if path, err := exec.LookPath("xfs_quota"); err != nil {
+			r.fail("xfs_quota", "xfs_quota needed for pool mode not available: %v", err)
+		} else {
+			r.pass("xfs_quota", "%s available", path)
+		}
+	}
+
+	if fi, err := os.Stat("/dev"); err != nil || !fi.IsDir() {
+		r.fail("devices", "/dev not accessible: %v", err)
+	} else if _, err := os.ReadDir("/dev/disk/by-id"); err != nil {
+		r.warn("devices", "/dev/disk/by-id not readable (%v); is /dev mounted into the plugin?", err)
+	} else {
+		r.pass("devices", "/dev/disk/by-id readable")
+	}
+
+	return r
+}
+
+// configuredFilesystemTypes returns all filesystem types volumes may be created with, by default or through a profile
+func configuredFilesystemTypes() []string {
+	fstypes := []string{os.Getenv("fstype")}
+	if poolName() != "" {
+		fstypes = []string{"xfs"}
+	}
+
+	profiles, _ := loadProfiles()
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fstype := string(profiles[name].Fstype)
+		if fstype != "" && !slices.Contains(fstypes, fstype) {
+			fstypes = append(fstypes, fstype)
+		}
+	}
+	return fstypes
+}
+
+func isPermissionError(err error) bool {
+	return hcloud.IsError(err, hcloud.ErrorCodeTokenReadonly, hcloud.ErrorCodeForbidden)
+}
+
+func describeAPIError(err error) string {
+	switch {
+	case hcloud.IsError(err, hcloud.ErrorCodeUnauthorized):
+		return fmt.Sprintf("API key invalid or revoked (%v)", err)
+	case isPermissionError(err):
+		return fmt.Sprintf("API key lacks permissions (%v)", err)
+	default:
+		return err.Error()
+	}
+}
+
+// preflightState holds the last preflight report, gating requests while it has fatal failures
+type preflightState struct {
+	mu     sync.Mutex
+	report *preflightReport
+	// the last change refused for lack of permissions, until a change succeeds again
+	permissionErr error
+	// whether report needs re-running, since the permissions changed
+	stale bool
+}
+
+// noteMutation records the outcome of a change to a volume: a change refused for lack of permissions fails the
+// preflight, and a successful change clears such a refusal again. Either way, the last report is re-run by the next
+// request checking it.
+func (hd *hetznerDriver) noteMutation(err error) {
+	if hd.preflightState == nil || (err != nil && !isPermissionError(err)) {
+		return
+	}
+	hd.preflightState.mu.Lock()
+	defer hd.preflightState.mu.Unlock()
+
+	if err == nil && hd.preflightState.permissionErr == nil {
+		return
+	}
+	hd.preflightState.permissionErr = err
+	hd.preflightState.stale = true
+}
+
+func (hd *hetznerDriver) permissionError() error {
+	if hd.preflightState == nil {
+		return nil
+	}
+	hd.preflightState.mu.Lock()
+	defer hd.preflightState.mu.Unlock()
+	return hd.preflightState.permissionErr
+}
+
+// runPreflight runs and logs a fresh preflight, storing its report
+func (hd *hetznerDriver) runPreflight() *preflightReport {
+	r := hd.preflight()
+	r.log()
+
+	hd.preflightState.mu.Lock()
+	hd.preflightState.report = r
+	hd.preflightState.stale = false
+	hd.preflightState.mu.Unlock()
+
+	return r
+}
+
+// checkPreflight returns an error if the last preflight found the plugin misconfigured. Failed preflights are re-run
+// after a while, in case the failure was only transient, and any preflight once the permissions were found to change.
+func (hd *hetznerDriver) checkPreflight() error {
+	if hd.preflightState == nil {
+		return nil
+	}
+
+	hd.preflightState.mu.Lock()
+	r, stale := hd.preflightState.report, hd.preflightState.stale
+	hd.preflightState.mu.Unlock()
+
+	if r == nil {
+		return nil
+	}
+	if stale || (r.err() != nil && time.Since(r.Time) > preflightRetryInterval) {
+		r = hd.runPreflight()
+	}
+	return r.err()
+}
+
+// serveHealth reports the last preflight results, re-running them if asked to with ?refresh
+func (hd *hetznerDriver) serveHealth(w http.ResponseWriter, req *http.Request) {
+	hd.preflightState.mu.Lock()
+	r := hd.preflightState.report
+	hd.preflightState.mu.Unlock()
+
+	if r == nil || req.URL.Query().Has("refresh") {
+		r = hd.runPreflight()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if r.err() != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(r)
+}
+
+func cmdDoctor(hd *hetznerDriver, out io.Writer, args []string) error {
+	if _, err := parseCLIArgs(flag.NewFlagSet("doctor", flag.ContinueOnError), args, false); err != nil {
+		return err
+	}
+
+	r := hd.preflight()
+	r.print(out)
+	return r.err()
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+)
+
+func Test_hetznerDriver_preflight(t *testing.T) {
+	readonly := hcloud.Error{Code: hcloud.ErrorCodeTokenReadonly, Message: "token is read-only"}
+
+	tests := []struct {
+		name      string
+		apikey    string
+		setup     func(m *mockClient, hd *hetznerDriver)
+		wantFatal []string
+	}{
+		{"healthy", "secret", nil, nil},
+		{"no apikey", "", nil, []string{"apikey"}},
+		{"invalid token", "secret", func(m *mockClient, _ *hetznerDriver) {
+			m.failCall("Volume.All", 1, hcloud.Error{Code: hcloud.ErrorCodeUnauthorized, Message: "unable to authenticate"})
+		}, []string{"token"}},
+		{"read-only token", "secret", func(m *mockClient, _ *hetznerDriver) {
+			m.failCall("Volume.Update", 1, readonly)
+		}, []string{"token permissions"}},
+		{"refused change", "secret", func(m *mockClient, hd *hetznerDriver) {
+			m.failCall("Volume.ChangeProtection", 1, readonly)
+			_ = hd.setProtection(m.addVolume("foo", "fsn1", nil), true)
+		}, []string{"token permissions"}},
+		{"refused change then allowed", "secret", func(m *mockClient, hd *hetznerDriver) {
+			m.failCall("Volume.ChangeProtection", 1, readonly)
+			vol := m.addVolume("foo", "fsn1", nil)
+			_ = hd.setProtection(vol, true)
+			_ = hd.setProtection(vol, true)
+		}, nil},
+		{"unknown server", "secret", func(m *mockClient, _ *hetznerDriver) {
+			delete(m.servers, 1)
+		}, []string{"server"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("apikey", tt.apikey)
+			t.Setenv("fstype", "ext4")
+			t.Setenv("detach_policy", "")
+
+			m := newMockClient()
+			hd := &hetznerDriver{client: m, preflightState: &preflightState{}}
+			if tt.setup != nil {
+				tt.setup(m, hd)
+			}
+
+			r := hd.preflight()
+			var fatal []string
+			for _, c := range r.Checks {
+				// the tools depend on the machine running the tests
+				if c.Fatal && c.Name != "mkfs" && c.Name != "devices" {
+					fatal = append(fatal, c.Name)
+				}
+			}
+			if strings.Join(fatal, ",") != strings.Join(tt.wantFatal, ",") {
+				t.Errorf("fatal checks = %v, want %v", fatal, tt.wantFatal)
+			}
+		})
+	}
+}
+
+func Test_hetznerDriver_checkPreflight(t *testing.T) {
+	t.Setenv("use_protection", "false")
+	t.Setenv("apikey", "secret")
+	t.Setenv("fstype", "ext4")
+	if _, err := os.Stat("/sbin/mkfs.ext4"); err != nil {
+		t.Skip("mkfs.ext4 not available")
+	}
+
+	m := newMockClient()
+	m.addVolume("foo", "fsn1", nil)
+	hd := &hetznerDriver{client: m, preflightState: &preflightState{}}
+
+	failed := &preflightReport{Time: time.Now()}
+	failed.fail("token", "listing volumes: temporary failure")
+	hd.preflightState.report = failed
+
+	misconfigured := func(err error) bool { return err != nil && strings.Contains(err.Error(), "plugin misconfigured") }
+
+	// changes are refused
+	if err := hd.Create(&volume.CreateRequest{Name: "bar"}); !misconfigured(err) {
+		t.Errorf("hetznerDriver.Create() error = %v, want misconfiguration", err)
+	}
+	if _, err := hd.Mount(&volume.MountRequest{Name: "foo", ID: "some-id"}); !misconfigured(err) {
+		t.Errorf("hetznerDriver.Mount() error = %v, want misconfiguration", err)
+	}
+	if err := hd.Remove(&volume.RemoveRequest{Name: "foo"}); !misconfigured(err) {
+		t.Errorf("hetznerDriver.Remove() error = %v, want misconfiguration", err)
+	}
+
+	// but volumes can still be looked at and released
+	if _, err := hd.List(); err != nil {
+		t.Errorf("hetznerDriver.List() error = %v", err)
+	}
+	if _, err := hd.Get(&volume.GetRequest{Name: "foo"}); err != nil {
+		t.Errorf("hetznerDriver.Get() error = %v", err)
+	}
+	if err := hd.Unmount(&volume.UnmountRequest{Name: "foo", ID: "some-id"}); misconfigured(err) {
+		t.Errorf("hetznerDriver.Unmount() error = %v, want no misconfiguration", err)
+	}
+
+	// re-run once the failure is old enough, and found to be transient
+	failed.Time = time.Now().Add(-2 * preflightRetryInterval)
+	if err := hd.checkPreflight(); err != nil && strings.Contains(err.Error(), "token") {
+		t.Errorf("hetznerDriver.checkPreflight() error = %v, want token check to pass", err)
+	}
+	if hd.preflightState.report == failed {
+		t.Error("failed preflight not re-run")
+	}
+}
+
+func Test_hetznerDriver_checkPreflight_permissions(t *testing.T) {
+	t.Setenv("apikey", "secret")
+	t.Setenv("fstype", "ext4")
+	if _, err := os.Stat("/sbin/mkfs.ext4"); err != nil {
+		t.Skip("mkfs.ext4 not available")
+	}
+
+	m := newMockClient()
+	vol := m.addVolume("foo", "fsn1", nil)
+	hd := &hetznerDriver{client: m, preflightState: &preflightState{}}
+	if err := hd.runPreflight().err(); err != nil && strings.Contains(err.Error(), "token") {
+		t.Fatalf("preflight error = %v", err)
+	}
+
+	// a change refused after a passing preflight gates the next requests
+	m.failCall("Volume.ChangeProtection", 1, hcloud.Error{Code: hcloud.ErrorCodeForbidden, Message: "insufficient permissions"})
+	if err := hd.setProtection(vol, true); err == nil {
+		t.Fatal("hetznerDriver.setProtection() succeeded despite refusal")
+	}
+	if err := hd.checkPreflight(); err == nil || !strings.Contains(err.Error(), "token permissions") {
+		t.Errorf("hetznerDriver.checkPreflight() error = %v, want token permissions", err)
+	}
+
+	// until a change succeeds again
+	if err := hd.setProtection(vol, true); err != nil {
+		t.Fatalf("hetznerDriver.setProtection() error = %v", err)
+	}
+	if err := hd.checkPreflight(); err != nil && strings.Contains(err.Error(), "token") {
+		t.Errorf("hetznerDriver.checkPreflight() error = %v, want token checks to pass", err)
+	}
+}
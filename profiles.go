@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"github.com/sirupsen/logrus"
+)
+
+// volumeProfile bundles options for volumes selected with the "profile" option. Unset fields fall back to the
+// plugin settings.
+type volumeProfile struct {
+	Size              profileValue      `json:"size,omitempty"`
+	Fstype            profileValue      `json:"fstype,omitempty"`
+	UID               profileValue      `json:"uid,omitempty"`
+	GID               profileValue      `json:"gid,omitempty"`
+	MountOptions      profileValue      `json:"mount_options,omitempty"`
+	Readonly          profileValue      `json:"readonly,omitempty"`
+	AutogrowThreshold profileValue      `json:"autogrow_threshold,omitempty"`
+	AutogrowStep      profileValue      `json:"autogrow_step,omitempty"`
+	AutogrowMax       profileValue      `json:"autogrow_max,omitempty"`
+	Trim              profileValue      `json:"trim,omitempty"`
+	Labels            map[string]string `json:"labels,omitempty"`
+	Protection        *bool             `json:"protection,omitempty"`
+}
+
+// profileValue is an option value which may be given as JSON string, number or boolean
+type profileValue string
+
+func (v *profileValue) UnmarshalJSON(b []byte) error {
+	if s := string(b); s == "true" || s == "false" {
+		*v = profileValue(s)
+		return nil
+	}
+	if len(b) > 0 && b[0] == '"' {
+		var s string
+		if err := json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+		*v = profileValue(s)
+		return nil
+	}
+
+	var n json.Number
+	if err := json.Unmarshal(b, &n); err != nil {
+		return fmt.Errorf("expected string, number or boolean, got %s", b)
+	}
+	*v = profileValue(n)
+	return nil
+}
+
+// option returns the profile's value for the given option key, if set
+func (p *volumeProfile) option(k string) (string, bool) {
+	var v profileValue
+	switch k {
+	case "size":
+		v = p.Size
+	case "fstype":
+		v = p.Fstype
+	case "uid":
+		v = p.UID
+	case "gid":
+		v = p.GID
+	case "mount_options":
+		v = p.MountOptions
+	case "readonly":
+		v = p.Readonly
+	case "autogrow_threshold":
+		v = p.AutogrowThreshold
+	case "autogrow_step":
+		v = p.AutogrowStep
+	case "autogrow_max":
+		v = p.AutogrowMax
+	case "trim":
+		v = p.Trim
+	}
+	return string(v), v != ""
+}
+
+// profileSource identifies the profile configuration a cached result was parsed from
+type profileSource struct {
+	path    string
+	modTime time.Time
+	size    int64
+	value   string
+}
+
+// profileCache keeps the last parsed profiles, since options are looked up in them many times per request
+var profileCache struct {
+	mu       sync.Mutex
+	source   profileSource
+	loaded   bool
+	profiles map[string]*volumeProfile
+	err      error
+	// problems already logged for this source
+	warned map[string]bool
+}
+
+// loadProfiles returns the profiles configured in the file given by profiles_file and in the JSON value of profiles,
+// the latter taking precedence for profiles defined in both. They are only parsed again once either changes.
+func loadProfiles() (map[string]*volumeProfile, error) {
+	src := profileSource{path: os.Getenv("profiles_file"), value: os.Getenv("profiles")}
+	if src.path != "" {
+		fi, err := os.Stat(src.path)
+		if err != nil {
+			return nil, fmt.Errorf("reading profiles file: %w", err)
+		}
+		src.modTime, src.size = fi.ModTime(), fi.Size()
+	}
+
+	profileCache.mu.Lock()
+	defer profileCache.mu.Unlock()
+
+	if !profileCache.loaded || profileCache.source != src {
+		profileCache.profiles, profileCache.err = parseProfiles(src)
+		profileCache.source, profileCache.loaded = src, true
+		profileCache.warned = map[string]bool{}
+	}
+	return profileCache.profiles, profileCache.err
+}
+
+// warnProfileOnce logs a problem with the profile configuration, unless already logged since it last changed
+func warnProfileOnce(err error) {
+	profileCache.mu.Lock()
+	defer profileCache.mu.Unlock()
+
+	if profileCache.warned[err.Error()] {
+		return
+	}
+	if profileCache.warned == nil {
+		profileCache.warned = map[string]bool{}
+	}
+	profileCache.warned[err.Error()] = true
+	logrus.Warnf("ignoring profile: %v", err)
+}
+
+func parseProfiles(src profileSource) (map[string]*volumeProfile, error) {
+	profiles := map[string]*volumeProfile{}
+
+	if path := src.path; path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading profiles file: %w", err)
+		}
+		if err := decodeProfiles(b, profiles); err != nil {
+			return nil, fmt.Errorf("parsing profiles file %q: %w", path, err)
+		}
+	}
+
+	if v := src.value; v != "" {
+		if err := decodeProfiles([]byte(v), profiles); err != nil {
+			return nil, fmt.Errorf("parsing profiles setting: %w", err)
+		}
+	}
+
+	return profiles, nil
+}
+
+func decodeProfiles(b []byte, profiles map[string]*volumeProfile) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+
+	var decoded map[string]*volumeProfile
+	if err := dec.Decode(&decoded); err != nil {
+		return err
+	}
+	for name, p := range decoded {
+		if p == nil {
+			return fmt.Errorf("profile %q is empty", name)
+		}
+		if err := validateProfileLabels(p.Labels); err != nil {
+			return fmt.Errorf("profile %q: %w", name, err)
+		}
+		profiles[name] = p
+	}
+	return nil
+}
+
+// validateProfileLabels rejects labels the API wouldn't accept, or that would clash with the ones the plugin sets
+func validateProfileLabels(labels map[string]string) error {
+	values := make(map[string]interface{}, len(labels))
+	for k, v := range labels {
+		if k == pluginLabel || strings.HasPrefix(k, pluginLabel+".") {
+			return fmt.Errorf("label %q is reserved for the plugin", k)
+		}
+		values[k] = v
+	}
+	if ok, err := hcloud.ValidateResourceLabels(values); !ok {
+		return fmt.Errorf("invalid labels: %w", err)
+	}
+	return nil
+}
+
+// getProfile returns the profile selected in opts, or nil if none is selected
+func getProfile(opts map[string]string) (*volumeProfile, error) {
+	name, ok := opts["profile"]
+	if !ok {
+		return nil, nil
+	}
+
+	profiles, err := loadProfiles()
+	if err != nil {
+		return nil, err
+	}
+
+	p, ok := profiles[name]
+	if !ok {
+		names := make([]string, 0, len(profiles))
+		for n := range profiles {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown profile %q; configured profiles: %v", name, names)
+	}
+	return p, nil
+}
+
+// profileOption looks up k in the profile selected in opts. Broken profile configuration is reported by
+// validateOptions, so lookups only log it.
+func profileOption(k string, opts map[string]string) (string, bool) {
+	p, err := getProfile(opts)
+	if err != nil {
+		warnProfileOnce(err)
+		return "", false
+	}
+	if p == nil {
+		return "", false
+	}
+	return p.option(k)
+}
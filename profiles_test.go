@@ -0,0 +1,168 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+func Test_loadProfiles(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "profiles.json")
+	if err := os.WriteFile(file, []byte(`{"db": {"size": "100G", "fstype": "xfs"}, "web": {"size": 20}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		file     string
+		env      string
+		wantErr  bool
+		wantSize map[string]string
+	}{
+		{"none", "", "", false, map[string]string{}},
+		{"file", file, "", false, map[string]string{"db": "100G", "web": "20"}},
+		{"env overrides file", file, `{"db": {"size": 200}}`, false, map[string]string{"db": "200", "web": "20"}},
+		{"missing file", filepath.Join(t.TempDir(), "missing.json"), "", true, nil},
+		{"invalid JSON", "", `{"db": `, true, nil},
+		{"unknown field", "", `{"db": {"sise": "100G"}}`, true, nil},
+		{"empty profile", "", `{"db": null}`, true, nil},
+		{"invalid label", "", `{"db": {"labels": {"team": "data science"}}}`, true, nil},
+		{"reserved label", "", `{"db": {"labels": {"docker-volume-hetzner.readonly": "false"}}}`, true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("profiles_file", tt.file)
+			t.Setenv("profiles", tt.env)
+
+			got, err := loadProfiles()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadProfiles() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if len(got) != len(tt.wantSize) {
+				t.Errorf("loadProfiles() returned %d profiles, want %d", len(got), len(tt.wantSize))
+			}
+			for name, size := range tt.wantSize {
+				if p, ok := got[name]; !ok || string(p.Size) != size {
+					t.Errorf("loadProfiles()[%q] = %+v, want size %q", name, p, size)
+				}
+			}
+		})
+	}
+}
+
+func Test_loadProfiles_cache(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "profiles.json")
+	if err := os.WriteFile(file, []byte(`{"db": {"size": 100}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("profiles_file", file)
+	t.Setenv("profiles", "")
+
+	first, err := loadProfiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := loadProfiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first["db"] != again["db"] {
+		t.Error("unchanged profiles parsed again")
+	}
+
+	if err := os.WriteFile(file, []byte(`{"db": {"size": 200}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(file, time.Now(), time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	changed, err := loadProfiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(changed["db"].Size) != "200" {
+		t.Errorf("size after changing profiles file = %q, want 200", changed["db"].Size)
+	}
+}
+
+func Test_getOption_profile(t *testing.T) {
+	t.Setenv("profiles_file", "")
+	t.Setenv("profiles", `{"db": {"size": "100G", "uid": 999}}`)
+
+	tests := []struct {
+		name string
+		k    string
+		opts map[string]string
+		want string
+	}{
+		{"profile", "size", map[string]string{"profile": "db"}, "100G"},
+		{"numeric profile value", "uid", map[string]string{"profile": "db"}, "999"},
+		{"option overrides profile", "size", map[string]string{"profile": "db", "size": "50"}, "50"},
+		{"env fallback", "fstype", map[string]string{"profile": "db"}, "ext4"},
+		{"unknown profile", "size", map[string]string{"profile": "nope"}, "10"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := getOption(tt.k, tt.opts); got != tt.want {
+				t.Errorf("getOption() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_hetznerDriver_Create_profile(t *testing.T) {
+	t.Setenv("use_protection", "false")
+	t.Setenv("profiles_file", "")
+	t.Setenv("profiles", `{"db": {
+		"size": "100G",
+		"fstype": "xfs",
+		"mount_options": "noatime",
+		"labels": {"team": "db"},
+		"protection": true
+	}}`)
+
+	f := newFakeAPI(t)
+	hd := f.driver()
+
+	if err := hd.Create(&volume.CreateRequest{Name: "nope", Options: map[string]string{"profile": "unknown"}}); err == nil {
+		t.Error("hetznerDriver.Create() succeeded with unknown profile")
+	}
+	if got := f.mutations(); len(got) != 0 {
+		t.Fatalf("API mutations = %v, want none", got)
+	}
+
+	if err := hd.Create(&volume.CreateRequest{Name: "foo", Options: map[string]string{"profile": "db"}}); err != nil {
+		t.Fatalf("hetznerDriver.Create() error = %v", err)
+	}
+
+	vol := f.volumeByName(prefixName("foo"))
+	if vol == nil {
+		t.Fatalf("volume %q not created", prefixName("foo"))
+	}
+	if vol.Size != 100 {
+		t.Errorf("created volume size = %d, want 100", vol.Size)
+	}
+	if vol.Format == nil || *vol.Format != "xfs" {
+		t.Errorf("created volume format = %v, want xfs", vol.Format)
+	}
+	if vol.Labels["team"] != "db" {
+		t.Errorf("created volume labels = %v, want profile label", vol.Labels)
+	}
+	if got, _ := getLabelString(vol.Labels, mountOptionsLabel); got != "noatime" {
+		t.Errorf("created volume mount options = %q, want %q", got, "noatime")
+	}
+	if !vol.Protection.Delete {
+		t.Error("created volume not protected")
+	}
+
+	// protection requested by the profile is lifted on removal, even with use_protection disabled
+	if err := hd.Remove(&volume.RemoveRequest{Name: "foo"}); err != nil {
+		t.Errorf("hetznerDriver.Remove() error = %v", err)
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"github.com/sirupsen/logrus"
+)
+
+// volumeSetup describes how a volume is initialized once it's first attached
+type volumeSetup struct {
+	fstype  string
+	uid     string
+	gid     string
+	source  string
+	protect bool
+	// location explicitly chosen for the volume, which it must not be moved out of
+	location string
+}
+
+func setupFromOptions(opts map[string]string, protect bool) volumeSetup {
+	return volumeSetup{
+		fstype:   getOption("fstype", opts),
+		uid:      getOption("uid", opts),
+		gid:      getOption("gid", opts),
+		source:   getOption("source", opts),
+		protect:  protect,
+		location: getOption("location", opts),
+	}
+}
+
+// setupFromLabels returns the setup recorded with setLabels
+func setupFromLabels(labels map[string]string) volumeSetup {
+	s := volumeSetup{uid: "0", gid: "0"}
+	if v, ok := getLabelString(labels, setupLabelPrefix+"fstype"); ok {
+		s.fstype = v
+	}
+	if v, ok := getLabelString(labels, setupLabelPrefix+"uid"); ok {
+		s.uid = v
+	}
+	if v, ok := getLabelString(labels, setupLabelPrefix+"gid"); ok {
+		s.gid = v
+	}
+	s.source, _ = getLabelString(labels, setupLabelPrefix+"source")
+	s.location, _ = getLabelString(labels, setupLabelPrefix+"location")
+	s.protect = labels[setupLabelPrefix+"protect"] == "true"
+	return s
+}
+
+// setLabels records the setup in labels, for volumes provisioned lazily
+func (s volumeSetup) setLabels(labels map[string]string) {
+	setLabelString(labels, setupLabelPrefix+"fstype", s.fstype)
+	setLabelString(labels, setupLabelPrefix+"uid", s.uid)
+	setLabelString(labels, setupLabelPrefix+"gid", s.gid)
+	if s.source != "" {
+		setLabelString(labels, setupLabelPrefix+"source", s.source)
+	}
+	if s.protect {
+		labels[setupLabelPrefix+"protect"] = "true"
+	}
+	if s.location != "" {
+		setLabelString(labels, setupLabelPrefix+"location", s.location)
+	}
+}
+
+// steps of provisionVolume, recorded on incomplete volumes
+const (
+	stepDetach     = "detach"
+	stepRelocate   = "relocate"
+	stepAttach     = "attach"
+	stepInitialize = "initialize"
+	stepFinalize   = "finalize"
+)
+
+// provisionError is returned by provisionVolume, naming the step which failed
+type provisionError struct {
+	step string
+	err  error
+}
+
+func (e *provisionError) Error() string {
+	return e.err.Error()
+}
+
+func (e *provisionError) Unwrap() error {
+	return e.err
+}
+
+// needsProvisioning reports whether the volume still has to be attached and initialized before use
+func needsProvisioning(vol *hcloud.Volume) bool {
+	switch vol.Labels[stateLabel] {
+	case statePending, stateIncomplete:
+		return true
+	}
+	return false
+}
+
+// relocatable reports whether the volume can still be moved to another location by re-creating it. Only pending volumes
+// qualify: incomplete ones may already have been formatted and populated.
+func relocatable(vol *hcloud.Volume) bool {
+	return vol.Labels[stateLabel] == statePending
+}
+
+func keepIncomplete() bool {
+	return os.Getenv("keep_incomplete") == "true"
+}
+
+func lazyProvisioning(opts map[string]string) bool {
+	return getOption("lazy", opts) == "true"
+}
+
+// initializeVolume formats, chowns and populates a freshly attached volume, as far as needed
+func (hd *hetznerDriver) initializeVolume(vol *hcloud.Volume, srv *hcloud.Server, setup volumeSetup) error {
+	if vol.Format == nil || setup.uid != "0" || setup.gid != "0" || setup.source != "" {
+		logrus.Infof("waiting for device %q", vol.LinuxDevice)
+		if err := waitForDevice(vol.LinuxDevice, vol.ID, deviceTimeout()); err != nil {
+			return fmt.Errorf("waiting for device of volume %q: %w", vol.Name, err)
+		}
+	}
+
+	if vol.Format == nil {
+		logrus.Infof("formatting %q as %q", vol.Name, setup.fstype)
+		if err := mkfs(vol.LinuxDevice, setup.fstype); err != nil {
+			return fmt.Errorf("mkfs on %q: %w", vol.LinuxDevice, err)
+		}
+	}
+
+	if setup.uid != "0" || setup.gid != "0" {
+		// string to int
+		uintParsed, err := strconv.Atoi(setup.uid)
+		if err != nil {
+			return fmt.Errorf("parsing uid option value as integer: %s: %w", setup.uid, err)
+		}
+		gidParsed, err := strconv.Atoi(setup.gid)
+		if err != nil {
+			return fmt.Errorf("parsing gid option value as integer: %s: %w", setup.gid, err)
+		}
+
+		if err := setPermissions(vol.LinuxDevice, setup.fstype, uintParsed, gidParsed); err != nil {
+			return fmt.Errorf("chown %q to '%s:%s': %w", vol.LinuxDevice, setup.uid, setup.gid, err)
+		}
+	}
+
+	if setup.source != "" {
+		logrus.Infof("populating %q from %q", vol.Name, setup.source)
+		if err := hd.populateVolume(vol.LinuxDevice, setup.fstype, setup.source, srv); err != nil {
+			return fmt.Errorf("populating volume %q from %q: %w", vol.Name, setup.source, err)
+		}
+	}
+
+	return nil
+}
+
+// provisionVolume finishes setting up a lazily created or incomplete volume on srv: it moves a pending volume to the
+// server's location if needed, attaches and initializes it, and finally clears its state. Failures are returned as
+// provisionError and leave the state as is, so the next attempt resumes; incomplete volumes which only failed to be
+// finalized aren't initialized again.
+func (hd *hetznerDriver) provisionVolume(vol *hcloud.Volume, srv *hcloud.Server) (*hcloud.Volume, error) {
+	setup := setupFromLabels(vol.Labels)
+
+	if err := checkAttachLocation(vol, srv); err != nil {
+		return nil, &provisionError{stepRelocate, err}
+	}
+
+	if vol.Server != nil && vol.Server.ID != 0 && vol.Server.ID != srv.ID {
+		logrus.Infof("detaching volume %q from server %d", vol.Name, vol.Server.ID)
+		if err := hd.detachVolume(vol); err != nil {
+			return nil, &provisionError{stepDetach, err}
+		}
+		vol.Server = nil
+	}
+
+	if loc := serverLocation(srv); vol.Location == nil || vol.Location.Name != loc.Name {
+		relocated, err := hd.relocateVolume(vol, loc)
+		if err != nil {
+			return nil, &provisionError{stepRelocate, err}
+		}
+		vol = relocated
+	}
+
+	if vol.Server == nil || vol.Server.ID != srv.ID {
+		logrus.Infof("attaching volume %q to %q", vol.Name, srv.Name)
+		if err := hd.attachVolume(vol, srv); err != nil {
+			return nil, &provisionError{stepAttach, err}
+		}
+		vol.Server = srv
+	}
+
+	if setup.protect {
+		// as on creation, be optimistic and ignore errors here
+		if err := hd.setProtection(vol, true); err != nil {
+			logrus.Warnf("protecting volume %q: %v", vol.Name, err)
+		}
+	}
+
+	if vol.Labels[stepLabel] != stepFinalize {
+		if err := hd.initializeVolume(vol, srv, setup); err != nil {
+			return nil, &provisionError{stepInitialize, err}
+		}
+	}
+
+	labels := make(map[string]string, len(vol.Labels))
+	for k, v := range vol.Labels {
+		if k != stateLabel && k != stepLabel && !strings.HasPrefix(k, setupLabelPrefix) {
+			labels[k] = v
+		}
+	}
+	updated, err := hd.updateVolume(vol, hcloud.VolumeUpdateOpts{Labels: labels})
+	if err != nil {
+		return nil, &provisionError{stepFinalize, fmt.Errorf("clearing state of volume %q: %w", vol.Name, err)}
+	}
+	vol.Labels = updated.Labels
+
+	logrus.Infof("volume %q provisioned on %q", vol.Name, srv.Name)
+
+	return vol, nil
+}
+
+// relocateVolume moves a volume nothing has been written to yet into loc by re-creating it there. The replacement is
+// created before the original is deleted, so a failure leaves the original volume in place under its own name.
+func (hd *hetznerDriver) relocateVolume(vol *hcloud.Volume, loc *hcloud.Location) (*hcloud.Volume, error) {
+	logrus.Infof("re-creating volume %q in location %q", vol.Name, loc.Name)
+
+	// volume names are unique, so the original has to make room for its replacement first
+	original, err := hd.updateVolume(vol, hcloud.VolumeUpdateOpts{Name: relocatingName(vol.Name)})
+	if err != nil {
+		return nil, fmt.Errorf("renaming volume %q: %w", vol.Name, err)
+	}
+
+	created, err := hd.createVolume(hcloud.VolumeCreateOpts{
+		Name:     vol.Name,
+		Size:     vol.Size,
+		Location: loc,
+		Labels:   vol.Labels,
+		Format:   vol.Format,
+	})
+	if err != nil {
+		if _, rerr := hd.updateVolume(original, hcloud.VolumeUpdateOpts{Name: vol.Name}); rerr != nil {
+			return nil, fmt.Errorf("re-creating volume in %q: %w; restoring name of %q: %v", loc.Name, err, original.Name, rerr)
+		}
+		return nil, fmt.Errorf("re-creating volume in %q: %w", loc.Name, err)
+	}
+
+	// an earlier attempt may already have protected the original
+	if original.Protection.Delete {
+		if err := hd.setProtection(original, false); err != nil {
+			logrus.Warnf("left volume %q behind after relocating %q: %v", original.Name, vol.Name, err)
+			return created, nil
+		}
+	}
+	if err := hd.deleteVolume(original); err != nil {
+		logrus.Warnf("left volume %q behind after relocating %q: %v", original.Name, vol.Name, err)
+	}
+	return created, nil
+}
+
+// relocatingName is the name a volume is parked under while being re-created in another location
+func relocatingName(name string) string {
+	const suffix = "-relocating"
+	if len(name)+len(suffix) > volumeNameMaxLen {
+		name = name[:volumeNameMaxLen-len(suffix)]
+	}
+	return name + suffix
+}
+
+// finishCreate provisions a volume created incomplete on srv. If that fails, the volume is deleted again or, with
+// keep_incomplete, marked with the failed step for the next create to resume from.
+func (hd *hetznerDriver) finishCreate(vol *hcloud.Volume, srv *hcloud.Server) error {
+	// like mounts, provisioning attaches volumes the idle detacher mustn't take away meanwhile
+	hd.mountMu.RLock()
+	_, err := hd.provisionVolume(vol, srv)
+	hd.mountMu.RUnlock()
+	if err == nil {
+		return nil
+	}
+
+	step := stepFinalize
+	var perr *provisionError
+	if errors.As(err, &perr) {
+		step = perr.step
+	}
+
+	if keepIncomplete() {
+		if merr := hd.markIncomplete(vol.Name, step); merr != nil {
+			return fmt.Errorf("creating volume %q failed at step %s: %w; marking it incomplete: %v", vol.Name, step, err, merr)
+		}
+		return fmt.Errorf("creating volume %q failed at step %s: %w; kept incomplete to be resumed by the next create", vol.Name, step, err)
+	}
+
+	if rerr := hd.rollbackCreate(vol.Name); rerr != nil {
+		// at least let the next create resume it
+		if merr := hd.markIncomplete(vol.Name, step); merr != nil {
+			logrus.Warnf("marking volume %q incomplete: %v", vol.Name, merr)
+		}
+		return fmt.Errorf("creating volume %q failed at step %s: %w; rolling back: %v", vol.Name, step, err, rerr)
+	}
+	return fmt.Errorf("creating volume %q failed at step %s: %w; rolled back", vol.Name, step, err)
+}
+
+// markIncomplete records the step the creation of the given volume failed at
+func (hd *hetznerDriver) markIncomplete(name, step string) error {
+	vol, _, err := hd.client.Volume().GetByName(context.Background(), name)
+	if err != nil {
+		return fmt.Errorf("getting cloud volume %q: %w", name, err)
+	}
+	if vol == nil {
+		return fmt.Errorf("cloud volume %q not found", name)
+	}
+
+	labels := make(map[string]string, len(vol.Labels)+2)
+	for k, v := range vol.Labels {
+		labels[k] = v
+	}
+	labels[stateLabel] = stateIncomplete
+	labels[stepLabel] = step
+	if _, err := hd.updateVolume(vol, hcloud.VolumeUpdateOpts{Labels: labels}); err != nil {
+		return fmt.Errorf("updating labels of volume %q: %w", name, err)
+	}
+	return nil
+}
+
+// rollbackCreate removes what's left of a failed volume creation: it unprotects, detaches and deletes the volume
+func (hd *hetznerDriver) rollbackCreate(name string) error {
+	vol, _, err := hd.client.Volume().GetByName(context.Background(), name)
+	if err != nil {
+		return fmt.Errorf("getting cloud volume %q: %w", name, err)
+	}
+	if vol == nil {
+		return nil
+	}
+
+	logrus.Infof("rolling back creation of volume %q", name)
+	if vol.Protection.Delete {
+		if err := hd.setProtection(vol, false); err != nil {
+			return err
+		}
+	}
+	if vol.Server != nil && vol.Server.ID != 0 {
+		if err := hd.detachVolume(vol); err != nil {
+			return err
+		}
+	}
+	return hd.deleteVolume(vol)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"github.com/sirupsen/logrus"
+)
+
+// bounds for volume sizes imposed by the API, in GB
+const (
+	apiMinSize = 10
+	apiMaxSize = 10240
+)
+
+var sizeRegexp = regexp.MustCompile(`^([0-9]+(?:\.[0-9]+)?)\s*([a-zA-Z]*)$`)
+
+// size units relative to the GB used by the API; decimal units scale by powers of 1000, binary ones by powers of 1024
+// bytes
+var sizeUnits = map[string]*big.Rat{
+	"":   big.NewRat(1, 1),
+	"k":  big.NewRat(1, 1000*1000),
+	"m":  big.NewRat(1, 1000),
+	"g":  big.NewRat(1, 1),
+	"t":  big.NewRat(1000, 1),
+	"p":  big.NewRat(1000*1000, 1),
+	"ki": big.NewRat(1<<10, 1000*1000*1000),
+	"mi": big.NewRat(1<<20, 1000*1000*1000),
+	"gi": big.NewRat(1<<30, 1000*1000*1000),
+	"ti": big.NewRat(1<<40, 1000*1000*1000),
+	"pi": big.NewRat(1<<50, 1000*1000*1000),
+}
+
+// parseSize converts a size with optional unit (e.g. "20", "20G", "1.5TB" or "512Mi") to whole GB, rounding up. Sizes
+// without unit are taken as GB.
+func parseSize(s string) (int, error) {
+	match := sizeRegexp.FindStringSubmatch(strings.TrimSpace(s))
+	if match == nil {
+		return 0, fmt.Errorf("invalid size %q: expected a number with optional unit, e.g. 20G", s)
+	}
+
+	unit := strings.TrimSuffix(strings.ToLower(match[2]), "b")
+	factor, ok := sizeUnits[unit]
+	if !ok {
+		return 0, fmt.Errorf("invalid size %q: unknown unit %q", s, match[2])
+	}
+
+	value, ok := new(big.Rat).SetString(match[1])
+	if !ok {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	value.Mul(value, factor)
+
+	gb, rem := new(big.Int).QuoRem(value.Num(), value.Denom(), new(big.Int))
+	if rem.Sign() != 0 {
+		gb.Add(gb, big.NewInt(1))
+		logrus.Warnf("size %q is not a whole number of GB; rounding up to %sGB", s, gb)
+	}
+	if !gb.IsInt64() || gb.Int64() > apiMaxSize {
+		return 0, fmt.Errorf("invalid size %q: above the maximum of %dGB", s, apiMaxSize)
+	}
+
+	return int(gb.Int64()), nil
+}
+
+// limitOption returns the value of the given limit setting, with 0 meaning unlimited
+func limitOption(name string) (int, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return 0, nil
+	}
+	limit, err := strconv.Atoi(v)
+	if err != nil || limit < 0 {
+		return 0, fmt.Errorf("invalid %s setting %q: must be a non-negative integer", name, v)
+	}
+	return limit, nil
+}
+
+// checkSizeLimits returns an error if the given size (in GB) is outside of the configured minimum and maximum
+func checkSizeLimits(name string, size int) error {
+	minSize, err := limitOption("min_size")
+	if err != nil {
+		return err
+	}
+	if minSize > 0 && size < minSize {
+		return fmt.Errorf("volume %q: size %dGB below configured minimum of %dGB", name, size, minSize)
+	}
+
+	maxSize, err := limitOption("max_size")
+	if err != nil {
+		return err
+	}
+	if maxSize > 0 && size > maxSize {
+		return fmt.Errorf("volume %q: size %dGB above configured maximum of %dGB", name, size, maxSize)
+	}
+
+	return nil
+}
+
+// labelledVolumes returns the cloud volumes carrying this plugin's label and prefix, leaving out volumes merely named
+// like them
+func (hd *hetznerDriver) labelledVolumes() ([]*hcloud.Volume, error) {
+	vols, err := hd.client.Volume().AllWithOpts(context.Background(), hcloud.VolumeListOpts{
+		ListOpts: hcloud.ListOpts{LabelSelector: pluginLabel},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("listing volumes: %w", err)
+	}
+
+	labelled := make([]*hcloud.Volume, 0, len(vols))
+	for _, vol := range vols {
+		if nameHasPrefix(vol.Name) {
+			labelled = append(labelled, vol)
+		}
+	}
+	return labelled, nil
+}
+
+// checkLimits returns an error if creating a volume of the given size (in GB) would exceed any of the configured limits.
+// Totals are computed over all volumes created by this plugin with its prefix.
+func (hd *hetznerDriver) checkLimits(name string, size int) error {
+	if size < apiMinSize || size > apiMaxSize {
+		return fmt.Errorf("volume %q: size %dGB outside of the supported range of %d-%dGB", name, size, apiMinSize, apiMaxSize)
+	}
+
+	return checkTotalLimits(name, size, func() ([]int, error) {
+		vols, err := hd.labelledVolumes()
+		if err != nil {
+			return nil, err
+		}
+		sizes := make([]int, 0, len(vols))
+		for _, vol := range vols {
+			sizes = append(sizes, vol.Size)
+		}
+		return sizes, nil
+	})
+}
+
+// createWithinLimits creates the volume unless that would exceed any of the configured limits. The check and the
+// creation happen under limitsMu, so concurrent creates can't both pass the totals check.
+func (hd *hetznerDriver) createWithinLimits(name string, opts hcloud.VolumeCreateOpts) (*hcloud.Volume, error) {
+	hd.limitsMu.Lock()
+	defer hd.limitsMu.Unlock()
+
+	if err := hd.checkLimits(name, opts.Size); err != nil {
+		return nil, err
+	}
+	return hd.createVolume(opts)
+}
+
+// checkTotalLimits returns an error if adding a volume of the given size (in GB) to the existing ones would exceed any
+// of the configured limits. The sizes of the existing volumes are only fetched if a total is limited.
+func checkTotalLimits(name string, size int, existing func() ([]int, error)) error {
+	if err := checkSizeLimits(name, size); err != nil {
+		return err
+	}
+
+	maxTotalSize, err := limitOption("max_total_size")
+	if err != nil {
+		return err
+	}
+	maxVolumes, err := limitOption("max_volumes")
+	if err != nil {
+		return err
+	}
+	if maxTotalSize == 0 && maxVolumes == 0 {
+		return nil
+	}
+
+	sizes, err := existing()
+	if err != nil {
+		return err
+	}
+
+	if maxVolumes > 0 && len(sizes)+1 > maxVolumes {
+		return fmt.Errorf("volume %q: would exceed the configured maximum of %d volumes for prefix %q", name, maxVolumes, os.Getenv("prefix"))
+	}
+
+	total := size
+	for _, s := range sizes {
+		total += s
+	}
+	if maxTotalSize > 0 && total > maxTotalSize {
+		return fmt.Errorf("volume %q: %dGB would bring the total for prefix %q to %dGB, above the configured maximum of %dGB",
+			name, size, os.Getenv("prefix"), total, maxTotalSize)
+	}
+
+	return nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+func Test_parseSize(t *testing.T) {
+	tests := []struct {
+		size    string
+		want    int
+		wantErr bool
+	}{
+		{"10", 10, false},
+		{"20G", 20, false},
+		{"20GB", 20, false},
+		{"20 gb", 20, false},
+		{"1T", 1000, false},
+		{"1.5T", 1500, false},
+		{"10240G", 10240, false},
+		{"512Mi", 1, false},
+		{"10.1", 11, false},
+		{"16Gi", 18, false},
+		{"1Ti", 1100, false},
+		{"20000M", 20, false},
+		{"11T", 0, true},
+		{"99999999999999999999999T", 0, true},
+		{"", 0, true},
+		{"-10", 0, true},
+		{"ten", 0, true},
+		{"10X", 0, true},
+		{"1.G", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.size, func(t *testing.T) {
+			got, err := parseSize(tt.size)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseSize() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseSize() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_hetznerDriver_checkLimits(t *testing.T) {
+	tests := []struct {
+		name     string
+		limits   map[string]string
+		existing []int
+		size     int
+		wantErr  bool
+	}{
+		{"no limits", nil, []int{100, 100}, 1000, false},
+		{"below minimum", map[string]string{"min_size": "20"}, nil, 10, true},
+		{"above maximum", map[string]string{"max_size": "50"}, nil, 100, true},
+		{"within size limits", map[string]string{"min_size": "10", "max_size": "50"}, nil, 50, false},
+		{"total within limit", map[string]string{"max_total_size": "100"}, []int{40, 40}, 20, false},
+		{"total above limit", map[string]string{"max_total_size": "100"}, []int{40, 40}, 30, true},
+		{"volume count within limit", map[string]string{"max_volumes": "3"}, []int{10, 10}, 10, false},
+		{"volume count above limit", map[string]string{"max_volumes": "2"}, []int{10, 10}, 10, true},
+		{"invalid limit", map[string]string{"max_size": "lots"}, nil, 10, true},
+		{"below API minimum", nil, nil, 9, true},
+		{"above API maximum", map[string]string{"max_size": "20000"}, nil, 10241, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, k := range []string{"min_size", "max_size", "max_total_size", "max_volumes"} {
+				t.Setenv(k, tt.limits[k])
+			}
+
+			m := newMockClient()
+			for i, size := range tt.existing {
+				m.addVolume(string(rune('a'+i)), "fsn1", nil).Size = size
+			}
+			// volumes outside the prefix do not count
+			unrelated := m.addVolume("unrelated", "fsn1", nil)
+			unrelated.Name, unrelated.Size = "unrelated", 1000
+			// nor do volumes merely named like ours
+			unlabelled := m.addVolume("unlabelled", "fsn1", nil)
+			unlabelled.Labels, unlabelled.Size = nil, 1000
+
+			hd := &hetznerDriver{client: m}
+			if err := hd.checkLimits("foo", tt.size); (err != nil) != tt.wantErr {
+				t.Errorf("hetznerDriver.checkLimits() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_hetznerDriver_Create_concurrentLimits(t *testing.T) {
+	t.Setenv("max_volumes", "1")
+
+	m := newMockClient()
+	hd := &hetznerDriver{client: m}
+	// the totals checked must still hold when the volume gets created
+	m.hookCall("Volume.Create", 1, func(*mockClient) {
+		if hd.limitsMu.TryLock() {
+			hd.limitsMu.Unlock()
+			t.Error("volume created without limitsMu held")
+		}
+	})
+
+	var wg sync.WaitGroup
+	for i := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_ = hd.Create(&volume.CreateRequest{Name: fmt.Sprintf("foo%d", i), Options: map[string]string{"lazy": "true"}})
+		}()
+	}
+	wg.Wait()
+
+	created := 0
+	for _, call := range m.getCalls() {
+		if strings.HasPrefix(call, "Volume.Create ") {
+			created++
+		}
+	}
+	if created != 1 {
+		t.Errorf("%d volumes created, want 1", created)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/pkg/mount"
+	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/hashicorp/go-multierror"
+	"github.com/sirupsen/logrus"
+)
+
+const defaultShutdownTimeout = 10 * time.Second
+
+var errShuttingDown = errors.New("plugin is shutting down")
+
+func shutdownTimeout() time.Duration {
+	d, err := time.ParseDuration(os.Getenv("shutdown_timeout"))
+	if err != nil || d <= 0 {
+		return defaultShutdownTimeout
+	}
+	return d
+}
+
+func releaseOnShutdown() bool {
+	return os.Getenv("release_on_shutdown") == "true"
+}
+
+// opTracker keeps count of running operations and refuses new ones once closed
+type opTracker struct {
+	mu     sync.Mutex
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// begin registers a new operation, which must be finished with end
+func (t *opTracker) begin() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return errShuttingDown
+	}
+	t.wg.Add(1)
+	return nil
+}
+
+func (t *opTracker) end() {
+	t.wg.Done()
+}
+
+// close refuses new operations and waits up to timeout for running ones, reporting whether they all finished
+func (t *opTracker) close(timeout time.Duration) bool {
+	t.mu.Lock()
+	t.closed = true
+	t.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// trackedDriver tracks requests to the driver, so they can be drained on shutdown. Requests changing volumes with
+// interrupted operations wait for those to be resumed first.
+type trackedDriver struct {
+	hd *hetznerDriver
+}
+
+func (d trackedDriver) Capabilities() *volume.CapabilitiesResponse {
+	return d.hd.Capabilities()
+}
+
+func (d trackedDriver) Create(req *volume.CreateRequest) error {
+	if err := d.hd.ops.begin(); err != nil {
+		return err
+	}
+	defer d.hd.ops.end()
+	d.hd.journal.waitResumed(req.Name)
+	return d.hd.Create(req)
+}
+
+func (d trackedDriver) List() (*volume.ListResponse, error) {
+	if err := d.hd.ops.begin(); err != nil {
+		return nil, err
+	}
+	defer d.hd.ops.end()
+	return d.hd.List()
+}
+
+func (d trackedDriver) Get(req *volume.GetRequest) (*volume.GetResponse, error) {
+	if err := d.hd.ops.begin(); err != nil {
+		return nil, err
+	}
+	defer d.hd.ops.end()
+	return d.hd.Get(req)
+}
+
+func (d trackedDriver) Remove(req *volume.RemoveRequest) error {
+	if err := d.hd.ops.begin(); err != nil {
+		return err
+	}
+	defer d.hd.ops.end()
+	d.hd.journal.waitResumed(req.Name)
+	return d.hd.Remove(req)
+}
+
+func (d trackedDriver) Path(req *volume.PathRequest) (*volume.PathResponse, error) {
+	if err := d.hd.ops.begin(); err != nil {
+		return nil, err
+	}
+	defer d.hd.ops.end()
+	return d.hd.Path(req)
+}
+
+func (d trackedDriver) Mount(req *volume.MountRequest) (*volume.MountResponse, error) {
+	if err := d.hd.ops.begin(); err != nil {
+		return nil, err
+	}
+	defer d.hd.ops.end()
+	d.hd.journal.waitResumed(req.Name)
+	return d.hd.Mount(req)
+}
+
+func (d trackedDriver) Unmount(req *volume.UnmountRequest) error {
+	if err := d.hd.ops.begin(); err != nil {
+		return err
+	}
+	defer d.hd.ops.end()
+	d.hd.journal.waitResumed(req.Name)
+	return d.hd.Unmount(req)
+}
+
+// shutdown refuses new requests and waits up to timeout for running ones. Those still running are left in the
+// journal, to be resumed on the next start. With release_on_shutdown, it then unmounts and detaches all volumes held by
+// the local server. Finally, it waits up to timeout for audit events still being delivered.
+func (hd *hetznerDriver) shutdown(timeout time.Duration) {
+	defer hd.events.flushOrWarn(timeout)
+
+	drained := hd.ops.close(timeout)
+	if !drained {
+		st := hd.journal.state()
+		logrus.Warnf("requests still running after %s; shutting down anyway, leaving %d operations and %d actions to resume on next start", timeout, len(st.Operations), len(st.Actions))
+	}
+
+	if !releaseOnShutdown() {
+		return
+	}
+	if !drained {
+		logrus.Warnf("not releasing volumes while requests are still running")
+		return
+	}
+	if err := hd.releaseAll(); err != nil {
+		logrus.Errorf("releasing volumes: %v", err)
+	}
+}
+
+// releaseAll unmounts all volumes mounted by the plugin, the pool last, and detaches all volumes attached to the local
+// server
+func (hd *hetznerDriver) releaseAll() error {
+	mounts, err := mount.GetMounts()
+	if err != nil {
+		return fmt.Errorf("getting local mounts: %w", err)
+	}
+
+	var mountpoints []string
+	poolMounted := false
+	for _, m := range mounts {
+		switch {
+		case m.Mountpoint == poolMountpoint():
+			poolMounted = true
+		case strings.HasPrefix(m.Mountpoint, propagatedMountPath+"/"):
+			mountpoints = append(mountpoints, m.Mountpoint)
+		}
+	}
+
+	var errs error
+	for _, mountpoint := range mountpoints {
+		logrus.Infof("unmounting %q", mountpoint)
+		if err := unmountVolume(mountpoint); err != nil {
+			errs = multierror.Append(errs, err)
+			continue
+		}
+		if err := os.Remove(mountpoint); err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("removing mountpoint %s: %w", mountpoint, err))
+		}
+	}
+	if poolMounted {
+		logrus.Infof("unmounting pool")
+		if err := unmountVolume(poolMountpoint()); err != nil {
+			errs = multierror.Append(errs, err)
+		}
+	}
+
+	vols, err := hd.unusedLocalVolumes()
+	if err != nil {
+		return multierror.Append(errs, err)
+	}
+	for _, vol := range vols {
+		logrus.Infof("detaching volume %q", vol.Name)
+		if err := hd.detachVolume(vol); err != nil {
+			errs = multierror.Append(errs, err)
+		}
+	}
+
+	return errs
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/pkg/mount"
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+func Test_opTracker(t *testing.T) {
+	var ops opTracker
+
+	if err := ops.begin(); err != nil {
+		t.Fatalf("opTracker.begin() error = %v", err)
+	}
+	if ops.close(10 * time.Millisecond) {
+		t.Error("opTracker.close() = true with operation running")
+	}
+	if err := ops.begin(); !errors.Is(err, errShuttingDown) {
+		t.Errorf("opTracker.begin() after close error = %v, want %v", err, errShuttingDown)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		ops.end()
+	}()
+	if !ops.close(time.Second) {
+		t.Error("opTracker.close() = false after operation finished")
+	}
+}
+
+func Test_trackedDriver_shutdown(t *testing.T) {
+	f := newFakeAPI(t)
+	hd := f.driver()
+	d := trackedDriver{hd}
+
+	if _, err := d.List(); err != nil {
+		t.Fatalf("trackedDriver.List() error = %v", err)
+	}
+	if !hd.ops.close(time.Second) {
+		t.Fatal("opTracker.close() = false without running requests")
+	}
+	if _, err := d.List(); !errors.Is(err, errShuttingDown) {
+		t.Errorf("trackedDriver.List() after shutdown error = %v, want %v", err, errShuttingDown)
+	}
+	if err := d.Create(&volume.CreateRequest{Name: "foo"}); !errors.Is(err, errShuttingDown) {
+		t.Errorf("trackedDriver.Create() after shutdown error = %v, want %v", err, errShuttingDown)
+	}
+	if got := f.mutations(); len(got) != 0 {
+		t.Errorf("API mutations = %v, want none", got)
+	}
+}
+
+func Test_loopHarness_releaseAll(t *testing.T) {
+	t.Setenv("use_protection", "false")
+	t.Setenv("detach_policy", "never")
+
+	h := newLoopHarness(t)
+	hd := h.driver()
+
+	for _, name := range []string{"foo", "bar", "baz"} {
+		if err := hd.Create(&volume.CreateRequest{Name: name}); err != nil {
+			t.Fatalf("hetznerDriver.Create(%q) error = %v", name, err)
+		}
+	}
+	var mountpoints []string
+	for _, name := range []string{"foo", "bar", "baz"} {
+		resp, err := hd.Mount(&volume.MountRequest{Name: name, ID: name + "-id"})
+		if err != nil {
+			t.Fatalf("hetznerDriver.Mount(%q) error = %v", name, err)
+		}
+		mountpoints = append(mountpoints, resp.Mountpoint)
+	}
+	t.Cleanup(func() {
+		for _, mountpoint := range mountpoints {
+			_ = mount.Unmount(mountpoint)
+		}
+	})
+	// unmounted, but left attached by the detach policy
+	if err := hd.Unmount(&volume.UnmountRequest{Name: "baz", ID: "baz-id"}); err != nil {
+		t.Fatalf("hetznerDriver.Unmount() error = %v", err)
+	}
+
+	if err := hd.releaseAll(); err != nil {
+		t.Fatalf("hetznerDriver.releaseAll() error = %v", err)
+	}
+
+	for _, mountpoint := range mountpoints {
+		if mounted, _ := mount.Mounted(mountpoint); mounted {
+			t.Errorf("%s still mounted", mountpoint)
+		}
+	}
+	for _, name := range []string{"foo", "bar", "baz"} {
+		if vol, _ := hd.getVolume(name); vol.Server != nil {
+			t.Errorf("volume %q still attached", name)
+		}
+	}
+}
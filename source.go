@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"github.com/sirupsen/logrus"
+)
+
+// how often to report progress while populating a volume
+const populateProgressInterval = 10 * time.Second
+
+const defaultSourceTimeout = time.Hour
+
+// sourceTimeout limits downloading an archive to populate a volume from, so a stalled server doesn't hang Create
+func sourceTimeout() time.Duration {
+	d, err := time.ParseDuration(os.Getenv("source_timeout"))
+	if err != nil || d <= 0 {
+		return defaultSourceTimeout
+	}
+	return d
+}
+
+// flags making tar keep ownership and extended attributes intact
+var tarPreserveFlags = []string{"--numeric-owner", "--xattrs", "--xattrs-include=*", "--acls"}
+
+// populateVolume fills the freshly created filesystem on dev with the contents of source, which may be a local or
+// HTTP(S) tar archive (optionally gzip or zstd compressed) or the name of another volume managed by this plugin.
+func (hd *hetznerDriver) populateVolume(dev, fstype, source string, srv *hcloud.Server) error {
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") || strings.HasPrefix(source, "/") {
+		archive, err := openArchive(source)
+		if err != nil {
+			return err
+		}
+		defer archive.Close()
+
+		return withTempMount(dev, fstype, "", func(dir string) error {
+			return extractArchive(dir, archive, archiveCompression(source), source)
+		})
+	}
+
+	return hd.copyFromVolume(dev, fstype, source, srv)
+}
+
+func openArchive(source string) (io.ReadCloser, error) {
+	if strings.HasPrefix(source, "/") {
+		f, err := os.Open(source)
+		if err != nil {
+			return nil, fmt.Errorf("opening archive: %w", err)
+		}
+		return f, nil
+	}
+
+	client := &http.Client{Timeout: sourceTimeout()}
+	resp, err := client.Get(source)
+	if err != nil {
+		return nil, fmt.Errorf("downloading archive: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("downloading archive: unexpected status %s", resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// archiveCompression returns the tar flag needed to decompress the given archive, if any
+func archiveCompression(source string) string {
+	switch {
+	case strings.HasSuffix(source, ".tar.zst"), strings.HasSuffix(source, ".tzst"):
+		return "--zstd"
+	case strings.HasSuffix(source, ".tar.gz"), strings.HasSuffix(source, ".tgz"):
+		return "--gzip"
+	default:
+		return ""
+	}
+}
+
+func extractArchive(dir string, archive io.Reader, compression, name string) error {
+	args := append([]string{"-x", "-p", "-C", dir, "-f", "-"}, tarPreserveFlags...)
+	if compression != "" {
+		args = append(args, compression)
+	}
+
+	progress := newProgressReader(archive, name)
+	defer progress.stop()
+
+	cmd := exec.Command("tar", args...)
+	cmd.Stdin = progress
+	if out, err := cmd.CombinedOutput(); err != nil {
+		logrus.Errorf("tar output: %s", out)
+		return fmt.Errorf("extracting archive: %w", err)
+	}
+
+	logrus.Infof("extracted %s from %q", formatBytes(progress.count.Load()), name)
+
+	return nil
+}
+
+// copyFromVolume copies the contents of another plugin volume onto dev. The source volume is temporarily attached to
+// the local server if needed, but is never taken away from another server. Like all provisioning, it runs with mountMu
+// read-locked.
+func (hd *hetznerDriver) copyFromVolume(dev, fstype, name string, srv *hcloud.Server) error {
+	vol, err := hd.getVolume(name)
+	if err != nil {
+		return err
+	}
+	if hd.waitForDetach(vol.Name) {
+		if vol, err = hd.getVolume(name); err != nil {
+			return err
+		}
+	}
+
+	if vol.Server != nil && vol.Server.ID != 0 && vol.Server.ID != srv.ID {
+		return fmt.Errorf("source volume %q is attached to another server (%d)", vol.Name, vol.Server.ID)
+	}
+
+	// an existing read-write mount of the same device would make a read-only one fail
+	mountOptions := ""
+	if vol.Server == nil || vol.Server.ID == 0 {
+		mountOptions = "ro"
+
+		logrus.Infof("attaching source volume %q to %q", vol.Name, srv.Name)
+		if err := hd.attachVolume(vol, srv); err != nil {
+			return fmt.Errorf("attaching source volume: %w", err)
+		}
+
+		defer func() {
+			// mounted for a container in the meantime
+			if !deviceUnused(vol.LinuxDevice) {
+				logrus.Infof("leaving source volume %q attached while in use", vol.Name)
+				return
+			}
+			logrus.Infof("detaching source volume %q", vol.Name)
+			if err := hd.detachVolume(vol); err != nil {
+				logrus.Errorf("detaching source volume: %v", err)
+			}
+		}()
+	}
+
+	if err := waitForDevice(vol.LinuxDevice, vol.ID, deviceTimeout()); err != nil {
+		return fmt.Errorf("waiting for device of source volume %q: %w", vol.Name, err)
+	}
+
+	return withTempMount(vol.LinuxDevice, "", mountOptions, func(srcDir string) error {
+		return withTempMount(dev, fstype, "", func(dstDir string) error {
+			return copyTree(srcDir, dstDir, vol.Name)
+		})
+	})
+}
+
+// copyTree copies src to dst by piping one tar into another, which keeps ownership and xattrs
+func copyTree(src, dst, name string) error {
+	pack := exec.Command("tar", append([]string{"-c", "-C", src, "-f", "-"}, append(tarPreserveFlags, ".")...)...)
+	var packErr strings.Builder
+	pack.Stderr = &packErr
+	stdout, err := pack.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := pack.Start(); err != nil {
+		return fmt.Errorf("starting tar: %w", err)
+	}
+
+	if err := extractArchive(dst, stdout, "", name); err != nil {
+		// nobody reads the pipe anymore, so the packing tar would block forever
+		_ = pack.Process.Kill()
+		_ = pack.Wait()
+		return err
+	}
+	// the extracting tar may stop before the zero blocks padding the archive
+	_, _ = io.Copy(io.Discard, stdout)
+	if err := pack.Wait(); err != nil {
+		logrus.Errorf("tar output: %s", packErr.String())
+		return fmt.Errorf("archiving source volume: %w", err)
+	}
+
+	return nil
+}
+
+// progressReader counts the bytes read through it and periodically logs them
+type progressReader struct {
+	r     io.Reader
+	count atomic.Int64
+	done  chan struct{}
+}
+
+func newProgressReader(r io.Reader, name string) *progressReader {
+	pr := &progressReader{r: r, done: make(chan struct{})}
+	go func() {
+		t := time.NewTicker(populateProgressInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				logrus.Infof("populating from %q: %s copied so far", name, formatBytes(pr.count.Load()))
+			case <-pr.done:
+				return
+			}
+		}
+	}()
+	return pr
+}
+
+func (pr *progressReader) Read(p []byte) (int, error) {
+	n, err := pr.r.Read(p)
+	pr.count.Add(int64(n))
+	return n, err
+}
+
+func (pr *progressReader) stop() {
+	close(pr.done)
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
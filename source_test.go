@@ -0,0 +1,147 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+func Test_archiveCompression(t *testing.T) {
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{"https://example.com/fixtures.tar", ""},
+		{"/data/fixtures.tar.gz", "--gzip"},
+		{"/data/fixtures.tgz", "--gzip"},
+		{"https://example.com/fixtures.tar.zst", "--zstd"},
+		{"/data/fixtures.tzst", "--zstd"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.source, func(t *testing.T) {
+			if got := archiveCompression(tt.source); got != tt.want {
+				t.Errorf("archiveCompression() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_copyTree(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	if err := os.MkdirAll(filepath.Join(src, "sub"), 0o750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "sub", "file"), []byte("content"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := copyTree(src, dst, "test"); err != nil {
+		t.Fatalf("copyTree() error = %v", err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(dst, "sub", "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "content" {
+		t.Errorf("copied file content = %q, want %q", got, "content")
+	}
+	if fi, err := os.Stat(filepath.Join(dst, "sub", "file")); err != nil || fi.Mode().Perm() != 0o640 {
+		t.Errorf("copied file mode = %v (%v), want %v", fi.Mode().Perm(), err, os.FileMode(0o640))
+	}
+}
+
+func Test_copyTree_extractFails(t *testing.T) {
+	src := t.TempDir()
+	// more than fits into a pipe, so packing blocks if nobody reads it
+	if err := os.WriteFile(filepath.Join(src, "file"), make([]byte, 1<<20), 0o640); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- copyTree(src, filepath.Join(t.TempDir(), "missing"), "test") }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("copyTree() into missing directory succeeded")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("copyTree() hangs after extracting failed")
+	}
+}
+
+func Test_openArchive_timeout(t *testing.T) {
+	t.Setenv("source_timeout", "100ms")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	archive, err := openArchive(srv.URL + "/fixtures.tar")
+	if err == nil {
+		archive.Close()
+		t.Fatal("openArchive() of stalled download succeeded")
+	}
+}
+
+func Test_loopHarness_copyFromVolume(t *testing.T) {
+	t.Setenv("use_protection", "false")
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	t.Setenv("audit_log", path)
+
+	h := newLoopHarness(t)
+	hd := h.driver()
+
+	if err := hd.Create(&volume.CreateRequest{Name: "bar"}); err != nil {
+		t.Fatalf("hetznerDriver.Create() error = %v", err)
+	}
+	resp, err := hd.Mount(&volume.MountRequest{Name: "bar", ID: "some-id"})
+	if err != nil {
+		t.Fatalf("hetznerDriver.Mount() error = %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(resp.Mountpoint, "data"), []byte("data"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := hd.Unmount(&volume.UnmountRequest{Name: "bar", ID: "some-id"}); err != nil {
+		t.Fatalf("hetznerDriver.Unmount() error = %v", err)
+	}
+
+	// the new volume and its source are attached with the idle detacher kept out
+	for n := 2; n <= 3; n++ {
+		h.mock.hookCall("Volume.Attach", n, func(*mockClient) {
+			if hd.mountMu.TryLock() {
+				hd.mountMu.Unlock()
+				t.Error("volume attached for provisioning without mountMu held")
+			}
+		})
+	}
+	if err := hd.Create(&volume.CreateRequest{Name: "foo", Options: map[string]string{"source": "bar"}}); err != nil {
+		t.Fatalf("hetznerDriver.Create() error = %v", err)
+	}
+
+	resp, err = hd.Mount(&volume.MountRequest{Name: "foo", ID: "other-id"})
+	if err != nil {
+		t.Fatalf("hetznerDriver.Mount() error = %v", err)
+	}
+	t.Cleanup(func() { _ = hd.Unmount(&volume.UnmountRequest{Name: "foo", ID: "other-id"}) })
+	if got, err := os.ReadFile(filepath.Join(resp.Mountpoint, "data")); err != nil || string(got) != "data" {
+		t.Errorf("copied data = %q, %v, want %q", got, err, "data")
+	}
+
+	var got []string
+	for _, e := range readAuditLog(t, path) {
+		if e.Volume == "bar" {
+			got = append(got, e.Event)
+		}
+	}
+	want := []string{auditCreated, auditAttached, auditMounted, auditUnmounted, auditDetached, auditAttached, auditDetached}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("audit events of source volume = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"os"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const defaultTrimInterval = 7 * 24 * time.Hour
+
+// how often the scheduler looks for volumes due to be trimmed
+const trimCheckInterval = time.Minute
+
+// trimInterval is how often each mounted volume is trimmed; 0 disables trimming
+func trimInterval() time.Duration {
+	v := os.Getenv("trim_interval")
+	if v == "" {
+		return defaultTrimInterval
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		logrus.Warnf("invalid trim_interval %q; using %s", v, defaultTrimInterval)
+		return defaultTrimInterval
+	}
+	return d
+}
+
+// nextTrim returns when the volume is to be trimmed next after the given time. Each volume is trimmed at a fixed
+// offset within every interval, derived from its name, to spread the trims of all volumes over the interval and keep
+// the schedule across restarts.
+func nextTrim(name string, after time.Time, interval time.Duration) time.Time {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(name))
+	offset := time.Duration(h.Sum64() % uint64(interval))
+
+	t := after.Truncate(interval).Add(offset)
+	if !t.After(after) {
+		t = t.Add(interval)
+	}
+	return t
+}
+
+// trimState holds when each mounted volume is due to be trimmed, and how much was trimmed since the plugin started
+type trimState struct {
+	mu      sync.Mutex
+	due     map[string]time.Time
+	trimmed map[string]uint64
+	last    map[string]time.Time
+}
+
+// dueVolumes returns the volumes due to be trimmed at the given time, out of the ones given, and schedules the next
+// trims. Volumes not given anymore are forgotten, to be rescheduled once mounted again.
+func (s *trimState) dueVolumes(names []string, now time.Time, interval time.Duration) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var due []string
+	next := make(map[string]time.Time, len(names))
+	for _, name := range names {
+		t, ok := s.due[name]
+		if !ok {
+			t = nextTrim(name, now, interval)
+		} else if !now.Before(t) {
+			due = append(due, name)
+			t = nextTrim(name, now, interval)
+		}
+		next[name] = t
+	}
+	s.due = next
+	return due
+}
+
+func (s *trimState) record(name string, trimmed uint64, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.trimmed == nil {
+		s.trimmed = map[string]uint64{}
+		s.last = map[string]time.Time{}
+	}
+	s.trimmed[name] += trimmed
+	s.last[name] = now
+}
+
+func (s *trimState) snapshot() (trimmed map[string]uint64, last map[string]time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	trimmed = make(map[string]uint64, len(s.trimmed))
+	for name, n := range s.trimmed {
+		trimmed[name] = n
+	}
+	last = make(map[string]time.Time, len(s.last))
+	for name, t := range s.last {
+		last[name] = t
+	}
+	return trimmed, last
+}
+
+// fstrimRange is struct fstrim_range from linux/fs.h
+type fstrimRange struct {
+	start  uint64
+	len    uint64
+	minLen uint64
+}
+
+// FITRIM is _IOWR('X', 121, struct fstrim_range), missing from x/sys/unix
+const fitrim = 0xc0185879
+
+// fstrim discards the unused blocks of the filesystem mounted on mountpoint, returning how many bytes were trimmed
+func fstrim(mountpoint string) (uint64, error) {
+	f, err := os.Open(mountpoint)
+	if err != nil {
+		return 0, fmt.Errorf("opening %s: %w", mountpoint, err)
+	}
+	defer f.Close()
+
+	r := fstrimRange{len: math.MaxUint64}
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), fitrim, uintptr(unsafe.Pointer(&r))); errno != 0 {
+		return 0, fmt.Errorf("trimming %s: %w", mountpoint, errno)
+	}
+	// the kernel reports the bytes trimmed in len
+	return r.len, nil
+}
+
+// trimVolumes trims the mounted volumes due at the given time, one after another. The volumes are the ones found mounted
+// by the last usage check, as long as they still are. Read-only volumes and volumes created with trim set to false are
+// skipped.
+func (hd *hetznerDriver) trimVolumes(now time.Time, interval time.Duration) error {
+	mounts, err := getMounts()
+	if err != nil {
+		return fmt.Errorf("getting local mounts: %w", err)
+	}
+
+	mountpoints := map[string]string{}
+	var names []string
+	for _, m := range hd.usage.mountedSnapshot() {
+		if m.vol.Labels[trimLabel] == "false" || m.vol.Labels[readonlyLabel] == "true" {
+			continue
+		}
+		mountpoint, ok := deviceMountpoint(mounts, m.vol.LinuxDevice)
+		if !ok {
+			continue
+		}
+		name := unprefixedName(m.vol)
+		mountpoints[name] = mountpoint
+		names = append(names, name)
+	}
+
+	for _, name := range hd.trim.dueVolumes(names, now, interval) {
+		start := time.Now()
+		trimmed, err := fstrim(mountpoints[name])
+		if err != nil {
+			logrus.Warnf("trimming volume %q: %v", name, err)
+			continue
+		}
+		hd.trim.record(name, trimmed, now)
+		logrus.Infof("trimmed %s of volume %q in %s", formatBytes(int64(trimmed)), name, time.Since(start).Round(time.Millisecond))
+	}
+	return nil
+}
+
+// runTrimScheduler trims each mounted volume once per interval, until stop is closed
+func (hd *hetznerDriver) runTrimScheduler(interval time.Duration, stop <-chan struct{}) {
+	logrus.Infof("trimming mounted volumes every %s", interval)
+
+	ticker := time.NewTicker(min(interval, trimCheckInterval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			if err := hd.ops.begin(); err != nil {
+				return
+			}
+			if err := hd.trimVolumes(now, interval); err != nil {
+				logrus.Warnf("trimming volumes: %v", err)
+			}
+			hd.ops.end()
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+func Test_nextTrim(t *testing.T) {
+	interval := time.Hour
+	now := time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)
+
+	offsets := map[time.Duration]bool{}
+	for _, name := range []string{"foo", "bar", "baz", "qux"} {
+		next := nextTrim(name, now, interval)
+		if !next.After(now) || next.Sub(now) > interval {
+			t.Errorf("nextTrim(%q) = %v, want within %s after %v", name, next, interval, now)
+		}
+		// stable within the interval
+		if again := nextTrim(name, now.Add(-time.Minute), interval); next.Sub(now) > time.Minute && !again.Equal(next) {
+			t.Errorf("nextTrim(%q) a minute earlier = %v, want %v", name, again, next)
+		}
+		if after := nextTrim(name, next, interval); !after.Equal(next.Add(interval)) {
+			t.Errorf("nextTrim(%q) after a trim = %v, want %v", name, after, next.Add(interval))
+		}
+		offsets[next.Sub(now.Truncate(interval))%interval] = true
+	}
+	if len(offsets) < 2 {
+		t.Errorf("volumes are all trimmed at the same offset %v", offsets)
+	}
+}
+
+func Test_trimState_dueVolumes(t *testing.T) {
+	var s trimState
+	interval := time.Hour
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	if got := s.dueVolumes([]string{"foo"}, now, interval); len(got) != 0 {
+		t.Errorf("dueVolumes() on first sight = %v, want none", got)
+	}
+	due := nextTrim("foo", now, interval)
+	if got := s.dueVolumes([]string{"foo"}, due.Add(-time.Second), interval); len(got) != 0 {
+		t.Errorf("dueVolumes() before due = %v, want none", got)
+	}
+	if got := s.dueVolumes([]string{"foo"}, due, interval); len(got) != 1 {
+		t.Errorf("dueVolumes() when due = %v, want foo", got)
+	}
+	if got := s.dueVolumes([]string{"foo"}, due.Add(time.Second), interval); len(got) != 0 {
+		t.Errorf("dueVolumes() right after trimming = %v, want none", got)
+	}
+
+	// forgotten once unmounted
+	s.dueVolumes(nil, due, interval)
+	if got := s.dueVolumes([]string{"foo"}, due.Add(interval), interval); len(got) != 0 {
+		t.Errorf("dueVolumes() after remounting = %v, want none", got)
+	}
+}
+
+func Test_loopHarness_trim(t *testing.T) {
+	t.Setenv("use_protection", "false")
+
+	h := newLoopHarness(t)
+	hd := h.driver()
+
+	for _, req := range []*volume.CreateRequest{
+		{Name: "foo"},
+		{Name: "bar", Options: map[string]string{"trim": "false"}},
+	} {
+		if err := hd.Create(req); err != nil {
+			t.Fatalf("hetznerDriver.Create() error = %v", err)
+		}
+		id := req.Name + "-id"
+		if _, err := hd.Mount(&volume.MountRequest{Name: req.Name, ID: id}); err != nil {
+			t.Fatalf("hetznerDriver.Mount() error = %v", err)
+		}
+		name := req.Name
+		t.Cleanup(func() { _ = hd.Unmount(&volume.UnmountRequest{Name: name, ID: id}) })
+	}
+
+	// volumes are taken from the last usage check
+	if err := hd.checkUsage(); err != nil {
+		t.Fatalf("hetznerDriver.checkUsage() error = %v", err)
+	}
+	listed := len(h.mock.getCalls())
+
+	interval := time.Hour
+	now := time.Now()
+	for _, at := range []time.Time{now, now.Add(interval)} {
+		if err := hd.trimVolumes(at, interval); err != nil {
+			t.Fatalf("hetznerDriver.trimVolumes() error = %v", err)
+		}
+	}
+
+	for _, call := range h.mock.getCalls()[listed:] {
+		t.Errorf("hetznerDriver.trimVolumes() called %s", call)
+	}
+
+	_, last := hd.trim.snapshot()
+	if _, ok := last["foo"]; !ok || len(last) != 1 {
+		t.Errorf("trimmed volumes = %v, want only foo", last)
+	}
+
+	var buf bytes.Buffer
+	if err := writeMetrics(&buf, hd.metrics()); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `docker_volume_hetzner_volume_trimmed_bytes_total{volume="foo"}`) {
+		t.Errorf("metrics lack trimmed bytes of foo:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	defaultUnmountRetries = 5
+	defaultReleaseTimeout = 10 * time.Second
+)
+
+// first delay between unmount attempts, doubled after each one
+var unmountBackoff = 100 * time.Millisecond
+
+// procPath is where process information is read from; only changed in tests
+var procPath = "/proc"
+
+func unmountRetries() int {
+	n, err := strconv.Atoi(os.Getenv("unmount_retries"))
+	if err != nil || n < 0 {
+		return defaultUnmountRetries
+	}
+	return n
+}
+
+func lazyUnmount() bool {
+	return os.Getenv("unmount_lazy") == "true"
+}
+
+func releaseTimeout() time.Duration {
+	d, err := time.ParseDuration(os.Getenv("release_timeout"))
+	if err != nil || d <= 0 {
+		return defaultReleaseTimeout
+	}
+	return d
+}
+
+// mountHolder is a process keeping a filesystem busy
+type mountHolder struct {
+	PID  int
+	Comm string
+}
+
+func (h mountHolder) String() string {
+	return fmt.Sprintf("%s (pid %d)", h.Comm, h.PID)
+}
+
+// errMountBusy is returned when a filesystem could not be unmounted because it's still in use
+type errMountBusy struct {
+	mountpoint string
+	holders    []mountHolder
+}
+
+func (e *errMountBusy) Error() string {
+	if len(e.holders) == 0 {
+		return fmt.Sprintf("%s is busy", e.mountpoint)
+	}
+	holders := make([]string, 0, len(e.holders))
+	for _, h := range e.holders {
+		holders = append(holders, h.String())
+	}
+	return fmt.Sprintf("%s is busy; held by %s", e.mountpoint, strings.Join(holders, ", "))
+}
+
+// unmountVolume syncs and unmounts the filesystem on mountpoint, retrying with backoff while it's busy. If it stays
+// busy, it's lazily unmounted if enabled; otherwise an error naming the processes holding it is returned. Mountpoints
+// not mounted are left alone.
+func unmountVolume(mountpoint string) error {
+	syncFilesystem(mountpoint)
+
+	backoff := unmountBackoff
+	for attempt := 0; ; attempt++ {
+		err := unix.Unmount(mountpoint, 0)
+		switch {
+		case err == nil:
+			return nil
+		case errors.Is(err, unix.EINVAL), errors.Is(err, unix.ENOENT):
+			// not mounted (anymore)
+			return nil
+		case !errors.Is(err, unix.EBUSY):
+			return fmt.Errorf("unmounting %q: %w", mountpoint, err)
+		}
+
+		if attempt >= unmountRetries() {
+			break
+		}
+		logrus.Infof("%s busy; retrying unmount in %s", mountpoint, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+
+	busy := &errMountBusy{mountpoint: mountpoint, holders: mountHolders(mountpoint)}
+	if !lazyUnmount() {
+		return busy
+	}
+
+	logrus.Warnf("%v; unmounting lazily", busy)
+	if err := unix.Unmount(mountpoint, unix.MNT_DETACH); err != nil {
+		return fmt.Errorf("lazily unmounting %q: %w", mountpoint, err)
+	}
+	return nil
+}
+
+// syncFilesystem flushes the filesystem on mountpoint, so as little as possible is lost if it can't be unmounted
+func syncFilesystem(mountpoint string) {
+	f, err := os.Open(mountpoint)
+	if err != nil {
+		logrus.Warnf("opening %q for sync: %v", mountpoint, err)
+		return
+	}
+	defer f.Close()
+
+	if err := unix.Syncfs(int(f.Fd())); err != nil {
+		logrus.Warnf("syncing %q: %v", mountpoint, err)
+	}
+}
+
+// mountHolders scans procPath for processes with open files, working directories or roots on the filesystem mounted on
+// mountpoint. Bind mounts of the same filesystem can't be told apart, so processes using those are reported too.
+// Seeing the processes of containers takes the host PID namespace and CAP_SYS_PTRACE, both granted by config.json.
+func mountHolders(mountpoint string) []mountHolder {
+	var st syscall.Stat_t
+	if err := syscall.Stat(mountpoint, &st); err != nil {
+		return nil
+	}
+	dev := st.Dev
+
+	onDevice := func(path string) bool {
+		var st syscall.Stat_t
+		return syscall.Stat(path, &st) == nil && st.Dev == dev
+	}
+
+	entries, err := os.ReadDir(procPath)
+	if err != nil {
+		return nil
+	}
+
+	var holders []mountHolder
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil || pid == os.Getpid() {
+			continue
+		}
+		dir := filepath.Join(procPath, e.Name())
+
+		held := onDevice(filepath.Join(dir, "cwd")) || onDevice(filepath.Join(dir, "root")) || onDevice(filepath.Join(dir, "exe"))
+		if !held {
+			fds, _ := os.ReadDir(filepath.Join(dir, "fd"))
+			for _, fd := range fds {
+				if onDevice(filepath.Join(dir, "fd", fd.Name())) {
+					held = true
+					break
+				}
+			}
+		}
+		if !held {
+			continue
+		}
+
+		comm, _ := os.ReadFile(filepath.Join(dir, "comm"))
+		holders = append(holders, mountHolder{PID: pid, Comm: strings.TrimSpace(string(comm))})
+	}
+	return holders
+}
+
+// deviceReleased reports whether the kernel has let go of dev, i.e. it's neither mounted (even lazily) nor otherwise
+// held exclusively
+func deviceReleased(dev string) bool {
+	fd, err := unix.Open(dev, unix.O_RDONLY|unix.O_EXCL|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return !errors.Is(err, unix.EBUSY)
+	}
+	unix.Close(fd)
+	return true
+}
+
+// waitForDeviceRelease waits until dev is released by the kernel, so it can be detached without losing data
+func waitForDeviceRelease(dev string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for !deviceReleased(dev) {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("device %q still in use after %s", dev, timeout)
+		}
+		time.Sleep(devicePollInterval)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/pkg/mount"
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+// holdMount starts a process with its working directory on mountpoint, keeping it busy until the test ends
+func holdMount(t *testing.T, mountpoint string) *exec.Cmd {
+	t.Helper()
+
+	cmd := exec.Command("sleep", "60")
+	cmd.Dir = mountpoint
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+	return cmd
+}
+
+func Test_unmountVolume(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("mounting requires root")
+	}
+	defer func(orig time.Duration) { unmountBackoff = orig }(unmountBackoff)
+	unmountBackoff = time.Millisecond
+	t.Setenv("unmount_retries", "2")
+
+	mountpoint := t.TempDir()
+	if err := mount.Mount("tmpfs", mountpoint, "tmpfs", ""); err != nil {
+		t.Skipf("mounting tmpfs: %v", err)
+	}
+	t.Cleanup(func() { _ = mount.Unmount(mountpoint) })
+
+	holder := holdMount(t, mountpoint)
+
+	t.Setenv("unmount_lazy", "false")
+	err := unmountVolume(mountpoint)
+	var busy *errMountBusy
+	if !errors.As(err, &busy) {
+		t.Fatalf("unmountVolume() error = %v, want busy error", err)
+	}
+	if len(busy.holders) != 1 || busy.holders[0].PID != holder.Process.Pid || busy.holders[0].Comm != "sleep" {
+		t.Errorf("unmountVolume() holders = %v, want sleep (pid %d)", busy.holders, holder.Process.Pid)
+	}
+	if mounted, _ := mount.Mounted(mountpoint); !mounted {
+		t.Error("busy filesystem unmounted")
+	}
+
+	t.Setenv("unmount_lazy", "true")
+	if err := unmountVolume(mountpoint); err != nil {
+		t.Errorf("unmountVolume() error = %v", err)
+	}
+	if mounted, _ := mount.Mounted(mountpoint); mounted {
+		t.Error("filesystem still mounted after lazy unmount")
+	}
+
+	// not mounted anymore
+	if err := unmountVolume(mountpoint); err != nil {
+		t.Errorf("unmountVolume() on unmounted dir error = %v", err)
+	}
+}
+
+func Test_loopHarness_unmountBusy(t *testing.T) {
+	defer func(orig time.Duration) { unmountBackoff = orig }(unmountBackoff)
+	unmountBackoff = time.Millisecond
+	t.Setenv("use_protection", "false")
+	t.Setenv("unmount_retries", "1")
+	t.Setenv("release_timeout", "100ms")
+
+	h := newLoopHarness(t)
+	hd := h.driver()
+
+	if err := hd.Create(&volume.CreateRequest{Name: "foo"}); err != nil {
+		t.Fatalf("hetznerDriver.Create() error = %v", err)
+	}
+	resp, err := hd.Mount(&volume.MountRequest{Name: "foo", ID: "some-id"})
+	if err != nil {
+		t.Fatalf("hetznerDriver.Mount() error = %v", err)
+	}
+	t.Cleanup(func() { _ = mount.Unmount(resp.Mountpoint) })
+
+	vol, err := hd.getVolume("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deviceReleased(vol.LinuxDevice) {
+		t.Error("mounted device reported as released")
+	}
+
+	holder := holdMount(t, resp.Mountpoint)
+
+	t.Setenv("unmount_lazy", "false")
+	if err := hd.Unmount(&volume.UnmountRequest{Name: "foo", ID: "some-id"}); err == nil {
+		t.Error("hetznerDriver.Unmount() succeeded on busy volume")
+	}
+
+	// the lazily unmounted filesystem keeps holding the device, so the volume must stay attached
+	t.Setenv("unmount_lazy", "true")
+	if err := hd.Unmount(&volume.UnmountRequest{Name: "foo", ID: "some-id"}); err != nil {
+		t.Fatalf("hetznerDriver.Unmount() error = %v", err)
+	}
+	if _, err := os.Stat(resp.Mountpoint); !os.IsNotExist(err) {
+		t.Errorf("mountpoint %s not removed: %v", resp.Mountpoint, err)
+	}
+	if vol, _ := hd.getVolume("foo"); vol.Server == nil {
+		t.Error("volume detached while its device was still in use")
+	}
+
+	_ = holder.Process.Kill()
+	_ = holder.Wait()
+	if err := waitForDeviceRelease(vol.LinuxDevice, time.Second); err != nil {
+		t.Errorf("device not released after holder exited: %v", err)
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	defaultUsageCheckInterval    = time.Minute
+	defaultUsageWarningThreshold = 90
+	defaultInodeWarningThreshold = 90
+)
+
+func usageCheckInterval() time.Duration {
+	d, err := time.ParseDuration(os.Getenv("usage_check_interval"))
+	if err != nil || d <= 0 {
+		return defaultUsageCheckInterval
+	}
+	return d
+}
+
+// usageWarningThreshold is the percentage of used space above which mounted volumes are warned about; 0 disables it
+func usageWarningThreshold() float64 {
+	return parseThreshold("usage_warning_threshold", defaultUsageWarningThreshold)
+}
+
+// inodeWarningThreshold is the percentage of used inodes above which mounted volumes are warned about; 0 disables it
+func inodeWarningThreshold() float64 {
+	return parseThreshold("inode_warning_threshold", defaultInodeWarningThreshold)
+}
+
+func parseThreshold(name string, def float64) float64 {
+	v, err := strconv.ParseFloat(os.Getenv(name), 64)
+	if err != nil || v < 0 || v > 100 {
+		return def
+	}
+	return v
+}
+
+// volumeUsage is the space and inode usage of a mounted filesystem
+type volumeUsage struct {
+	SizeBytes      uint64
+	UsedBytes      uint64
+	AvailableBytes uint64
+	Inodes         uint64
+	InodesUsed     uint64
+	InodesFree     uint64
+}
+
+func statUsage(mountpoint string) (volumeUsage, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(mountpoint, &st); err != nil {
+		return volumeUsage{}, fmt.Errorf("getting filesystem usage of %s: %w", mountpoint, err)
+	}
+	bsize := uint64(st.Bsize)
+	return volumeUsage{
+		SizeBytes: st.Blocks * bsize,
+		UsedBytes: (st.Blocks - st.Bfree) * bsize,
+		// space reserved for root isn't available to containers
+		AvailableBytes: st.Bavail * bsize,
+		Inodes:         st.Files,
+		InodesUsed:     st.Files - st.Ffree,
+		InodesFree:     st.Ffree,
+	}, nil
+}
+
+// usedPercent is the percentage of space used, as reported by df, i.e. not counting space reserved for root
+func (u volumeUsage) usedPercent() float64 {
+	if u.UsedBytes+u.AvailableBytes == 0 {
+		return 0
+	}
+	return float64(u.UsedBytes) / float64(u.UsedBytes+u.AvailableBytes) * 100
+}
+
+func (u volumeUsage) inodesUsedPercent() float64 {
+	if u.Inodes == 0 {
+		return 0
+	}
+	return float64(u.InodesUsed) / float64(u.Inodes) * 100
+}
+
+// addStatus adds the usage to a volume's status, as shown by docker volume inspect
+func (u volumeUsage) addStatus(status map[string]interface{}) {
+	status["size_bytes"] = u.SizeBytes
+	status["used_bytes"] = u.UsedBytes
+	status["available_bytes"] = u.AvailableBytes
+	status["used_percent"] = roundPercent(u.usedPercent())
+	status["inodes"] = u.Inodes
+	status["inodes_used"] = u.InodesUsed
+	status["inodes_free"] = u.InodesFree
+	status["inodes_used_percent"] = roundPercent(u.inodesUsedPercent())
+}
+
+func roundPercent(p float64) float64 {
+	return float64(int64(p*10+0.5)) / 10
+}
+
+// usageState holds the volumes mounted and their usage as of the last check, and which ones are above the warning
+// thresholds
+type usageState struct {
+	mu      sync.Mutex
+	mounted []mountedVolume
+	usage   map[string]volumeUsage
+	warned  map[string]bool
+}
+
+func (s *usageState) snapshot() map[string]volumeUsage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	usage := make(map[string]volumeUsage, len(s.usage))
+	for name, u := range s.usage {
+		usage[name] = u
+	}
+	return usage
+}
+
+// mountedSnapshot returns the volumes found mounted by the last check, sparing other periodic tasks from listing volumes
+// themselves
+func (s *usageState) mountedSnapshot() []mountedVolume {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]mountedVolume(nil), s.mounted...)
+}
+
+// mountedVolume is a managed volume mounted locally
+type mountedVolume struct {
+	vol *hcloud.Volume
+	// one of its mountpoints, if mounted more than once
+	mountpoint string
+}
+
+// mountedVolumes returns the managed volumes mounted locally. Volumes are only listed if the plugin has mounted anything,
+// so idle nodes don't query the API.
+func (hd *hetznerDriver) mountedVolumes() ([]mountedVolume, error) {
+	mounts, err := getMounts()
+	if err != nil {
+		return nil, fmt.Errorf("getting local mounts: %w", err)
+	}
+	if !hasPluginMounts(mounts) {
+		return nil, nil
+	}
+
+	vols, err := hd.managedVolumes()
+	if err != nil {
+		return nil, err
+	}
+
+	var mounted []mountedVolume
+	for _, vol := range vols {
+		if mountpoint, ok := deviceMountpoint(mounts, vol.LinuxDevice); ok {
+			mounted = append(mounted, mountedVolume{vol, mountpoint})
+		}
+	}
+	return mounted, nil
+}
+
+// hasPluginMounts reports whether anything is mounted below the propagated mount path, where the plugin mounts volumes
+func hasPluginMounts(mounts map[string]string) bool {
+	for _, mountpoint := range mounts {
+		if strings.HasPrefix(mountpoint, propagatedMountPath+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// checkUsage records the usage of all locally mounted volumes and warns about those crossing the warning thresholds.
+// Volumes are only warned about again after dropping below the thresholds in between. Volumes crossing their autogrow
+// threshold are grown afterwards.
+func (hd *hetznerDriver) checkUsage() error {
+	mounted, err := hd.mountedVolumes()
+	if err != nil {
+		return err
+	}
+
+	hd.usage.mu.Lock()
+
+	usage := map[string]volumeUsage{}
+	warned := map[string]bool{}
+	for _, m := range mounted {
+		u, err := statUsage(m.mountpoint)
+		if err != nil {
+			logrus.Warnf("%v", err)
+			continue
+		}
+		name := unprefixedName(m.vol)
+		usage[name] = u
+
+		for _, c := range []struct {
+			event     string
+			what      string
+			percent   float64
+			threshold float64
+		}{
+			{auditUsageWarning, "space", u.usedPercent(), usageWarningThreshold()},
+			{auditInodeWarning, "inodes", u.inodesUsedPercent(), inodeWarningThreshold()},
+		} {
+			key := name + "/" + c.what
+			if c.threshold == 0 || c.percent < c.threshold {
+				if hd.usage.warned[key] {
+					logrus.Infof("volume %q back below the %s warning threshold of %g%% with %.1f%% used", name, c.what, c.threshold, c.percent)
+				}
+				continue
+			}
+			warned[key] = true
+			if hd.usage.warned[key] {
+				continue
+			}
+			detail := fmt.Sprintf("%.1f%% of %s used, above the warning threshold of %g%%", c.percent, c.what, c.threshold)
+			logrus.Warnf("volume %q has %s", name, detail)
+			hd.audit(auditEvent{Event: c.event, Detail: detail}, name, m.vol, time.Now(), nil)
+		}
+	}
+	hd.usage.mounted = mounted
+	hd.usage.usage = usage
+	hd.usage.warned = warned
+	hd.usage.mu.Unlock()
+
+	hd.autogrowVolumes(mounted, usage, time.Now())
+
+	return nil
+}
+
+// runUsageMonitor checks the usage of mounted volumes right away and then periodically, until stop is closed
+func (hd *hetznerDriver) runUsageMonitor(stop <-chan struct{}) {
+	interval := usageCheckInterval()
+	logrus.Infof("checking usage of mounted volumes every %s", interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := hd.ops.begin(); err != nil {
+			return
+		}
+		if err := hd.checkUsage(); err != nil {
+			logrus.Warnf("checking volume usage: %v", err)
+		}
+		hd.ops.end()
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
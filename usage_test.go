@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+func Test_volumeUsage_percent(t *testing.T) {
+	tests := []struct {
+		name       string
+		u          volumeUsage
+		wantUsed   float64
+		wantInodes float64
+	}{
+		{"empty", volumeUsage{}, 0, 0},
+		// reserved blocks count neither as used nor as available
+		{"reserved", volumeUsage{SizeBytes: 100, UsedBytes: 45, AvailableBytes: 45, Inodes: 10, InodesUsed: 1, InodesFree: 9}, 50, 10},
+		{"full", volumeUsage{SizeBytes: 100, UsedBytes: 95, Inodes: 10, InodesUsed: 10}, 100, 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.u.usedPercent(); got != tt.wantUsed {
+				t.Errorf("volumeUsage.usedPercent() = %v, want %v", got, tt.wantUsed)
+			}
+			if got := tt.u.inodesUsedPercent(); got != tt.wantInodes {
+				t.Errorf("volumeUsage.inodesUsedPercent() = %v, want %v", got, tt.wantInodes)
+			}
+		})
+	}
+}
+
+func Test_writeMetrics(t *testing.T) {
+	var buf bytes.Buffer
+	err := writeMetrics(&buf, []metricFamily{
+		{name: "volume_used_bytes", help: "Space used.", typ: "gauge", samples: map[string]float64{"foo": 1024, `b"a\r`: 0.5}},
+		{name: "empty", help: "Nothing.", typ: "counter"},
+	})
+	if err != nil {
+		t.Fatalf("writeMetrics() error = %v", err)
+	}
+
+	want := `# HELP docker_volume_hetzner_volume_used_bytes Space used.
+# TYPE docker_volume_hetzner_volume_used_bytes gauge
+docker_volume_hetzner_volume_used_bytes{volume="b\"a\\r"} 0.5
+docker_volume_hetzner_volume_used_bytes{volume="foo"} 1024
+# HELP docker_volume_hetzner_empty Nothing.
+# TYPE docker_volume_hetzner_empty counter
+`
+	if got := buf.String(); got != want {
+		t.Errorf("writeMetrics() = %q, want %q", got, want)
+	}
+}
+
+func Test_hetznerDriver_checkUsage_idle(t *testing.T) {
+	defer func(orig string) { propagatedMountPath = orig }(propagatedMountPath)
+	propagatedMountPath = t.TempDir()
+
+	m := newMockClient()
+	m.addVolume("foo", "fsn1", m.servers[1])
+	hd := &hetznerDriver{client: m}
+
+	if err := hd.checkUsage(); err != nil {
+		t.Fatalf("hetznerDriver.checkUsage() error = %v", err)
+	}
+	if calls := m.getCalls(); len(calls) != 0 {
+		t.Errorf("calls without mounted volumes = %v, want none", calls)
+	}
+}
+
+func Test_loopHarness_checkUsage(t *testing.T) {
+	t.Setenv("use_protection", "false")
+	t.Setenv("usage_warning_threshold", "0.5")
+	t.Setenv("inode_warning_threshold", "0")
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	t.Setenv("audit_log", path)
+
+	h := newLoopHarness(t)
+	hd := h.driver()
+
+	if err := hd.Create(&volume.CreateRequest{Name: "foo"}); err != nil {
+		t.Fatalf("hetznerDriver.Create() error = %v", err)
+	}
+	resp, err := hd.Mount(&volume.MountRequest{Name: "foo", ID: "some-id"})
+	if err != nil {
+		t.Fatalf("hetznerDriver.Mount() error = %v", err)
+	}
+	t.Cleanup(func() { _ = hd.Unmount(&volume.UnmountRequest{Name: "foo", ID: "some-id"}) })
+
+	if err := hd.checkUsage(); err != nil {
+		t.Fatalf("hetznerDriver.checkUsage() error = %v", err)
+	}
+	before := hd.usage.snapshot()["foo"]
+	if before.SizeBytes == 0 || before.Inodes == 0 {
+		t.Fatalf("usage of mounted volume = %+v, want size and inodes", before)
+	}
+
+	// fill the volume past the threshold
+	if err := os.WriteFile(filepath.Join(resp.Mountpoint, "data"), make([]byte, before.SizeBytes/100), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := hd.checkUsage(); err != nil {
+			t.Fatalf("hetznerDriver.checkUsage() error = %v", err)
+		}
+	}
+	after := hd.usage.snapshot()["foo"]
+	if after.UsedBytes <= before.UsedBytes || after.InodesUsed <= before.InodesUsed {
+		t.Errorf("usage after writing = %+v, want more than %+v", after, before)
+	}
+
+	var warnings []auditEvent
+	for _, e := range readAuditLog(t, path) {
+		if e.Event == auditUsageWarning || e.Event == auditInodeWarning {
+			warnings = append(warnings, e)
+		}
+	}
+	if len(warnings) != 1 || warnings[0].Event != auditUsageWarning || warnings[0].Volume != "foo" || warnings[0].Detail == "" {
+		t.Errorf("warning events = %+v, want a single usage warning for foo", warnings)
+	}
+
+	got, err := hd.Get(&volume.GetRequest{Name: "foo"})
+	if err != nil {
+		t.Fatalf("hetznerDriver.Get() error = %v", err)
+	}
+	for _, k := range []string{"used_bytes", "available_bytes", "inodes_used", "inodes_free"} {
+		if _, ok := got.Volume.Status[k]; !ok {
+			t.Errorf("hetznerDriver.Get() status %v lacks %s", got.Volume.Status, k)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := writeMetrics(&buf, hd.metrics()); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `docker_volume_hetzner_volume_used_bytes{volume="foo"}`) {
+		t.Errorf("metrics lack used bytes of foo:\n%s", buf.String())
+	}
+}